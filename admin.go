@@ -0,0 +1,224 @@
+package butler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// admin serves an API for managing a running server. Like the registrar, it
+// only listens on localhost.
+//
+//	GET /cache                lists cache entries, filtered by the url,
+//	                          prefix or surrogate-key query parameters
+//	POST /cache/purge         purges the cache entries selected by a JSON
+//	                          CacheFilter
+//	GET /splits               lists the weights of every split
+//	PUT /splits/<rule>        sets the weights of the split of a rule from a
+//	                          JSON object of target names to weights
+//	GET /backends             lists the passive health of every backend,
+//	                          including whether it is ejected
+//	GET /pools                lists the requests in flight to every pool,
+//	                          and those waiting in its queue
+type admin struct {
+	backingServer *Server
+	adminServer   *Server
+}
+
+func newAdmin(port int, server *Server) (*admin, error) {
+	s, err := NewServer(&Config{
+		Host:      "localhost",
+		Listen:    port,
+		ListenTLS: -1,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a := &admin{server, s}
+	s.httpListener.handlers = append(s.httpListener.handlers, adminHandler{a})
+	return a, nil
+}
+
+func (a *admin) Listen() error {
+	return a.adminServer.Listen()
+}
+
+func (a *admin) Close() error {
+	return a.adminServer.Close()
+}
+
+// caches returns the cache of every site that has one.
+func (a *admin) caches() []*cache {
+	var caches []*cache
+	for _, st := range a.backingServer.sites.all() {
+		if st.cache != nil {
+			caches = append(caches, st.cache)
+		}
+	}
+	return caches
+}
+
+type adminHandler struct {
+	a *admin
+}
+
+func (h adminHandler) Handle(c *Context) (bool, error) {
+	path, query, _ := strings.Cut(c.Request.Path, "?")
+
+	rule, isSplit := strings.CutPrefix(path, "/splits/")
+
+	switch {
+	case path == "/cache" && c.Request.Method == RequestGet:
+		return h.listCache(c, query)
+	case path == "/cache/purge" && c.Request.Method == "POST":
+		return h.purgeCache(c)
+	case path == "/splits" && c.Request.Method == RequestGet:
+		return h.listSplits(c)
+	case isSplit && rule != "" && c.Request.Method == "PUT":
+		return h.setSplitWeights(c, rule)
+	case path == "/backends" && c.Request.Method == RequestGet:
+		return h.listBackends(c)
+	case path == "/pools" && c.Request.Method == RequestGet:
+		return h.listPools(c)
+	case path == "/cache" || path == "/cache/purge" || path == "/splits" || isSplit || path == "/backends" || path == "/pools":
+		c.Response = MethodNotAllowed()
+	default:
+		c.Response = NotFound()
+	}
+	return true, nil
+}
+
+func (h adminHandler) listCache(c *Context, query string) (bool, error) {
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		c.Response = BadRequest()
+		return true, nil
+	}
+
+	f := CacheFilter{URL: q.Get("url"), Prefix: q.Get("prefix"), SurrogateKey: q.Get("surrogate-key")}
+	if f.validate() != nil {
+		c.Response = BadRequest()
+		return true, nil
+	}
+
+	entries := make([]CacheEntryInfo, 0)
+	for _, ch := range h.a.caches() {
+		entries = append(entries, ch.list(f)...)
+	}
+
+	return writeJSON(c, http.StatusOK, entries)
+}
+
+func (h adminHandler) purgeCache(c *Context) (bool, error) {
+	body, err := c.Request.ReadBody()
+	if err != nil {
+		return false, err
+	}
+
+	f := CacheFilter{}
+	err = json.Unmarshal(body, &f)
+	if err != nil || f.isZero() || f.validate() != nil {
+		c.Response = BadRequest()
+		return true, nil
+	}
+
+	purged := 0
+	for _, ch := range h.a.caches() {
+		purged += ch.purge(f)
+	}
+
+	return writeJSON(c, http.StatusOK, struct{ Purged int }{purged})
+}
+
+func (h adminHandler) listSplits(c *Context) (bool, error) {
+	splits := make([]SplitInfo, 0)
+	for _, st := range h.a.backingServer.sites.all() {
+		for _, sp := range st.splits {
+			splits = append(splits, sp.info(st.name))
+		}
+	}
+
+	return writeJSON(c, http.StatusOK, splits)
+}
+
+// setSplitWeights sets the weights of every split of the rule, in case sites
+// share a rule name.
+func (h adminHandler) setSplitWeights(c *Context, rule string) (bool, error) {
+	body, err := c.Request.ReadBody()
+	if err != nil {
+		return false, err
+	}
+
+	weights := map[string]int{}
+	err = json.Unmarshal(body, &weights)
+	if err != nil || len(weights) == 0 {
+		c.Response = BadRequest()
+		return true, nil
+	}
+
+	var updated []SplitInfo
+	for _, st := range h.a.backingServer.sites.all() {
+		for _, sp := range st.splits {
+			if sp.name != rule {
+				continue
+			}
+
+			err := sp.setWeights(weights)
+			if err != nil {
+				c.Response = StatusCode(http.StatusBadRequest, []byte(err.Error()))
+				return true, nil
+			}
+			slog.Info(fmt.Sprintf("split %s weights set to %v", rule, weights))
+			updated = append(updated, sp.info(st.name))
+		}
+	}
+
+	if len(updated) == 0 {
+		c.Response = NotFound()
+		return true, nil
+	}
+
+	return writeJSON(c, http.StatusOK, updated)
+}
+
+func (h adminHandler) listBackends(c *Context) (bool, error) {
+	backends := make([]BackendHealth, 0)
+	for _, st := range h.a.backingServer.sites.all() {
+		for _, p := range st.allPools() {
+			for _, bh := range p.health() {
+				bh.Site = st.name
+				backends = append(backends, bh)
+			}
+		}
+	}
+
+	return writeJSON(c, http.StatusOK, backends)
+}
+
+func (h adminHandler) listPools(c *Context) (bool, error) {
+	pools := make([]PoolStats, 0)
+	for _, st := range h.a.backingServer.sites.all() {
+		for _, p := range st.allPools() {
+			ps := p.stats()
+			ps.Site = st.name
+			pools = append(pools, ps)
+		}
+	}
+
+	return writeJSON(c, http.StatusOK, pools)
+}
+
+func writeJSON(c *Context, status int, v any) (bool, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+
+	c.Response = StatusCode(status, b)
+	c.Response.Headers[HeaderContentType] = []string{"application/json"}
+	return true, nil
+}
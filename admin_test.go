@@ -0,0 +1,172 @@
+package butler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminCache(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		switch r.URL.Path {
+		case "/a":
+			w.Header().Set("Surrogate-Key", "products")
+		case "/b":
+			w.Header().Set("Surrogate-Key", "products home")
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	s, url := startServer(t, &Config{
+		Host:        "127.0.0.1",
+		Listen:      0,
+		ListenTLS:   -1,
+		Backends:    []Backend{{Addr: upstream.Listener.Addr().String(), Path: "/"}},
+		Cache:       Cache{MaxSize: 1 << 20},
+		Admin:       true,
+		AdminListen: 0,
+	})
+	<-s.admin.adminServer.httpListener.readyCh
+	adminURL := "http://" + s.admin.adminServer.httpListener.listener.Addr().String()
+	client := cacheClient(t)
+
+	populate := func() {
+		for _, p := range []string{"/a", "/b", "/c/d"} {
+			resp, _ := cacheGet(t, client, "GET", url+p, nil)
+			if resp.Header.Get("Surrogate-Key") != "" {
+				t.Fatal("expected surrogate keys not to be sent to clients")
+			}
+		}
+	}
+
+	list := func(query string) []CacheEntryInfo {
+		resp, err := http.Get(adminURL + "/cache" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var entries []CacheEntryInfo
+		err = json.NewDecoder(resp.Body).Decode(&entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+
+	populate()
+	cacheGet(t, client, "GET", url+"/a", nil)
+
+	entries := list("")
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries but got %v", entries)
+	}
+	if e := entries[0]; e.URL != url+"/a" || e.Hits != 1 || e.Tier != "memory" || e.Size == 0 || len(e.SurrogateKeys) != 1 {
+		t.Fatalf("expected the most recently used entry to be /a, hit once, but got %+v", e)
+	}
+	if got := list("?surrogate-key=products"); len(got) != 2 {
+		t.Fatalf("expected 2 entries tagged products but got %v", got)
+	}
+
+	cases := []struct {
+		n      string
+		filter string
+		status int
+		purged int
+		left   int
+	}{
+		{"URL", `{"URL": "` + url + `/a"}`, http.StatusOK, 1, 2},
+		{"Prefix", `{"Prefix": "` + url + `/c/"}`, http.StatusOK, 1, 2},
+		{"SurrogateKey", `{"SurrogateKey": "products"}`, http.StatusOK, 2, 1},
+		{"Empty", `{}`, http.StatusBadRequest, 0, 3},
+		{"Ambiguous", `{"URL": "` + url + `/a", "Prefix": "/"}`, http.StatusBadRequest, 0, 3},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			populate()
+
+			resp, err := http.Post(adminURL+"/cache/purge", "application/json", bytes.NewReader([]byte(c.filter)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != c.status {
+				t.Fatalf("expected %v but got %v", c.status, resp.StatusCode)
+			}
+
+			if c.status == http.StatusOK {
+				var result struct{ Purged int }
+				json.NewDecoder(resp.Body).Decode(&result)
+				if result.Purged != c.purged {
+					t.Fatalf("expected %v purged but got %v", c.purged, result.Purged)
+				}
+			}
+
+			if left := list(""); len(left) != c.left {
+				t.Fatalf("expected %v entries left but got %v", c.left, left)
+			}
+		})
+	}
+}
+
+func TestAdminBackends(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	healthy := startNamedUpstream(t, "healthy")
+
+	s, url := startServer(t, &Config{
+		Listen:    0,
+		ListenTLS: -1,
+		Backends: []Backend{
+			{Addr: failing.Listener.Addr().String(), Path: "/failing", BreakerThreshold: 2},
+			{Addr: healthy, Path: "/healthy"},
+		},
+		Admin:       true,
+		AdminListen: 0,
+	})
+	<-s.admin.adminServer.httpListener.readyCh
+	adminURL := "http://" + s.admin.adminServer.httpListener.listener.Addr().String()
+
+	for range 2 {
+		getBody(t, url+"/failing", nil)
+		getBody(t, url+"/healthy", nil)
+	}
+
+	resp, err := http.Get(adminURL + "/backends")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var backends []BackendHealth
+	err = json.NewDecoder(resp.Body).Decode(&backends)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]BackendHealth{}
+	for _, b := range backends {
+		got[b.Pool] = b
+	}
+
+	if b := got["/failing"]; b.State != "open" || b.Ejections != 1 || b.ConsecutiveFailures != 2 || b.EjectedUntil.IsZero() {
+		t.Fatalf("expected the failing backend to be ejected but got %+v", b)
+	}
+	if b := got["/healthy"]; b.Addr != healthy || b.State != "closed" || b.ConsecutiveFailures != 0 || !b.EjectedUntil.IsZero() {
+		t.Fatalf("expected the healthy backend to be in rotation but got %+v", b)
+	}
+}
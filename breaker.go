@@ -0,0 +1,190 @@
+package butler
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerThreshold   = 5
+	defaultBreakerCooldown    = 10 * time.Second
+	defaultBreakerMaxCooldown = 5 * time.Minute
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// BackendHealth describes the passive health of a backend, as listed by the
+// admin API. A backend is ejected from its pool while its breaker is open.
+type BackendHealth struct {
+	Site                string    `json:"Site,omitempty"`
+	Pool                string    `json:"Pool"`
+	Addr                string    `json:"Addr"`
+	State               string    `json:"State"`
+	ConsecutiveFailures int       `json:"ConsecutiveFailures"`
+	Ejections           int       `json:"Ejections"`
+	EjectedUntil        time.Time `json:"EjectedUntil,omitzero"`
+}
+
+// breaker stops traffic to a backend after threshold consecutive failures,
+// ejecting it from its pool. Once cooldown has passed, a single probe request
+// is let through half-open, which closes the breaker if it succeeds and opens
+// it again if it fails. The cooldown doubles every time the probe fails, up
+// to maxCooldown.
+type breaker struct {
+	name        string
+	threshold   int
+	cooldown    time.Duration
+	maxCooldown time.Duration
+	now         func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	// ejections counts the times the breaker has opened since it was last
+	// closed
+	ejections int
+	openedAt  time.Time
+}
+
+func newBreaker(b Backend) *breaker {
+	threshold := b.BreakerThreshold
+	if threshold == 0 {
+		threshold = defaultBreakerThreshold
+	}
+
+	cooldown := b.BreakerCooldown
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+
+	maxCooldown := b.BreakerMaxCooldown
+	if maxCooldown <= 0 {
+		maxCooldown = max(defaultBreakerMaxCooldown, cooldown)
+	}
+
+	return &breaker{name: b.Addr, threshold: threshold, cooldown: cooldown, maxCooldown: maxCooldown, now: time.Now}
+}
+
+// currentCooldown is the time the breaker stays open for, doubling with every
+// ejection. b.mu must be held.
+func (b *breaker) currentCooldown() time.Duration {
+	d := b.cooldown
+	for i := 1; i < b.ejections && d < b.maxCooldown; i++ {
+		d *= 2
+	}
+	return min(d, b.maxCooldown)
+}
+
+// available reports whether allow would let a request through.
+func (b *breaker) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		return b.now().Sub(b.openedAt) >= b.currentCooldown()
+	case breakerHalfOpen:
+		return false
+	}
+	return true
+}
+
+// allow reports whether a request may be sent, claiming the probe if the
+// breaker is ready to be half-open.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.currentCooldown() {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		return true
+	case breakerHalfOpen:
+		// The probe is still in flight
+		return false
+	}
+	return true
+}
+
+// release gives back a probe claimed by allow that was never sent, so that
+// the next request may claim it.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		slog.Debug(fmt.Sprintf("circuit breaker for %s is open again as its probe was not sent", b.name))
+		b.state = breakerOpen
+	}
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	if b.state != breakerClosed {
+		b.ejections = 0
+		b.setState(breakerClosed)
+	}
+}
+
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.threshold < 0 {
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.state == breakerClosed && b.failures >= b.threshold {
+		b.openedAt = b.now()
+		b.ejections++
+		b.setState(breakerOpen)
+	}
+}
+
+func (b *breaker) setState(s breakerState) {
+	switch s {
+	case breakerOpen:
+		slog.Info(fmt.Sprintf("ejecting %s for %s after %d consecutive failures", b.name, b.currentCooldown(), b.failures))
+	case breakerClosed:
+		slog.Info(fmt.Sprintf("restoring %s", b.name))
+	default:
+		slog.Debug(fmt.Sprintf("circuit breaker for %s is %s", b.name, s))
+	}
+	b.state = s
+}
+
+func (b *breaker) health() BackendHealth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	h := BackendHealth{Addr: b.name, State: b.state.String(), ConsecutiveFailures: b.failures, Ejections: b.ejections}
+	if b.state == breakerOpen {
+		h.EjectedUntil = b.openedAt.Add(b.currentCooldown())
+	}
+	return h
+}
@@ -0,0 +1,346 @@
+package butler
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreakerStates(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	now := time.Now()
+	b := newBreaker(Backend{Addr: "a", BreakerThreshold: 2, BreakerCooldown: time.Second})
+	b.now = func() time.Time { return now }
+
+	steps := []struct {
+		n         string
+		action    func()
+		allowed   bool
+		available bool
+	}{
+		{"Closed", func() {}, true, true},
+		{"OneFailure", b.failure, true, true},
+		{"SuccessResets", func() { b.success(); b.failure() }, true, true},
+		{"Opens", b.failure, false, false},
+		{"Cooling", func() { now = now.Add(500 * time.Millisecond) }, false, false},
+		{"HalfOpen", func() { now = now.Add(500 * time.Millisecond) }, true, true},
+		{"ProbeInFlight", func() {}, false, false},
+		{"ProbeReleased", b.release, true, true},
+		{"ProbeFails", b.failure, false, false},
+		{"BacksOff", func() { now = now.Add(time.Second) }, false, false},
+		{"HalfOpenAgain", func() { now = now.Add(time.Second) }, true, true},
+		{"ProbeSucceeds", b.success, true, true},
+		{"OpensAgain", func() { b.failure(); b.failure() }, false, false},
+		{"BackOffResets", func() { now = now.Add(time.Second) }, true, true},
+	}
+
+	for _, s := range steps {
+		s.action()
+		if got := b.available(); got != s.available {
+			t.Fatalf("%s: expected available %v but got %v", s.n, s.available, got)
+		}
+		if got := b.allow(); got != s.allowed {
+			t.Fatalf("%s: expected allow %v but got %v", s.n, s.allowed, got)
+		}
+	}
+}
+
+func TestBreakerBackOff(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	now := time.Now()
+	b := newBreaker(Backend{Addr: "a", BreakerThreshold: 1, BreakerCooldown: time.Second, BreakerMaxCooldown: 5 * time.Second})
+	b.now = func() time.Time { return now }
+
+	b.failure()
+	for _, expected := range []time.Duration{1, 2, 4, 5, 5} {
+		if h := b.health(); h.State != "open" || h.EjectedUntil != now.Add(expected*time.Second) {
+			t.Fatalf("expected to be ejected for %ds but got %+v", expected, h)
+		}
+
+		now = now.Add(expected*time.Second - time.Millisecond)
+		if b.allow() {
+			t.Fatalf("expected to be ejected for %ds", expected)
+		}
+
+		now = now.Add(time.Millisecond)
+		if !b.allow() {
+			t.Fatalf("expected a probe after %ds", expected)
+		}
+		b.failure()
+	}
+
+	if h := b.health(); h.Ejections != 6 || h.ConsecutiveFailures != 6 {
+		t.Fatalf("expected 6 ejections but got %+v", h)
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	b := newBreaker(Backend{Addr: "a", BreakerThreshold: -1})
+	for range 100 {
+		b.failure()
+	}
+	if !b.allow() {
+		t.Fatal("expected a disabled breaker to stay closed")
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := &retryBudget{ratio: 0.5, tokens: 1}
+	if !b.withdraw() || b.withdraw() {
+		t.Fatal("expected exactly one retry")
+	}
+
+	b.deposit()
+	if b.withdraw() {
+		t.Fatal("expected half a token not to be enough")
+	}
+	b.deposit()
+	if !b.withdraw() {
+		t.Fatal("expected two requests to earn a retry")
+	}
+
+	for range 100 {
+		b.deposit()
+	}
+	if b.tokens != maxRetryTokens {
+		t.Fatalf("expected tokens to be capped but got %v", b.tokens)
+	}
+}
+
+// deadAddr returns an address that refuses connections.
+func deadAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestBackendTimeouts(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	release := make(chan bool)
+	defer close(release)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-body" {
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+	addr := upstream.Listener.Addr().String()
+
+	cases := []struct {
+		n      string
+		b      Backend
+		path   string
+		status int
+	}{
+		{"ResponseHeader", Backend{Addr: addr, Path: "/", ResponseHeaderTimeout: 50 * time.Millisecond}, "/", http.StatusGatewayTimeout},
+		{"Total", Backend{Addr: addr, Path: "/", Timeout: 50 * time.Millisecond}, "/", http.StatusGatewayTimeout},
+		{"Refused", Backend{Addr: deadAddr(t), Path: "/"}, "/", http.StatusBadGateway},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			proxy := startProxy(t, c.b)
+
+			start := time.Now()
+			resp, err := http.Get(proxy + c.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != c.status {
+				t.Fatalf("expected %v but got %v", c.status, resp.StatusCode)
+			}
+			if time.Since(start) > 2*time.Second {
+				t.Fatal("expected the timeout to cut the request short")
+			}
+		})
+	}
+
+	t.Run("TotalDuringBody", func(t *testing.T) {
+		proxy := startProxy(t, Backend{Addr: addr, Path: "/", Timeout: 100 * time.Millisecond})
+
+		resp, err := http.Get(proxy + "/slow-body")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		_, err = io.ReadAll(resp.Body)
+		if err == nil {
+			t.Fatal("expected the body to be cut short")
+		}
+	})
+}
+
+func TestBackendRetries(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	dead := deadAddr(t)
+
+	cases := []struct {
+		n       string
+		method  string
+		body    string
+		retries int
+		status  int
+	}{
+		{"Get", "GET", "", 1, http.StatusOK},
+		{"Delete", "DELETE", "", 1, http.StatusOK},
+		{"NoRetries", "GET", "", 0, http.StatusBadGateway},
+		{"Post", "POST", "", 1, http.StatusBadGateway},
+		{"PutWithBody", "PUT", "body", 1, http.StatusBadGateway},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			_, proxy := startServer(t, &Config{
+				Listen:    0,
+				ListenTLS: -1,
+				Backends: []Backend{
+					{Addr: dead, Path: "/"},
+					{Addr: upstream.Listener.Addr().String(), Path: "/"},
+				},
+				Pools: []Pool{{Path: "/", Retries: c.retries}},
+			})
+
+			// Round robin starts with the dead member
+			req, _ := http.NewRequest(c.method, proxy+"/", strings.NewReader(c.body))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != c.status {
+				t.Fatalf("expected %v but got %v", c.status, resp.StatusCode)
+			}
+		})
+	}
+}
+
+// closingListener accepts connections and closes them straight away.
+func closingListener(t *testing.T, accepted *atomic.Int32) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestBackendRetryBudget(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	var accepted atomic.Int32
+	_, proxy := startServer(t, &Config{
+		Listen:    0,
+		ListenTLS: -1,
+		Backends: []Backend{
+			{Addr: closingListener(t, &accepted), Path: "/", BreakerThreshold: -1},
+			{Addr: closingListener(t, &accepted), Path: "/", BreakerThreshold: -1},
+		},
+		Pools: []Pool{{Path: "/", Retries: 1, RetryBudget: 0.01}},
+	})
+
+	requests := maxRetryTokens + 5
+	for range requests {
+		resp, err := http.Get(proxy + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// Only the retries saved up front are spent
+	if got := int(accepted.Load()); got != requests+maxRetryTokens {
+		t.Fatalf("expected %v attempts but got %v", requests+maxRetryTokens, got)
+	}
+}
+
+func TestBackendBreaker(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	for _, status := range []int{http.StatusInternalServerError, http.StatusNotImplemented, http.StatusServiceUnavailable} {
+		t.Run(strconv.Itoa(status), func(t *testing.T) {
+			var hits atomic.Int32
+			var healthy atomic.Bool
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				if !healthy.Load() {
+					w.WriteHeader(status)
+				}
+			}))
+			defer upstream.Close()
+
+			proxy := startProxy(t, Backend{
+				Addr:             upstream.Listener.Addr().String(),
+				Path:             "/",
+				BreakerThreshold: 2,
+				BreakerCooldown:  100 * time.Millisecond,
+			})
+
+			get := func() int {
+				resp, err := http.Get(proxy + "/")
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				return resp.StatusCode
+			}
+
+			get()
+			get()
+			if got := get(); got != http.StatusServiceUnavailable || hits.Load() != 2 {
+				t.Fatalf("expected the open breaker to stop traffic but got %v after %v hits", got, hits.Load())
+			}
+
+			time.Sleep(150 * time.Millisecond)
+			healthy.Store(true)
+			if got := get(); got != http.StatusOK || hits.Load() != 3 {
+				t.Fatalf("expected the half-open probe to reach the backend but got %v after %v hits", got, hits.Load())
+			}
+
+			get()
+			if hits.Load() != 4 {
+				t.Fatalf("expected the breaker to close but got %v hits", hits.Load())
+			}
+		})
+	}
+}
@@ -0,0 +1,1145 @@
+package butler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxObjectSize = 1 << 20
+	defaultMaxDiskSize   = 1 << 30
+	// maxHeuristicFreshness caps the freshness guessed from Last-Modified
+	maxHeuristicFreshness = 24 * time.Hour
+	// maxDeltaSeconds is the largest delta-seconds, see RFC 9111 section 1.2.2
+	maxDeltaSeconds = 1 << 31
+	// maxCollapseWait bounds how long a request waits for another one fetching
+	// the same response, before going to the backend itself
+	maxCollapseWait = 10 * time.Second
+	cacheStatusName = "butler"
+	// defaultSurrogateKeys is the header backends tag responses with
+	defaultSurrogateKeys = "Surrogate-Key"
+)
+
+// Cache configures a shared cache, see RFC 9111, for the responses of a site's
+// backends. It is off unless MaxSize, the bytes of responses kept in memory, is
+// set. Responses evicted from memory move to files in Dir, if it is set, until
+// they add up to MaxDiskSize. Sites must not share a Dir. When the backend
+// fails, responses that have been stale for up to StaleIfError are served,
+// unless they say otherwise. Backends tag responses for purging with the
+// space separated keys of SurrogateKeyHeader, Surrogate-Key by default, which
+// is not passed on to clients.
+type Cache struct {
+	MaxSize            int64         `yaml:"MaxSize"`
+	MaxObjectSize      int64         `yaml:"MaxObjectSize"`
+	Dir                string        `yaml:"Dir"`
+	MaxDiskSize        int64         `yaml:"MaxDiskSize"`
+	StaleIfError       time.Duration `yaml:"StaleIfError"`
+	SurrogateKeyHeader string        `yaml:"SurrogateKeyHeader"`
+}
+
+// cacheEntry is a stored response. Entries are not modified once stored, so
+// they can be served without holding the cache lock.
+type cacheEntry struct {
+	// Key is URL followed by the request headers named by Vary
+	Key          string
+	URL          string
+	StatusCode   int
+	Header       map[string][]string
+	Body         []byte
+	RequestTime  time.Time
+	ResponseTime time.Time
+	// Hits counts the times the entry has been served, and is only accessed
+	// with the cache lock held
+	Hits int64
+}
+
+func (e *cacheEntry) size() int64 {
+	n := len(e.Key) + len(e.URL) + len(e.Body)
+	for k, vs := range e.Header {
+		for _, v := range vs {
+			n += len(k) + len(v)
+		}
+	}
+	return int64(n)
+}
+
+// metadata returns e without its body.
+func (e *cacheEntry) metadata() *cacheEntry {
+	m := *e
+	m.Body = nil
+	return &m
+}
+
+func (e *cacheEntry) cacheControl() cacheControl {
+	return parseCacheControl(http.Header(e.Header).Values(HeaderCacheControl))
+}
+
+func (e *cacheEntry) date() time.Time {
+	if d, err := http.ParseTime(http.Header(e.Header).Get(HeaderDate)); err == nil {
+		return d
+	}
+	return e.ResponseTime
+}
+
+// freshnessLifetime is how long after its date e may be served without
+// revalidation, see RFC 9111 section 4.2.1.
+func (e *cacheEntry) freshnessLifetime() time.Duration {
+	h := http.Header(e.Header)
+	cc := e.cacheControl()
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+
+	if v := h.Get(HeaderExpires); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			// An invalid Expires is in the past
+			return 0
+		}
+		return expires.Sub(e.date())
+	}
+
+	if lastModified, err := http.ParseTime(h.Get(HeaderLastModified)); err == nil && heuristicallyCacheable(e.StatusCode) {
+		return min(e.date().Sub(lastModified)/10, maxHeuristicFreshness)
+	}
+	return 0
+}
+
+// age is the current age of e, see RFC 9111 section 4.2.3.
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparentAge := max(0, e.ResponseTime.Sub(e.date()))
+
+	var ageValue time.Duration
+	if n, err := strconv.ParseInt(http.Header(e.Header).Get(HeaderAge), 10, 64); err == nil && n > 0 {
+		ageValue = time.Duration(min(n, maxDeltaSeconds)) * time.Second
+	}
+	correctedAgeValue := ageValue + e.ResponseTime.Sub(e.RequestTime)
+
+	return max(apparentAge, correctedAgeValue) + now.Sub(e.ResponseTime)
+}
+
+// servable reports whether e may be served without revalidation at age to a
+// request with the directives rcc.
+func (e *cacheEntry) servable(age time.Duration, rcc cacheControl) bool {
+	cc := e.cacheControl()
+	if cc.has("no-cache") || rcc.has("no-cache") {
+		return false
+	}
+
+	if maxAge, ok := rcc.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+
+	lifetime := e.freshnessLifetime()
+	if minFresh, ok := rcc.seconds("min-fresh"); ok && lifetime-age < minFresh {
+		return false
+	}
+
+	if age < lifetime {
+		return true
+	}
+
+	if !e.mayServeStale() || !rcc.has("max-stale") {
+		return false
+	}
+	if maxStale, ok := rcc.seconds("max-stale"); ok {
+		return age-lifetime <= maxStale
+	}
+	// max-stale without a value accepts any staleness
+	return rcc["max-stale"] == ""
+}
+
+// staleWhileRevalidate reports whether the stale e may be served at age while
+// it is revalidated in the background, see RFC 5861 section 3.
+func (e *cacheEntry) staleWhileRevalidate(age time.Duration, rcc cacheControl) bool {
+	if !e.mayServeStale() || rcc.has("no-cache") {
+		return false
+	}
+
+	if maxAge, ok := rcc.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+
+	limit, ok := e.cacheControl().seconds("stale-while-revalidate")
+	return ok && age-e.freshnessLifetime() <= limit
+}
+
+// staleIfError reports whether the stale e may be served at age when the
+// backend fails, see RFC 5861 section 4. Either the response or the request
+// may allow it, otherwise it is allowed for fallback once e is stale. It is
+// never allowed if the request asked for validation with no-cache.
+func (e *cacheEntry) staleIfError(age time.Duration, rcc cacheControl, fallback time.Duration) bool {
+	if !e.mayServeStale() || rcc.has("no-cache") {
+		return false
+	}
+
+	staleness := age - e.freshnessLifetime()
+	if limit, ok := e.cacheControl().seconds("stale-if-error"); ok && staleness <= limit {
+		return true
+	}
+	if limit, ok := rcc.seconds("stale-if-error"); ok && staleness <= limit {
+		return true
+	}
+	return staleness > 0 && staleness <= fallback
+}
+
+// mayServeStale reports whether e allows being served without validation once
+// stale, see RFC 9111 section 4.2.4.
+func (e *cacheEntry) mayServeStale() bool {
+	cc := e.cacheControl()
+	return !cc.has("no-cache") && !cc.has("must-revalidate") && !cc.has("proxy-revalidate") && !cc.has("s-maxage")
+}
+
+func (e *cacheEntry) hasValidator() bool {
+	h := http.Header(e.Header)
+	return h.Get(HeaderETag) != "" || h.Get(HeaderLastModified) != ""
+}
+
+// response returns e as a response to a request for which it is age old.
+func (e *cacheEntry) response(age time.Duration) *Response {
+	r := StatusCode(e.StatusCode, e.Body)
+	for k, vs := range e.Header {
+		r.Headers[k] = slices.Clone(vs)
+	}
+	r.Headers[HeaderAge] = []string{strconv.FormatInt(int64(age/time.Second), 10)}
+	return r
+}
+
+// notModified returns a 304 for e, with the headers RFC 9110 section 15.4.5
+// asks for.
+func (e *cacheEntry) notModified(age time.Duration) *Response {
+	r := StatusCode(http.StatusNotModified, nil)
+	h := http.Header(e.Header)
+	for _, k := range []string{HeaderCacheControl, HeaderContentLocation, HeaderDate, HeaderETag, HeaderExpires, HeaderVary} {
+		if vs := h.Values(k); len(vs) > 0 {
+			r.Headers[k] = slices.Clone(vs)
+		}
+	}
+	r.Headers[HeaderAge] = []string{strconv.FormatInt(int64(age/time.Second), 10)}
+	return r
+}
+
+// cacheControl maps Cache-Control directives to their arguments.
+type cacheControl map[string]string
+
+func parseCacheControl(values []string) cacheControl {
+	cc := cacheControl{}
+	for _, v := range values {
+		for _, directive := range strings.Split(v, ",") {
+			name, arg, _ := strings.Cut(directive, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "" {
+				cc[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	v, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(min(n, maxDeltaSeconds)) * time.Second, true
+}
+
+// heuristicallyCacheable reports whether responses with status may be stored
+// without explicit freshness, see RFC 9110 section 15.1.
+func heuristicallyCacheable(status int) bool {
+	switch status {
+	case 200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501:
+		return true
+	}
+	return false
+}
+
+// storable reports whether the response to r with status and headers h may be
+// stored by a shared cache, see RFC 9111 section 3.
+func storable(r *Request, status int, h http.Header) bool {
+	if r.Method != RequestGet || status < 200 || status == http.StatusPartialContent || status == http.StatusNotModified {
+		return false
+	}
+
+	if parseCacheControl(r.HeaderValues(HeaderCacheControl)).has("no-store") {
+		return false
+	}
+
+	cc := parseCacheControl(h.Values(HeaderCacheControl))
+	if cc.has("no-store") || cc.has("private") {
+		return false
+	}
+
+	if r.Header(HeaderAuthorization) != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+
+	if slices.Contains(varyNames(h), "*") {
+		return false
+	}
+
+	// Cookies are for the client that was sent them, not for everyone
+	if len(h.Values(HeaderSetCookie)) > 0 {
+		return false
+	}
+
+	if cc.has("public") || cc.has("max-age") || cc.has("s-maxage") || h.Get(HeaderExpires) != "" {
+		return true
+	}
+	return heuristicallyCacheable(status) && (h.Get(HeaderETag) != "" || h.Get(HeaderLastModified) != "")
+}
+
+// varyNames returns the request headers named by the Vary header of h.
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values(HeaderVary) {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// cacheURL is the URL a request is cached under.
+func cacheURL(r *Request) string {
+	return r.Scheme + "://" + strings.ToLower(r.Host) + r.Path
+}
+
+func cacheKey(u string, vary []string, r *Request) string {
+	var b strings.Builder
+	b.WriteString(u)
+	for _, name := range vary {
+		b.WriteString("\x00" + name + "=" + strings.Join(r.HeaderValues(name), ","))
+	}
+	return b.String()
+}
+
+// cache is the store of a site's cached responses. Entries are kept in memory
+// until evicted, then on disk if there is a disk tier.
+type cache struct {
+	maxObjectSize int64
+	staleIfError  time.Duration
+	surrogateKeys string
+	now           func() time.Time
+
+	mu     sync.Mutex
+	memory *lru
+	disk   *diskStore
+	// urls indexes the keys of each URL's entries
+	urls map[string]*cachedURL
+	// fetches are the responses being fetched from backends, by key
+	fetches map[string]*cacheFetch
+}
+
+type cachedURL struct {
+	// vary is the Vary of the latest response for the URL
+	vary []string
+	keys map[string]struct{}
+}
+
+// cacheFetch is closed once a response being fetched has been stored, or is
+// not going to be.
+type cacheFetch struct {
+	done chan struct{}
+}
+
+func newCache(c Cache) (*cache, error) {
+	if c.MaxSize <= 0 {
+		return nil, errors.New("cache MaxSize must be set")
+	}
+
+	maxObjectSize := c.MaxObjectSize
+	if maxObjectSize <= 0 {
+		maxObjectSize = min(defaultMaxObjectSize, c.MaxSize)
+	}
+	if maxObjectSize > c.MaxSize {
+		return nil, errors.New("cache MaxObjectSize must not be larger than MaxSize")
+	}
+
+	surrogateKeys := c.SurrogateKeyHeader
+	if surrogateKeys == "" {
+		surrogateKeys = defaultSurrogateKeys
+	}
+
+	ch := &cache{
+		maxObjectSize: maxObjectSize,
+		staleIfError:  c.StaleIfError,
+		surrogateKeys: http.CanonicalHeaderKey(surrogateKeys),
+		now:           time.Now,
+		memory:        newLRU(c.MaxSize),
+		urls:          make(map[string]*cachedURL),
+		fetches:       make(map[string]*cacheFetch),
+	}
+
+	if c.Dir != "" {
+		maxDiskSize := c.MaxDiskSize
+		if maxDiskSize <= 0 {
+			maxDiskSize = defaultMaxDiskSize
+		}
+
+		d, err := newDiskStore(c.Dir, maxDiskSize)
+		if err != nil {
+			return nil, err
+		}
+
+		err = d.load()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, el := range d.entries.items {
+			e := el.Value.(*lruItem).entry
+			ch.index(e.URL, varyNames(e.Header), e.Key)
+		}
+		ch.disk = d
+	}
+
+	return ch, nil
+}
+
+// key returns the key the response to r would be stored under, as far as is
+// known before the response arrives.
+func (ch *cache) key(r *Request) string {
+	u := cacheURL(r)
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if cu, ok := ch.urls[u]; ok {
+		return cacheKey(u, cu.vary, r)
+	}
+	return u
+}
+
+// startFetch returns the fetch under way for key, starting one if there is
+// none, and reports whether it was started by the caller, who must end it.
+func (ch *cache) startFetch(key string) (*cacheFetch, bool) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if f, ok := ch.fetches[key]; ok {
+		return f, false
+	}
+
+	f := &cacheFetch{done: make(chan struct{})}
+	ch.fetches[key] = f
+	return f, true
+}
+
+func (ch *cache) endFetch(key string, f *cacheFetch) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.fetches[key] == f {
+		delete(ch.fetches, key)
+		close(f.done)
+	}
+}
+
+// get returns the entry matching r, or nil if there is none.
+func (ch *cache) get(r *Request) *cacheEntry {
+	u := cacheURL(r)
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	cu, ok := ch.urls[u]
+	if !ok {
+		return nil
+	}
+
+	key := cacheKey(u, cu.vary, r)
+	if e, ok := ch.memory.get(key); ok {
+		return e
+	}
+
+	if ch.disk == nil {
+		return nil
+	}
+
+	e, err := ch.disk.take(key)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("failed reading %s from the cache: %s", u, err))
+		ch.unindex(u, key)
+		return nil
+	}
+	if e == nil {
+		return nil
+	}
+
+	ch.addToMemory(e)
+	return e
+}
+
+// put stores the response to r, replacing any entry with the same key.
+func (ch *cache) put(r *Request, status int, h http.Header, body []byte, requestTime time.Time, responseTime time.Time) {
+	u := cacheURL(r)
+	vary := varyNames(h)
+
+	header := make(map[string][]string, len(h))
+	for k, vs := range h {
+		switch k {
+		case HeaderCacheStatus, HeaderContentLength, HeaderConnection, HeaderTransferEncoding:
+			// Set whenever the entry is served. Age is kept as it counts
+			// towards the age of the entry, and is replaced when served
+		default:
+			header[k] = slices.Clone(vs)
+		}
+	}
+
+	e := &cacheEntry{
+		Key:          cacheKey(u, vary, r),
+		URL:          u,
+		StatusCode:   status,
+		Header:       header,
+		Body:         body,
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.removeKey(e.Key)
+	ch.index(u, vary, e.Key)
+	ch.addToMemory(e)
+}
+
+// freshen updates e with the headers of a 304 response that validated it, see
+// RFC 9111 section 4.3.4, returning the updated entry.
+func (ch *cache) freshen(e *cacheEntry, h http.Header, requestTime time.Time, responseTime time.Time) *cacheEntry {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	updated := *e
+	updated.Header = make(map[string][]string, len(e.Header))
+	for k, vs := range e.Header {
+		updated.Header[k] = vs
+	}
+	// The age of the stored response no longer applies from responseTime
+	delete(updated.Header, HeaderAge)
+	for k, vs := range h {
+		switch k {
+		case HeaderCacheStatus, HeaderContentLength, HeaderConnection, HeaderTransferEncoding:
+		default:
+			updated.Header[k] = slices.Clone(vs)
+		}
+	}
+	updated.RequestTime, updated.ResponseTime = requestTime, responseTime
+
+	ch.removeKey(e.Key)
+	ch.index(e.URL, varyNames(updated.Header), e.Key)
+	ch.addToMemory(&updated)
+	return &updated
+}
+
+// invalidate removes every entry for the URL u.
+func (ch *cache) invalidate(u string) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	cu, ok := ch.urls[u]
+	if !ok {
+		return
+	}
+
+	for key := range cu.keys {
+		ch.removeKey(key)
+	}
+}
+
+// CacheFilter selects cache entries through the admin API. URL matches
+// entries for that URL, Prefix those whose URL starts with it and SurrogateKey
+// those a backend tagged with it. At most one may be set, and an empty filter
+// matches every entry.
+type CacheFilter struct {
+	URL          string `json:",omitempty"`
+	Prefix       string `json:",omitempty"`
+	SurrogateKey string `json:",omitempty"`
+}
+
+// CacheEntryInfo describes a cache entry listed through the admin API. Age is
+// in seconds and Tier is memory or disk.
+type CacheEntryInfo struct {
+	URL           string
+	StatusCode    int
+	Size          int64
+	Age           int64
+	Hits          int64
+	SurrogateKeys []string
+	Tier          string
+}
+
+func (f CacheFilter) isZero() bool {
+	return f == CacheFilter{}
+}
+
+func (f CacheFilter) validate() error {
+	set := 0
+	for _, v := range []string{f.URL, f.Prefix, f.SurrogateKey} {
+		if v != "" {
+			set++
+		}
+	}
+
+	if set > 1 {
+		return errors.New("only one of URL, Prefix and SurrogateKey may be set")
+	}
+	return nil
+}
+
+func (ch *cache) matches(f CacheFilter, e *cacheEntry) bool {
+	switch {
+	case f.URL != "":
+		return e.URL == f.URL
+	case f.Prefix != "":
+		return strings.HasPrefix(e.URL, f.Prefix)
+	case f.SurrogateKey != "":
+		return slices.Contains(ch.surrogateKeysOf(e), f.SurrogateKey)
+	}
+	return true
+}
+
+func (ch *cache) surrogateKeysOf(e *cacheEntry) []string {
+	var keys []string
+	for _, v := range http.Header(e.Header).Values(ch.surrogateKeys) {
+		keys = append(keys, strings.Fields(v)...)
+	}
+	return keys
+}
+
+// list describes the entries matching f, most recently used first.
+func (ch *cache) list(f CacheFilter) []CacheEntryInfo {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	now := ch.now()
+	infos := make([]CacheEntryInfo, 0)
+	add := func(l *lru, tier string) {
+		for el := l.order.Front(); el != nil; el = el.Next() {
+			item := el.Value.(*lruItem)
+			if !ch.matches(f, item.entry) {
+				continue
+			}
+
+			infos = append(infos, CacheEntryInfo{
+				URL:           item.entry.URL,
+				StatusCode:    item.entry.StatusCode,
+				Size:          item.size,
+				Age:           int64(item.entry.age(now) / time.Second),
+				Hits:          item.entry.Hits,
+				SurrogateKeys: ch.surrogateKeysOf(item.entry),
+				Tier:          tier,
+			})
+		}
+	}
+
+	add(ch.memory, "memory")
+	if ch.disk != nil {
+		add(ch.disk.entries, "disk")
+	}
+	return infos
+}
+
+// purge removes the entries matching f, returning how many there were.
+func (ch *cache) purge(f CacheFilter) int {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	var keys []string
+	collect := func(l *lru) {
+		for key, el := range l.items {
+			if ch.matches(f, el.Value.(*lruItem).entry) {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	collect(ch.memory)
+	if ch.disk != nil {
+		collect(ch.disk.entries)
+	}
+
+	for _, key := range keys {
+		ch.removeKey(key)
+	}
+
+	if len(keys) > 0 {
+		slog.Info(fmt.Sprintf("purged %d cache entries", len(keys)))
+	}
+	return len(keys)
+}
+
+// recordHit counts e being served, if it is still stored.
+func (ch *cache) recordHit(e *cacheEntry) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if el, ok := ch.memory.items[e.Key]; ok && el.Value.(*lruItem).entry == e {
+		e.Hits++
+	}
+}
+
+func (ch *cache) addToMemory(e *cacheEntry) {
+	for _, item := range ch.memory.add(e.Key, e.size(), e) {
+		ch.spill(item.entry)
+	}
+}
+
+// spill moves an entry evicted from memory to disk, or drops it if there is no
+// room there.
+func (ch *cache) spill(e *cacheEntry) {
+	if ch.disk == nil {
+		ch.unindex(e.URL, e.Key)
+		return
+	}
+
+	evicted, err := ch.disk.add(e)
+	if err != nil {
+		slog.Error(fmt.Sprintf("failed writing %s to the cache: %s", e.URL, err))
+	}
+	if _, ok := ch.disk.entries.items[e.Key]; !ok {
+		ch.unindex(e.URL, e.Key)
+	}
+
+	for _, d := range evicted {
+		ch.unindex(d.URL, d.Key)
+	}
+}
+
+func (ch *cache) removeKey(key string) {
+	e, ok := ch.memory.remove(key)
+	if !ok && ch.disk != nil {
+		if el, found := ch.disk.entries.items[key]; found {
+			e, ok = el.Value.(*lruItem).entry, true
+			ch.disk.remove(key)
+		}
+	}
+
+	if ok {
+		ch.unindex(e.URL, key)
+	}
+}
+
+func (ch *cache) index(u string, vary []string, key string) {
+	cu, ok := ch.urls[u]
+	if !ok {
+		cu = &cachedURL{keys: make(map[string]struct{})}
+		ch.urls[u] = cu
+	}
+	cu.vary = vary
+	cu.keys[key] = struct{}{}
+}
+
+func (ch *cache) unindex(u string, key string) {
+	cu, ok := ch.urls[u]
+	if !ok {
+		return
+	}
+
+	delete(cu.keys, key)
+	if len(cu.keys) == 0 {
+		delete(ch.urls, u)
+	}
+}
+
+// cacheHandler serves responses from the cache, passing requests it cannot
+// answer on to next and storing what comes back.
+type cacheHandler struct {
+	cache *cache
+	next  handler
+}
+
+func (h cacheHandler) Handle(c *Context) (bool, error) {
+	r := c.Request
+	switch r.Method {
+	case RequestGet, RequestHead:
+	case RequestOptions, "TRACE":
+		return h.next.Handle(c)
+	default:
+		return h.forwardUnsafe(c)
+	}
+
+	if isUpgrade(r) || r.Header(HeaderRange) != "" {
+		return h.next.Handle(c)
+	}
+
+	rcc := parseCacheControl(r.HeaderValues(HeaderCacheControl))
+	e := h.cache.get(r)
+	if e != nil {
+		age := e.age(h.cache.now())
+		if e.servable(age, rcc) {
+			h.serve(c, e, age, cacheStatusName+"; hit")
+			return true, nil
+		}
+
+		if e.staleWhileRevalidate(age, rcc) {
+			h.refresh(c, e)
+			h.serve(c, e, age, cacheStatusName+"; hit; detail=stale-while-revalidate")
+			return true, nil
+		}
+	}
+
+	if rcc.has("only-if-cached") {
+		c.Response = GatewayTimeout()
+		return true, nil
+	}
+
+	if r.Method != RequestGet {
+		return h.forward(c, e, rcc, func() {})
+	}
+
+	// Collapse concurrent requests for the same response into one
+	key := h.cache.key(r)
+	f, leader := h.cache.startFetch(key)
+	if leader {
+		return h.forward(c, e, rcc, func() { h.cache.endFetch(key, f) })
+	}
+
+	select {
+	case <-f.done:
+	case <-time.After(maxCollapseWait):
+	}
+
+	if e = h.cache.get(r); e != nil {
+		age := e.age(h.cache.now())
+		if e.servable(age, rcc) {
+			h.serve(c, e, age, cacheStatusName+"; hit; collapsed")
+			return true, nil
+		}
+	}
+	return h.forward(c, e, rcc, func() {})
+}
+
+// serve answers c with e, which is age old.
+func (h cacheHandler) serve(c *Context, e *cacheEntry, age time.Duration, status string) {
+	if conditionMatches(c.Request, e.Header) {
+		c.Response = e.notModified(age)
+	} else {
+		c.Response = e.response(age)
+	}
+	delete(c.Response.Headers, h.cache.surrogateKeys)
+	c.Response.Headers[HeaderCacheStatus] = []string{status}
+	h.cache.recordHit(e)
+}
+
+// forward passes the request on to the backend, storing the response if it
+// may be. If there is a stale entry e, the backend is asked to validate it,
+// and it is served again if the backend says it is current or cannot be
+// reached. done is called once the response has been stored or is not going
+// to be.
+func (h cacheHandler) forward(c *Context, e *cacheEntry, rcc cacheControl, done func()) (bool, error) {
+	validating := e != nil && e.hasValidator()
+	restore := func() {}
+	if validating {
+		restore = setConditionalHeaders(c.Request, http.Header(e.Header))
+	}
+
+	requestTime := h.cache.now()
+	handled, err := h.next.Handle(c)
+	restore()
+	if !handled || err != nil || c.Response == nil {
+		done()
+		return handled, err
+	}
+
+	if e == nil {
+		h.store(c, requestTime, cacheStatusName+"; fwd=uri-miss", done)
+		return true, nil
+	}
+
+	now := h.cache.now()
+	status := c.Response.StatusCode
+	switch {
+	case validating && status == http.StatusNotModified:
+		closeResponse(c.Response)
+		e = h.cache.freshen(e, c.Response.Headers, requestTime, now)
+		h.serve(c, e, e.age(now), cacheStatusName+"; fwd=stale; fwd-status=304")
+		done()
+	case isServerError(status) && e.staleIfError(e.age(now), rcc, h.cache.staleIfError):
+		slog.Debug(fmt.Sprintf("serving stale %s as the backend responded %d", e.URL, status))
+		closeResponse(c.Response)
+		h.serve(c, e, e.age(now), fmt.Sprintf("%s; fwd=stale; fwd-status=%d; detail=stale-if-error", cacheStatusName, status))
+		done()
+	default:
+		h.store(c, requestTime, cacheStatusName+"; fwd=stale", done)
+	}
+	return true, nil
+}
+
+// refresh revalidates the stale entry e in the background, unless that is
+// already under way.
+func (h cacheHandler) refresh(c *Context, e *cacheEntry) {
+	f, leader := h.cache.startFetch(e.Key)
+	if !leader {
+		return
+	}
+
+	r := *c.Request
+	r.Method = RequestGet
+	r.Headers = maps.Clone(c.Request.Headers)
+	bg := &Context{Conn: c.Conn, Request: &r}
+
+	go func() {
+		_, err := h.forward(bg, e, cacheControl{}, func() { h.cache.endFetch(e.Key, f) })
+		if err != nil {
+			slog.Debug(fmt.Sprintf("failed revalidating %s: %s", e.URL, err))
+		}
+
+		if bg.Response != nil && bg.Response.Body != nil {
+			io.Copy(io.Discard, bg.Response.Body)
+			bg.Response.Body.Close()
+		}
+	}()
+}
+
+// store arranges for the response of c to be stored once its body has been
+// read, if it may be stored, calling done afterwards.
+func (h cacheHandler) store(c *Context, requestTime time.Time, status string, done func()) {
+	resp := c.Response
+	header := http.Header(resp.Headers)
+	stored := false
+	if resp.Body != nil && storable(c.Request, resp.StatusCode, header) {
+		length, err := strconv.ParseInt(header.Get(HeaderContentLength), 10, 64)
+		if err != nil || length <= h.cache.maxObjectSize {
+			r := c.Request
+			statusCode := resp.StatusCode
+			storedHeader := header.Clone()
+			resp.Body = newCacheBody(resp.Body, h.cache.maxObjectSize, func(body []byte) {
+				h.cache.put(r, statusCode, storedHeader, body, requestTime, h.cache.now())
+			}, done)
+			status += "; stored"
+			stored = true
+		}
+	}
+	delete(resp.Headers, h.cache.surrogateKeys)
+	resp.Headers[HeaderCacheStatus] = []string{status}
+
+	if !stored {
+		done()
+	}
+}
+
+func isServerError(status int) bool {
+	switch status {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func closeResponse(r *Response) {
+	if r.Body != nil {
+		r.Body.Close()
+	}
+}
+
+// forwardUnsafe passes on a request that may change the resource, then
+// invalidates the entries for it, see RFC 9111 section 4.4.
+func (h cacheHandler) forwardUnsafe(c *Context) (bool, error) {
+	handled, err := h.next.Handle(c)
+	if !handled || err != nil || c.Response == nil {
+		return handled, err
+	}
+
+	if c.Response.StatusCode < 200 || c.Response.StatusCode >= 400 {
+		return true, nil
+	}
+
+	target := cacheURL(c.Request)
+	h.cache.invalidate(target)
+
+	base, err := url.Parse(target)
+	if err != nil {
+		return true, nil
+	}
+	for _, k := range []string{HeaderLocation, HeaderContentLocation} {
+		ref, err := url.Parse(http.Header(c.Response.Headers).Get(k))
+		if err != nil || ref.String() == "" {
+			continue
+		}
+
+		// Only URLs of the same origin, so that a backend cannot purge others
+		if u := base.ResolveReference(ref); u.Scheme == base.Scheme && u.Host == base.Host {
+			h.cache.invalidate(u.String())
+		}
+	}
+	return true, nil
+}
+
+// setConditionalHeaders replaces the conditional headers of r with ones that
+// validate a response with headers h, returning a func to put them back.
+func setConditionalHeaders(r *Request, h http.Header) func() {
+	saved := make(map[string][]string)
+	for k, vs := range r.Headers {
+		if strings.EqualFold(k, HeaderIfNoneMatch) || strings.EqualFold(k, HeaderIfModifiedSince) {
+			saved[k] = vs
+			delete(r.Headers, k)
+		}
+	}
+
+	if etag := h.Get(HeaderETag); etag != "" {
+		r.Headers[HeaderIfNoneMatch] = []string{etag}
+	}
+	if lastModified := h.Get(HeaderLastModified); lastModified != "" {
+		r.Headers[HeaderIfModifiedSince] = []string{lastModified}
+	}
+
+	return func() {
+		delete(r.Headers, HeaderIfNoneMatch)
+		delete(r.Headers, HeaderIfModifiedSince)
+		for k, vs := range saved {
+			r.Headers[k] = vs
+		}
+	}
+}
+
+// conditionMatches reports whether the conditional headers of r are satisfied
+// by a response with headers h, so that a 304 can be sent instead.
+func conditionMatches(r *Request, h map[string][]string) bool {
+	header := http.Header(h)
+	if inm := r.Header(HeaderIfNoneMatch); inm != "" {
+		etag := strings.TrimPrefix(header.Get(HeaderETag), "W/")
+		if etag == "" {
+			return false
+		}
+
+		// If-None-Match uses the weak comparison, see RFC 9110 section 8.8.3.2
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header(HeaderIfModifiedSince); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		lastModified, err := http.ParseTime(header.Get(HeaderLastModified))
+		return err == nil && !lastModified.After(since)
+	}
+
+	return false
+}
+
+// errCacheBodyTooLarge ends the read ahead of a body too large to be stored.
+var errCacheBodyTooLarge = errors.New("response too large to be cached")
+
+// cacheBody reads a response body ahead of the client, storing it once the
+// backend has sent all of it, unless it grew larger than limit. The requests
+// collapsed into it are let go as soon as it is stored, or is not going to
+// be, rather than waiting for a slow client to read it.
+type cacheBody struct {
+	body  io.ReadCloser
+	limit int64
+	store func(body []byte)
+	// done is called once the body is stored, or is not going to be
+	done func()
+	once sync.Once
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  []byte
+	// read is how much of buf the client has read
+	read int
+	// err ends the read ahead, either io.EOF, a read error or
+	// errCacheBodyTooLarge, after which the client reads body itself
+	err error
+}
+
+func newCacheBody(body io.ReadCloser, limit int64, store func(body []byte), done func()) *cacheBody {
+	b := &cacheBody{body: body, limit: limit, store: store, done: done}
+	b.cond = sync.NewCond(&b.mu)
+	go b.readAhead()
+	return b
+}
+
+func (b *cacheBody) readAhead() {
+	defer b.once.Do(b.done)
+
+	chunk := make([]byte, 32<<10)
+	for {
+		n, err := b.body.Read(chunk)
+
+		b.mu.Lock()
+		b.buf = append(b.buf, chunk[:n]...)
+		if err == nil && int64(len(b.buf)) > b.limit {
+			err = errCacheBodyTooLarge
+		}
+		b.err = err
+		b.cond.Broadcast()
+		b.mu.Unlock()
+
+		if err == io.EOF && int64(len(b.buf)) <= b.limit {
+			b.store(bytes.Clone(b.buf))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (b *cacheBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	for b.read == len(b.buf) && b.err == nil {
+		b.cond.Wait()
+	}
+
+	if b.read < len(b.buf) {
+		n := copy(p, b.buf[b.read:])
+		b.read += n
+		b.mu.Unlock()
+		return n, nil
+	}
+	err := b.err
+	b.mu.Unlock()
+
+	if err == errCacheBodyTooLarge {
+		// The read ahead has stopped, so the rest is passed straight through
+		return b.body.Read(p)
+	}
+	return 0, err
+}
+
+func (b *cacheBody) Close() error {
+	// Ends the read ahead if the client gave up before the end
+	err := b.body.Close()
+
+	b.mu.Lock()
+	for b.err == nil {
+		b.cond.Wait()
+	}
+	b.mu.Unlock()
+	return err
+}
@@ -0,0 +1,616 @@
+package butler
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startCachingProxy starts a proxy caching the responses of b, with a clock
+// that is moved forward by adding to offset.
+func startCachingProxy(t *testing.T, b Backend, c Cache, offset *atomic.Int64) string {
+	s, err := NewServer(&Config{
+		Listen:    0,
+		ListenTLS: -1,
+		Backends:  []Backend{b},
+		Cache:     c,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.sites.defaultSite.cache.now = func() time.Time {
+		return time.Now().Add(time.Duration(offset.Load()))
+	}
+
+	go s.Listen()
+	t.Cleanup(func() { s.Close() })
+	<-s.httpListener.readyCh
+	return "http://" + s.httpListener.listener.Addr().String()
+}
+
+// cacheClient sends every request on one connection, so that a response has
+// been stored before the next request is handled.
+func cacheClient(t *testing.T) *http.Client {
+	transport := &http.Transport{MaxConnsPerHost: 1}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{Transport: transport}
+}
+
+func cacheGet(t *testing.T, client *http.Client, method string, url string, headers map[string]string) (*http.Response, string) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, _ := io.ReadAll(resp.Body)
+	return resp, string(b)
+}
+
+func TestCacheFreshnessLifetime(t *testing.T) {
+	date := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		n        string
+		status   int
+		header   map[string]string
+		lifetime time.Duration
+	}{
+		{"MaxAge", 200, map[string]string{"Cache-Control": "max-age=60"}, time.Minute},
+		{"SMaxAgeWins", 200, map[string]string{"Cache-Control": "max-age=60, s-maxage=120"}, 2 * time.Minute},
+		{"Expires", 200, map[string]string{"Expires": date.Add(time.Hour).Format(http.TimeFormat)}, time.Hour},
+		{"MaxAgeOverExpires", 200, map[string]string{"Cache-Control": "max-age=5", "Expires": date.Add(time.Hour).Format(http.TimeFormat)}, 5 * time.Second},
+		{"InvalidExpires", 200, map[string]string{"Expires": "0"}, 0},
+		{"Heuristic", 200, map[string]string{"Last-Modified": date.Add(-10 * time.Hour).Format(http.TimeFormat)}, time.Hour},
+		{"HeuristicCapped", 200, map[string]string{"Last-Modified": date.Add(-1000 * time.Hour).Format(http.TimeFormat)}, maxHeuristicFreshness},
+		{"HeuristicStatus", 302, map[string]string{"Last-Modified": date.Add(-10 * time.Hour).Format(http.TimeFormat)}, 0},
+		{"None", 200, map[string]string{}, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			h := http.Header{}
+			h.Set(HeaderDate, date.Format(http.TimeFormat))
+			for k, v := range c.header {
+				h.Set(k, v)
+			}
+
+			e := &cacheEntry{StatusCode: c.status, Header: h, RequestTime: date, ResponseTime: date}
+			if got := e.freshnessLifetime(); got != c.lifetime {
+				t.Fatalf("expected %v but got %v", c.lifetime, got)
+			}
+		})
+	}
+}
+
+func TestCacheServable(t *testing.T) {
+	date := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		n        string
+		response string
+		request  string
+		age      time.Duration
+		servable bool
+	}{
+		{"Fresh", "max-age=60", "", 30 * time.Second, true},
+		{"Stale", "max-age=60", "", 90 * time.Second, false},
+		{"NoCache", "max-age=60, no-cache", "", 0, false},
+		{"RequestNoCache", "max-age=60", "no-cache", 0, false},
+		{"RequestMaxAge", "max-age=60", "max-age=10", 30 * time.Second, false},
+		{"RequestMinFresh", "max-age=60", "min-fresh=40", 30 * time.Second, false},
+		{"RequestMaxStale", "max-age=60", "max-stale=60", 90 * time.Second, true},
+		{"RequestMaxStaleExceeded", "max-age=60", "max-stale=10", 90 * time.Second, false},
+		{"RequestAnyStale", "max-age=60", "max-stale", time.Hour, true},
+		{"MustRevalidate", "max-age=60, must-revalidate", "max-stale", 90 * time.Second, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			h := http.Header{}
+			h.Set(HeaderDate, date.Format(http.TimeFormat))
+			h.Set(HeaderCacheControl, c.response)
+
+			e := &cacheEntry{StatusCode: 200, Header: h, RequestTime: date, ResponseTime: date}
+			if got := e.servable(c.age, parseCacheControl([]string{c.request})); got != c.servable {
+				t.Fatalf("expected %v but got %v", c.servable, got)
+			}
+		})
+	}
+}
+
+func TestCacheServesAndRevalidates(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	var offset atomic.Int64
+	var hits, revalidations atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		// Dated by the proxy's clock, as if the two were in step
+		w.Header().Set("Date", time.Now().Add(time.Duration(offset.Load())).UTC().Format(http.TimeFormat))
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			revalidations.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("cached"))
+	}))
+	defer upstream.Close()
+
+	url := startCachingProxy(t, Backend{Addr: upstream.Listener.Addr().String(), Path: "/"}, Cache{MaxSize: 1 << 20}, &offset)
+	client := cacheClient(t)
+
+	steps := []struct {
+		n             string
+		advance       time.Duration
+		headers       map[string]string
+		status        int
+		cacheStatus   string
+		hits          int32
+		revalidations int32
+	}{
+		{"Miss", 0, nil, 200, "butler; fwd=uri-miss; stored", 1, 0},
+		{"Hit", 0, nil, 200, "butler; hit", 1, 0},
+		{"ClientConditional", 0, map[string]string{"If-None-Match": `"v1"`}, 304, "butler; hit", 1, 0},
+		{"Stale", 61 * time.Second, nil, 200, "butler; fwd=stale; fwd-status=304", 2, 1},
+		{"Freshened", 0, nil, 200, "butler; hit", 2, 1},
+		{"RequestNoCache", 0, map[string]string{"Cache-Control": "no-cache"}, 200, "butler; fwd=stale; fwd-status=304", 3, 2},
+	}
+
+	for _, s := range steps {
+		offset.Add(int64(s.advance))
+		resp, body := cacheGet(t, client, "GET", url+"/page", s.headers)
+
+		if resp.StatusCode != s.status {
+			t.Fatalf("%s: expected %v but got %v", s.n, s.status, resp.StatusCode)
+		}
+		if s.status == 200 && body != "cached" {
+			t.Fatalf("%s: expected %q but got %q", s.n, "cached", body)
+		}
+		if got := resp.Header.Get(HeaderCacheStatus); got != s.cacheStatus {
+			t.Fatalf("%s: expected Cache-Status %q but got %q", s.n, s.cacheStatus, got)
+		}
+		if hits.Load() != s.hits || revalidations.Load() != s.revalidations {
+			t.Fatalf("%s: expected %v hits and %v revalidations but got %v and %v",
+				s.n, s.hits, s.revalidations, hits.Load(), revalidations.Load())
+		}
+	}
+
+	offset.Add(int64(30 * time.Second))
+	resp, _ := cacheGet(t, client, "HEAD", url+"/page", nil)
+	if age := resp.Header.Get(HeaderAge); age != "30" && age != "31" {
+		t.Fatalf("expected an Age of 30 but got %q", age)
+	}
+	if resp.ContentLength != int64(len("cached")) || hits.Load() != 3 {
+		t.Fatalf("expected HEAD to be answered from the cache")
+	}
+}
+
+func TestCacheUpstreamAge(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	var offset atomic.Int64
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		// As sent by a cache in front of the backend
+		w.Header().Set("Date", time.Now().Add(time.Duration(offset.Load())).UTC().Format(http.TimeFormat))
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Age", "3000")
+		w.Write([]byte("cached"))
+	}))
+	defer upstream.Close()
+
+	url := startCachingProxy(t, Backend{Addr: upstream.Listener.Addr().String(), Path: "/"}, Cache{MaxSize: 1 << 20}, &offset)
+	client := cacheClient(t)
+
+	steps := []struct {
+		n       string
+		advance time.Duration
+		ages    []string
+		hits    int32
+	}{
+		{"Miss", 0, []string{"3000"}, 1},
+		{"Hit", 0, []string{"3000", "3001"}, 1},
+		{"StillFresh", 590 * time.Second, []string{"3590", "3591"}, 1},
+		{"Stale", 20 * time.Second, []string{"3000"}, 2},
+	}
+
+	for _, s := range steps {
+		offset.Add(int64(s.advance))
+		resp, _ := cacheGet(t, client, "GET", url+"/page", nil)
+
+		if age := resp.Header.Get(HeaderAge); !slices.Contains(s.ages, age) {
+			t.Fatalf("%s: expected an Age of %s but got %q", s.n, s.ages[0], age)
+		}
+		if hits.Load() != s.hits {
+			t.Fatalf("%s: expected %v hits but got %v", s.n, s.hits, hits.Load())
+		}
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte(r.Header.Get("Accept-Language")))
+	}))
+	defer upstream.Close()
+
+	url := startCachingProxy(t, Backend{Addr: upstream.Listener.Addr().String(), Path: "/"}, Cache{MaxSize: 1 << 20}, &atomic.Int64{})
+	client := cacheClient(t)
+
+	for _, lang := range []string{"en", "fr", "en", "fr"} {
+		_, body := cacheGet(t, client, "GET", url+"/", map[string]string{"Accept-Language": lang})
+		if body != lang {
+			t.Fatalf("expected %q but got %q", lang, body)
+		}
+	}
+
+	if hits.Load() != 2 {
+		t.Fatalf("expected a response per language but upstream was hit %v times", hits.Load())
+	}
+}
+
+func TestCacheNotStored(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		switch r.URL.Path {
+		case "/no-store":
+			w.Header().Set("Cache-Control", "max-age=60, no-store")
+		case "/private":
+			w.Header().Set("Cache-Control", "max-age=60, private")
+		case "/cookie":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Set-Cookie", "session=1")
+		case "/vary-all":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "*")
+		case "/authorized", "/request-no-store":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/too-large":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte(strings.Repeat("a", 2048)))
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	url := startCachingProxy(t, Backend{Addr: upstream.Listener.Addr().String(), Path: "/"}, Cache{MaxSize: 1 << 20, MaxObjectSize: 1024}, &atomic.Int64{})
+	client := cacheClient(t)
+
+	cases := []struct {
+		path    string
+		headers map[string]string
+	}{
+		{"/no-store", nil},
+		{"/private", nil},
+		{"/cookie", nil},
+		{"/vary-all", nil},
+		{"/authorized", map[string]string{"Authorization": "Basic dXNlcjpwYXNz"}},
+		{"/request-no-store", map[string]string{"Cache-Control": "no-store"}},
+		{"/uncacheable", nil},
+		{"/too-large", nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			hits.Store(0)
+			cacheGet(t, client, "GET", url+c.path, c.headers)
+			cacheGet(t, client, "GET", url+c.path, c.headers)
+			if hits.Load() != 2 {
+				t.Fatalf("expected the response not to be stored but upstream was hit %v times", hits.Load())
+			}
+		})
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.Method == "POST" {
+			w.Header().Set("Location", "/other")
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	url := startCachingProxy(t, Backend{Addr: upstream.Listener.Addr().String(), Path: "/"}, Cache{MaxSize: 1 << 20}, &atomic.Int64{})
+	client := cacheClient(t)
+
+	cacheGet(t, client, "GET", url+"/items", nil)
+	cacheGet(t, client, "GET", url+"/other", nil)
+	cacheGet(t, client, "POST", url+"/items", nil)
+	cacheGet(t, client, "GET", url+"/items", nil)
+	cacheGet(t, client, "GET", url+"/other", nil)
+
+	if hits.Load() != 5 {
+		t.Fatalf("expected POST to invalidate both URLs but upstream was hit %v times", hits.Load())
+	}
+}
+
+func TestCacheDiskTier(t *testing.T) {
+	dir := t.TempDir()
+	c := Cache{MaxSize: 1024, Dir: dir}
+
+	ch, err := newCache(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(path string) *Request {
+		return &Request{Scheme: "http", Host: "example.com", Method: "GET", Path: path, Headers: map[string][]string{}}
+	}
+	header := http.Header{"Cache-Control": {"max-age=60"}}
+	now := time.Now()
+
+	ch.put(request("/a"), 200, header, []byte(strings.Repeat("a", 600)), now, now)
+	ch.put(request("/b"), 200, header, []byte(strings.Repeat("b", 600)), now, now)
+
+	if _, ok := ch.memory.items[cacheURL(request("/a"))]; ok {
+		t.Fatal("expected /a to have been evicted from memory")
+	}
+	if _, ok := ch.disk.entries.items[cacheURL(request("/a"))]; !ok {
+		t.Fatal("expected /a to have moved to disk")
+	}
+
+	// A new cache finds what the last one left on disk
+	ch, err = newCache(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := ch.get(request("/a"))
+	if e == nil || string(e.Body) != strings.Repeat("a", 600) {
+		t.Fatal("expected /a to be read from disk")
+	}
+	if e.freshnessLifetime() != time.Minute {
+		t.Fatalf("expected the headers of /a to be kept but got %v", e.Header)
+	}
+	if ch.get(request("/b")) != nil {
+		t.Fatal("expected /b to have been lost with the memory of the last cache")
+	}
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	date := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		n        string
+		response string
+		request  string
+		fallback time.Duration
+		age      time.Duration
+		allowed  bool
+	}{
+		{"Response", "max-age=60, stale-if-error=60", "", 0, 90 * time.Second, true},
+		{"ResponseExceeded", "max-age=60, stale-if-error=10", "", 0, 90 * time.Second, false},
+		{"Request", "max-age=60", "stale-if-error=60", 0, 90 * time.Second, true},
+		{"Fallback", "max-age=60", "", time.Minute, 90 * time.Second, true},
+		{"FallbackExceeded", "max-age=60", "", time.Minute, 5 * time.Minute, false},
+		{"None", "max-age=60", "", 0, 90 * time.Second, false},
+		{"MustRevalidate", "max-age=60, must-revalidate, stale-if-error=60", "", time.Minute, 90 * time.Second, false},
+		{"NoCache", "no-cache, stale-if-error=60", "", time.Minute, 0, false},
+		{"RequestNoCache", "max-age=60, stale-if-error=60", "no-cache", time.Minute, 90 * time.Second, false},
+		{"FreshWithoutFallback", "max-age=60", "max-age=0", 0, 30 * time.Second, false},
+		{"FreshFallback", "max-age=60", "max-age=0", time.Minute, 30 * time.Second, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			h := http.Header{}
+			h.Set(HeaderDate, date.Format(http.TimeFormat))
+			h.Set(HeaderCacheControl, c.response)
+
+			e := &cacheEntry{StatusCode: 200, Header: h, RequestTime: date, ResponseTime: date}
+			if got := e.staleIfError(c.age, parseCacheControl([]string{c.request}), c.fallback); got != c.allowed {
+				t.Fatalf("expected %v but got %v", c.allowed, got)
+			}
+		})
+	}
+}
+
+func TestCacheCollapsesRequests(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	var hits atomic.Int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("popular"))
+	}))
+	defer upstream.Close()
+
+	url := startCachingProxy(t, Backend{Addr: upstream.Listener.Addr().String(), Path: "/"}, Cache{MaxSize: 1 << 20}, &atomic.Int64{})
+
+	bodies := make(chan string)
+	for range 5 {
+		go func() {
+			resp, err := http.Get(url + "/popular")
+			if err != nil {
+				bodies <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+
+			b, _ := io.ReadAll(resp.Body)
+			bodies <- string(b)
+		}()
+	}
+
+	// Let the requests queue up behind the first
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	for range 5 {
+		if body := <-bodies; body != "popular" {
+			t.Fatalf("expected %q but got %q", "popular", body)
+		}
+	}
+
+	if hits.Load() != 1 {
+		t.Fatalf("expected one fetch from upstream but got %v", hits.Load())
+	}
+}
+
+func TestCacheCollapsesBehindSlowClient(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	body := strings.Repeat("a", 8<<20)
+	var hits atomic.Int32
+	arrived := make(chan struct{}, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		arrived <- struct{}{}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(body))
+	}))
+	defer upstream.Close()
+
+	url := startCachingProxy(t, Backend{Addr: upstream.Listener.Addr().String(), Path: "/"}, Cache{MaxSize: 32 << 20, MaxObjectSize: 16 << 20}, &atomic.Int64{})
+
+	// The first request is never read
+	host := strings.TrimPrefix(url, "http://")
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /big HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+	<-arrived
+
+	start := time.Now()
+	resp, got := cacheGet(t, http.DefaultClient, "GET", url+"/big", nil)
+	if got != body || resp.Header.Get(HeaderCacheStatus) != "butler; hit; collapsed" {
+		t.Fatalf("expected the collapsed response but got %d bytes with %q", len(got), resp.Header.Get(HeaderCacheStatus))
+	}
+	if time.Since(start) > 2*time.Second || hits.Load() != 1 {
+		t.Fatalf("expected not to wait for the first client, but took %s with %v fetches", time.Since(start), hits.Load())
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	var offset atomic.Int64
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		w.Header().Set("Date", time.Now().Add(time.Duration(offset.Load())).UTC().Format(http.TimeFormat))
+		w.Header().Set("Cache-Control", "max-age=10, stale-while-revalidate=60")
+		fmt.Fprintf(w, "version %d", n)
+	}))
+	defer upstream.Close()
+
+	url := startCachingProxy(t, Backend{Addr: upstream.Listener.Addr().String(), Path: "/"}, Cache{MaxSize: 1 << 20}, &offset)
+	client := cacheClient(t)
+
+	cacheGet(t, client, "GET", url+"/", nil)
+	offset.Add(int64(20 * time.Second))
+
+	resp, body := cacheGet(t, client, "GET", url+"/", nil)
+	if body != "version 1" || resp.Header.Get(HeaderCacheStatus) != "butler; hit; detail=stale-while-revalidate" {
+		t.Fatalf("expected the stale response but got %q %q", body, resp.Header.Get(HeaderCacheStatus))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, body = cacheGet(t, client, "GET", url+"/", nil)
+		if body == "version 2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the response to be refreshed in the background but got %q", body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if resp.Header.Get(HeaderCacheStatus) != "butler; hit" || hits.Load() != 2 {
+		t.Fatalf("expected the refreshed response from the cache but got %q after %v hits",
+			resp.Header.Get(HeaderCacheStatus), hits.Load())
+	}
+
+	// Beyond stale-while-revalidate, the client waits for a fresh response
+	offset.Add(int64(2 * time.Minute))
+	if _, body = cacheGet(t, client, "GET", url+"/", nil); body != "version 3" {
+		t.Fatalf("expected %q but got %q", "version 3", body)
+	}
+}
+
+func TestCacheStaleIfBackendFails(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	var offset atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(time.Duration(offset.Load())).UTC().Format(http.TimeFormat))
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Write([]byte("last known"))
+	}))
+
+	url := startCachingProxy(t,
+		Backend{Addr: upstream.Listener.Addr().String(), Path: "/", BreakerThreshold: 1},
+		Cache{MaxSize: 1 << 20, StaleIfError: time.Minute}, &offset)
+	client := cacheClient(t)
+
+	cacheGet(t, client, "GET", url+"/", nil)
+	upstream.Close()
+	offset.Add(int64(20 * time.Second))
+
+	steps := []struct {
+		n           string
+		status      int
+		cacheStatus string
+	}{
+		{"BackendDown", 200, "butler; fwd=stale; fwd-status=502; detail=stale-if-error"},
+		{"BreakerOpen", 200, "butler; fwd=stale; fwd-status=503; detail=stale-if-error"},
+	}
+
+	for _, s := range steps {
+		resp, body := cacheGet(t, client, "GET", url+"/", nil)
+		if resp.StatusCode != s.status || body != "last known" {
+			t.Fatalf("%s: expected the stale response but got %v %q", s.n, resp.StatusCode, body)
+		}
+		if got := resp.Header.Get(HeaderCacheStatus); got != s.cacheStatus {
+			t.Fatalf("%s: expected Cache-Status %q but got %q", s.n, s.cacheStatus, got)
+		}
+	}
+
+	offset.Add(int64(time.Minute))
+	if resp, _ := cacheGet(t, client, "GET", url+"/", nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 once too stale but got %v", resp.StatusCode)
+	}
+}
@@ -0,0 +1,209 @@
+package butler
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// lru keeps the most recently used items whose sizes add up to at most maxSize.
+type lru struct {
+	maxSize int64
+	size    int64
+	items   map[string]*list.Element
+	order   *list.List
+}
+
+type lruItem struct {
+	key   string
+	size  int64
+	entry *cacheEntry
+}
+
+func newLRU(maxSize int64) *lru {
+	return &lru{maxSize: maxSize, items: make(map[string]*list.Element), order: list.New()}
+}
+
+func (l *lru) get(key string) (*cacheEntry, bool) {
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	l.order.MoveToFront(el)
+	return el.Value.(*lruItem).entry, true
+}
+
+// add stores e under key, returning the items evicted to make room for it.
+func (l *lru) add(key string, size int64, e *cacheEntry) []*lruItem {
+	l.remove(key)
+	if size > l.maxSize {
+		return []*lruItem{{key, size, e}}
+	}
+
+	l.items[key] = l.order.PushFront(&lruItem{key, size, e})
+	l.size += size
+
+	var evicted []*lruItem
+	for l.size > l.maxSize {
+		el := l.order.Back()
+		item := el.Value.(*lruItem)
+		l.order.Remove(el)
+		delete(l.items, item.key)
+		l.size -= item.size
+		evicted = append(evicted, item)
+	}
+	return evicted
+}
+
+func (l *lru) remove(key string) (*cacheEntry, bool) {
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	item := el.Value.(*lruItem)
+	l.order.Remove(el)
+	delete(l.items, key)
+	l.size -= item.size
+	return item.entry, true
+}
+
+// diskStore keeps entries in files under dir, one per key. Only their
+// metadata is held in memory.
+type diskStore struct {
+	dir     string
+	entries *lru
+}
+
+func newDiskStore(dir string, maxSize int64) (*diskStore, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &diskStore{dir: dir, entries: newLRU(maxSize)}, nil
+}
+
+// load indexes the entries left in dir by a previous run, least recently
+// written first so that they are evicted first.
+func (d *diskStore) load() error {
+	files, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+
+	type stored struct {
+		path    string
+		modTime time.Time
+	}
+	var paths []stored
+	for _, f := range files {
+		info, err := f.Info()
+		if err != nil || !info.Mode().IsRegular() || filepath.Ext(f.Name()) != ".cache" {
+			continue
+		}
+		paths = append(paths, stored{filepath.Join(d.dir, f.Name()), info.ModTime()})
+	}
+	slices.SortFunc(paths, func(a, b stored) int { return a.modTime.Compare(b.modTime) })
+
+	for _, p := range paths {
+		e, err := readCacheFile(p.path)
+		if err != nil {
+			slog.Debug(fmt.Sprintf("skipping cache file %s: %s", p.path, err))
+			continue
+		}
+
+		for _, item := range d.entries.add(e.Key, e.size(), e.metadata()) {
+			os.Remove(d.path(item.key))
+		}
+	}
+	return nil
+}
+
+func (d *diskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:])+".cache")
+}
+
+// add writes e to disk, returning the entries evicted to make room for it.
+func (d *diskStore) add(e *cacheEntry) ([]*cacheEntry, error) {
+	if e.size() > d.entries.maxSize {
+		return nil, nil
+	}
+
+	path := d.path(e.Key)
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	err = gob.NewEncoder(f).Encode(e)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	var evicted []*cacheEntry
+	for _, item := range d.entries.add(e.Key, e.size(), e.metadata()) {
+		os.Remove(d.path(item.key))
+		if item.key != e.Key {
+			evicted = append(evicted, item.entry)
+		}
+	}
+	return evicted, nil
+}
+
+// take reads the entry for key and removes it from disk.
+func (d *diskStore) take(key string) (*cacheEntry, error) {
+	m, ok := d.entries.remove(key)
+	if !ok {
+		return nil, nil
+	}
+
+	path := d.path(key)
+	defer os.Remove(path)
+
+	e, err := readCacheFile(path)
+	if err != nil {
+		return nil, err
+	}
+	e.Hits = m.Hits
+	return e, nil
+}
+
+func (d *diskStore) remove(key string) {
+	if _, ok := d.entries.remove(key); ok {
+		os.Remove(d.path(key))
+	}
+}
+
+func readCacheFile(path string) (*cacheEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	e := &cacheEntry{}
+	err = gob.NewDecoder(f).Decode(e)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
@@ -0,0 +1,419 @@
+package butler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCGITimeout = 30 * time.Second
+	maxLocalRedirects = 10
+	// maxCGIStderr bounds how much of a script's stderr is kept for logging
+	maxCGIStderr = 4096
+)
+
+var errMalformedCGIResponse = errors.New("malformed cgi response")
+
+// CGI executes scripts per RFC 3875. With Extensions empty, every file under
+// Dir is a script, mounted at Path. Otherwise only files ending in one of
+// Extensions are scripts, and other requests fall through to the next handler.
+// Dir defaults to the site's DocumentRoot.
+type CGI struct {
+	Path       string        `yaml:"Path"`
+	Dir        string        `yaml:"Dir"`
+	Extensions []string      `yaml:"Extensions"`
+	Timeout    time.Duration `yaml:"Timeout"`
+}
+
+type cgiHandler struct {
+	cgi     CGI
+	docRoot string
+	site    *site
+}
+
+func newCGIHandler(cgi CGI, docRoot string, st *site) cgiHandler {
+	if cgi.Path == "" {
+		cgi.Path = "/"
+	}
+
+	if cgi.Dir == "" {
+		cgi.Dir = docRoot
+	}
+
+	if cgi.Timeout <= 0 {
+		cgi.Timeout = defaultCGITimeout
+	}
+
+	return cgiHandler{cgi, docRoot, st}
+}
+
+func (h cgiHandler) Handle(c *Context) (bool, error) {
+	urlPath, query, _ := strings.Cut(c.Request.Path, "?")
+	if !hasPathPrefix(urlPath, h.cgi.Path) {
+		return false, nil
+	}
+
+	rel := path.Clean("/" + strings.TrimPrefix(urlPath, h.cgi.Path))
+	script, scriptName, pathInfo := h.findScript(rel)
+	if script == "" {
+		if len(h.cgi.Extensions) > 0 {
+			return false, nil
+		}
+
+		c.Response = NotFound()
+		return true, nil
+	}
+
+	env := cgiEnv(c, scriptName, pathInfo, query, h.docRoot)
+	env = append(env, "SCRIPT_FILENAME="+script, "PATH="+os.Getenv("PATH"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.cgi.Timeout)
+	stderr := &limitedBuffer{max: maxCGIStderr}
+
+	cmd := exec.CommandContext(ctx, script)
+	cmd.Dir = filepath.Dir(script)
+	cmd.Env = env
+	cmd.Stdin = c.Request.BodyReader()
+	cmd.Stderr = stderr
+	// Scripts that leave children holding stdout open must not block us past the timeout
+	cmd.WaitDelay = time.Second
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return false, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		cancel()
+		slog.Error(fmt.Sprintf("cgi script %s failed: %s", script, err))
+		c.Response = InternalServerError()
+		return true, nil
+	}
+
+	body := &cgiBody{reader: bufio.NewReader(stdout), ctx: ctx, cancel: cancel, cmd: cmd, script: script, timeout: h.cgi.Timeout, stderr: stderr}
+	r, location, perr := parseCGIHeaders(body.reader)
+	if perr != nil {
+		body.Close()
+		if ctx.Err() == context.DeadlineExceeded {
+			c.Response = GatewayTimeout()
+			return true, nil
+		}
+
+		slog.Error(fmt.Sprintf("cgi script %s: %s", script, perr))
+		c.Response = InternalServerError()
+		return true, nil
+	}
+
+	if location != "" {
+		// Any body is discarded, but the script is left to finish
+		io.Copy(io.Discard, body)
+		body.Close()
+		return true, localRedirect(c, h.site, location)
+	}
+
+	r.Body = body
+	c.Response = r
+	return true, nil
+}
+
+// cgiBody streams the output of a script to the client. Closing it waits for
+// the script to exit, killing it if its output was not read to the end.
+type cgiBody struct {
+	reader  *bufio.Reader
+	ctx     context.Context
+	cancel  context.CancelFunc
+	cmd     *exec.Cmd
+	script  string
+	timeout time.Duration
+	stderr  *limitedBuffer
+	eof     bool
+	once    sync.Once
+}
+
+func (b *cgiBody) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	if err == io.EOF {
+		if b.ctx.Err() == context.DeadlineExceeded {
+			// Cut short, which must not look like the whole output
+			return n, fmt.Errorf("cgi script %s timed out after %v", b.script, b.timeout)
+		}
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *cgiBody) Close() error {
+	b.once.Do(func() {
+		if !b.eof {
+			b.cancel()
+		}
+		err := b.cmd.Wait()
+		timedOut := b.ctx.Err() == context.DeadlineExceeded
+		b.cancel()
+
+		switch {
+		case timedOut:
+			slog.Error(fmt.Sprintf("cgi script %s timed out after %v", b.script, b.timeout))
+		case err != nil && b.eof:
+			slog.Error(fmt.Sprintf("cgi script %s failed: %s: %s", b.script, err, b.stderr))
+		case b.stderr.Len() > 0:
+			slog.Debug(fmt.Sprintf("cgi script %s: %s", b.script, b.stderr))
+		}
+	})
+	return nil
+}
+
+// findScript walks rel one segment at a time until it reaches a file. The
+// remaining segments become PATH_INFO.
+func (h cgiHandler) findScript(rel string) (script string, scriptName string, pathInfo string) {
+	segments := strings.Split(strings.TrimPrefix(rel, "/"), "/")
+	for i := range segments {
+		candidate := filepath.Join(h.cgi.Dir, filepath.FromSlash(strings.Join(segments[:i+1], "/")))
+		fi, err := os.Stat(candidate)
+		if err != nil {
+			return "", "", ""
+		}
+
+		if fi.IsDir() {
+			continue
+		}
+
+		if !fi.Mode().IsRegular() {
+			return "", "", ""
+		}
+
+		if len(h.cgi.Extensions) > 0 && !slices.Contains(h.cgi.Extensions, filepath.Ext(candidate)) {
+			return "", "", ""
+		}
+
+		scriptName = path.Join(h.cgi.Path, strings.Join(segments[:i+1], "/"))
+		if i+1 < len(segments) {
+			pathInfo = "/" + strings.Join(segments[i+1:], "/")
+		}
+
+		script, err = filepath.Abs(candidate)
+		if err != nil {
+			return "", "", ""
+		}
+		return script, scriptName, pathInfo
+	}
+
+	return "", "", ""
+}
+
+// cgiEnv builds the RFC 3875 meta-variables for a request.
+func cgiEnv(c *Context, scriptName string, pathInfo string, query string, docRoot string) []string {
+	env := []string{
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"SERVER_SOFTWARE=" + serverSoftware,
+		"SERVER_PROTOCOL=HTTP/1.1",
+		"REQUEST_METHOD=" + c.Request.Method,
+		"REQUEST_URI=" + c.Request.Path,
+		"SCRIPT_NAME=" + scriptName,
+		"QUERY_STRING=" + query,
+	}
+
+	if pathInfo != "" {
+		env = append(env, "PATH_INFO="+pathInfo)
+		if docRoot != "" {
+			env = append(env, "PATH_TRANSLATED="+filepath.Join(docRoot, filepath.FromSlash(pathInfo)))
+		}
+	}
+
+	if c.Request.Scheme == "https" {
+		env = append(env, "HTTPS=on")
+	}
+
+	serverName := normalizeHost(c.Request.Host)
+	if c.Conn != nil {
+		if host, port, err := net.SplitHostPort(c.Conn.LocalAddr().String()); err == nil {
+			if serverName == "" {
+				serverName = host
+			}
+			env = append(env, "SERVER_PORT="+port)
+		}
+
+		if host, port, err := net.SplitHostPort(c.Conn.RemoteAddr().String()); err == nil {
+			env = append(env, "REMOTE_ADDR="+host, "REMOTE_HOST="+host, "REMOTE_PORT="+port)
+		}
+	}
+	env = append(env, "SERVER_NAME="+serverName)
+	if host := c.Request.Header(HeaderHost); host != "" {
+		env = append(env, "HTTP_HOST="+host)
+	}
+
+	if c.Request.ContentLength > 0 {
+		env = append(env, "CONTENT_LENGTH="+strconv.FormatInt(c.Request.ContentLength, 10))
+	}
+
+	return appendHeaderEnv(env, c.Request.Headers, false)
+}
+
+// appendHeaderEnv appends request headers as HTTP_* meta-variables, except
+// HTTP_HOST, which callers set from the host the client asked for. The
+// credentials in Authorization are only passed on if credentials is set.
+func appendHeaderEnv(env []string, headers map[string][]string, credentials bool) []string {
+	for k, vs := range headers {
+		if len(vs) == 0 {
+			continue
+		}
+
+		switch http.CanonicalHeaderKey(k) {
+		case HeaderContentLength, HeaderTransferEncoding, HeaderHost:
+			continue
+		case HeaderContentType:
+			env = append(env, "CONTENT_TYPE="+vs[0])
+			continue
+		case HeaderAuthorization:
+			scheme, _, _ := strings.Cut(vs[0], " ")
+			env = append(env, "AUTH_TYPE="+scheme)
+			if !credentials {
+				continue
+			}
+		case "Proxy":
+			// https://httpoxy.org
+			continue
+		}
+
+		name := strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+		env = append(env, "HTTP_"+name+"="+strings.Join(vs, ", "))
+	}
+
+	return env
+}
+
+// localRedirect re-handles the request on st as a GET for location, as
+// described in RFC 3875 section 6.2.2.
+func localRedirect(c *Context, st *site, location string) error {
+	c.localRedirects++
+	if c.localRedirects > maxLocalRedirects {
+		slog.Error(fmt.Sprintf("too many cgi local redirects for %s", c.Request))
+		c.Response = InternalServerError()
+		return nil
+	}
+
+	err := c.Request.discardBody()
+	if err != nil {
+		return err
+	}
+
+	c.Request.Method = RequestGet
+	c.Request.Path = location
+	c.Request.ContentLength = 0
+	c.Request.body = nil
+	c.Request.Body = nil
+	delete(c.Request.Headers, HeaderContentLength)
+	delete(c.Request.Headers, HeaderContentType)
+	delete(c.Request.Headers, HeaderTransferEncoding)
+
+	return st.handleRequest(c)
+}
+
+// parseCGIResponse parses the headers and body written by a CGI (or FastCGI,
+// SCGI) application. If the application asked for a local redirect, the
+// location is returned instead of a response.
+func parseCGIResponse(reader *bufio.Reader) (*Response, string, error) {
+	r, location, err := parseCGIHeaders(reader)
+	if err != nil || location != "" {
+		return r, location, err
+	}
+
+	r.Content, err = io.ReadAll(reader)
+	if err != nil {
+		return nil, "", err
+	}
+	return r, "", nil
+}
+
+// parseCGIHeaders parses the headers written by a CGI application, leaving
+// reader at the start of the body.
+func parseCGIHeaders(reader *bufio.Reader) (*Response, string, error) {
+	headers, err := textproto.NewReader(reader).ReadMIMEHeader()
+	if err != nil && !(err == io.EOF && len(headers) > 0) {
+		return nil, "", fmt.Errorf("%w: %s", errMalformedCGIResponse, err)
+	}
+
+	location := headers.Get(HeaderLocation)
+	if headers.Get("Status") == "" && location != "" {
+		if strings.HasPrefix(location, "/") {
+			return nil, location, nil
+		}
+		headers.Set("Status", strconv.Itoa(http.StatusFound))
+	}
+
+	statusCode, err := cgiStatus(headers)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if location == "" && headers.Get(HeaderContentType) == "" {
+		return nil, "", fmt.Errorf("%w: missing Content-Type", errMalformedCGIResponse)
+	}
+
+	r := StatusCode(statusCode, nil)
+	for k, vs := range headers {
+		if k == "Status" {
+			continue
+		}
+		r.Headers[k] = vs
+	}
+
+	return r, "", nil
+}
+
+// cgiStatus returns the status code from the Status header, e.g. "404 Not Found".
+func cgiStatus(headers textproto.MIMEHeader) (int, error) {
+	status := headers.Get("Status")
+	if status == "" {
+		return http.StatusOK, nil
+	}
+
+	code, _, _ := strings.Cut(status, " ")
+	statusCode, err := strconv.Atoi(code)
+	if err != nil || statusCode < 100 || statusCode > 999 {
+		return 0, fmt.Errorf("%w: invalid status %q", errMalformedCGIResponse, status)
+	}
+
+	return statusCode, nil
+}
+
+// hasPathPrefix reports whether p is prefix or below it, matching whole segments.
+func hasPathPrefix(p string, prefix string) bool {
+	if prefix == "" || prefix == "/" {
+		return true
+	}
+
+	prefix = strings.TrimSuffix(prefix, "/")
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if remaining := b.max - b.Len(); remaining > 0 {
+		b.Buffer.Write(p[:min(len(p), remaining)])
+	}
+	return len(p), nil
+}
@@ -0,0 +1,175 @@
+package butler
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeScript(t *testing.T, dir string, name string, script string) {
+	err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCGI(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	dir := t.TempDir()
+	writeScript(t, dir, "echo.sh", `printf 'Content-Type: text/plain\n\n'
+printf '%s %s %s %s ' "$REQUEST_METHOD" "$SCRIPT_NAME" "$PATH_INFO" "$QUERY_STRING"
+cat
+`)
+	writeScript(t, dir, "status.sh", `printf 'Status: 201 Created\nContent-Type: text/plain\nX-Script: yes\n\ncreated'`)
+	writeScript(t, dir, "local.sh", `printf 'Location: /cgi-bin/echo.sh/redirected\n\n'`)
+	writeScript(t, dir, "client.sh", `printf 'Location: https://example.com/\n\n'`)
+	writeScript(t, dir, "broken.sh", `printf 'no headers here'`)
+	writeScript(t, dir, "hang.sh", `sleep 10`)
+	writeScript(t, dir, "host.sh", `printf 'Content-Type: text/plain\n\n%s %s' "$HTTP_HOST" "$SERVER_NAME"`)
+
+	s, err := NewServer(&Config{
+		Host:      "localhost",
+		Listen:    0,
+		ListenTLS: -1,
+		CGI: []CGI{
+			{Path: "/cgi-bin", Dir: dir, Timeout: 200 * time.Millisecond},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go s.Listen()
+	defer s.Close()
+	<-s.httpListener.readyCh
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	cases := []struct {
+		m string
+		p string
+		b string
+		s int
+		r string
+		n string
+	}{
+		{m: "POST", p: "/cgi-bin/echo.sh/extra?a=1", b: "stdin", s: http.StatusOK, r: "POST /cgi-bin/echo.sh /extra a=1 stdin", n: "MetaVariablesAndStdin"},
+		{m: "PUT", p: "/cgi-bin/status.sh", s: http.StatusCreated, r: "created", n: "Status"},
+		{m: "POST", p: "/cgi-bin/local.sh", b: "dropped", s: http.StatusOK, r: "GET /cgi-bin/echo.sh /redirected  ", n: "LocalRedirect"},
+		{m: "GET", p: "/cgi-bin/client.sh", s: http.StatusFound, n: "ClientRedirect"},
+		{m: "GET", p: "/cgi-bin/broken.sh", s: http.StatusInternalServerError, n: "MalformedResponse"},
+		{m: "GET", p: "/cgi-bin/hang.sh", s: http.StatusGatewayTimeout, n: "Timeout"},
+		{m: "GET", p: "/cgi-bin/host.sh", s: http.StatusOK, r: "localhost:8080 localhost", n: "Host"},
+		{m: "GET", p: "/cgi-bin/missing.sh", s: http.StatusNotFound, n: "Missing"},
+		{m: "GET", p: "/cgi-bin/../cgi_test.go", s: http.StatusNotFound, n: "Traversal"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			req, _ := http.NewRequest(c.m, "http://"+s.httpListener.listener.Addr().String()+c.p, strings.NewReader(c.b))
+			req.Host = "localhost:8080"
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != c.s {
+				t.Fatalf("expected %v but got %v", c.s, resp.StatusCode)
+			}
+
+			b, _ := io.ReadAll(resp.Body)
+			if c.r != "" && string(b) != c.r {
+				t.Fatalf("expected %q but got %q", c.r, b)
+			}
+		})
+	}
+}
+
+func TestCGIStreamsOutput(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	dir := t.TempDir()
+	release := filepath.Join(dir, "release")
+	writeScript(t, dir, "stream.sh", `printf 'Content-Type: text/plain\n\nfirst\n'
+while [ ! -f '`+release+`' ]; do sleep 0.01; done
+printf 'second'
+`)
+
+	_, url := startServer(t, &Config{
+		Listen:    0,
+		ListenTLS: -1,
+		CGI:       []CGI{{Path: "/cgi-bin", Dir: dir, Timeout: 5 * time.Second}},
+	})
+
+	resp, err := http.Get(url + "/cgi-bin/stream.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The script only finishes once the first line has been received
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	if err != nil || line != "first\n" {
+		t.Fatalf("expected the first line to be streamed but got %q: %v", line, err)
+	}
+
+	os.WriteFile(release, nil, 0644)
+	rest, err := io.ReadAll(reader)
+	if err != nil || string(rest) != "second" {
+		t.Fatalf("expected the rest of the output but got %q: %v", rest, err)
+	}
+}
+
+func TestCGIExtensions(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("static"), 0644)
+	writeScript(t, dir, "app.cgi", `printf 'Content-Type: text/plain\n\n%s' "$PATH_INFO"`)
+	writeScript(t, dir, "plain.sh", `printf 'Content-Type: text/plain\n\nran'`)
+
+	s, _ := NewServer(&Config{
+		Host:         "localhost",
+		Listen:       0,
+		ListenTLS:    -1,
+		DocumentRoot: dir,
+		CGI:          []CGI{{Extensions: []string{".cgi"}}},
+	})
+
+	go s.Listen()
+	defer s.Close()
+	<-s.httpListener.readyCh
+
+	cases := []struct {
+		p string
+		r string
+	}{
+		{p: "/app.cgi/some/path", r: "/some/path"},
+		{p: "/index.html", r: "static"},
+		{p: "/plain.sh", r: "#!/bin/sh\nprintf 'Content-Type: text/plain\\n\\nran'"},
+	}
+
+	for _, c := range cases {
+		resp, err := http.Get("http://" + s.httpListener.listener.Addr().String() + c.p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != c.r {
+			t.Fatalf("expected %q but got %q", c.r, b)
+		}
+	}
+}
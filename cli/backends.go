@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kenkam/butler"
+)
+
+type BackendsCmd struct {
+	Admin string `default:"localhost:7071" help:"Address of the admin API."`
+}
+
+func (c *BackendsCmd) Run() error {
+	resp, err := http.Get("http://" + c.Admin + "/backends")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("listing backends failed: %s", resp.Status)
+	}
+
+	var backends []butler.BackendHealth
+	err = json.NewDecoder(resp.Body).Decode(&backends)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SITE\tPOOL\tADDR\tSTATE\tFAILURES\tEJECTIONS\tEJECTED FOR")
+	for _, b := range backends {
+		ejectedFor := ""
+		if !b.EjectedUntil.IsZero() {
+			ejectedFor = time.Until(b.EjectedUntil).Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%s\n", b.Site, b.Pool, b.Addr, b.State, b.ConsecutiveFailures, b.Ejections, ejectedFor)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+
+	"github.com/kenkam/butler"
+)
+
+// cacheFilter selects the cache entries a command applies to.
+type cacheFilter struct {
+	Admin        string `default:"localhost:7071" help:"Address of the admin API."`
+	URL          string `help:"Select the entries for this URL."`
+	Prefix       string `help:"Select the entries whose URL starts with this."`
+	SurrogateKey string `help:"Select the entries tagged with this surrogate key."`
+}
+
+func (f cacheFilter) filter() butler.CacheFilter {
+	return butler.CacheFilter{URL: f.URL, Prefix: f.Prefix, SurrogateKey: f.SurrogateKey}
+}
+
+type CacheListCmd struct {
+	cacheFilter `embed:""`
+}
+
+type CachePurgeCmd struct {
+	cacheFilter `embed:""`
+}
+
+type CacheCmd struct {
+	List  CacheListCmd  `cmd:"" help:"List cache entries."`
+	Purge CachePurgeCmd `cmd:"" help:"Purge cache entries."`
+}
+
+func (c *CacheListCmd) Run() error {
+	q := url.Values{}
+	for k, v := range map[string]string{"url": c.URL, "prefix": c.Prefix, "surrogate-key": c.SurrogateKey} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+
+	resp, err := http.Get("http://" + c.Admin + "/cache?" + q.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("listing cache entries failed: %s", resp.Status)
+	}
+
+	var entries []butler.CacheEntryInfo
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "URL\tSTATUS\tSIZE\tAGE\tHITS\tTIER\tSURROGATE KEYS")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%ds\t%d\t%s\t%v\n", e.URL, e.StatusCode, e.Size, e.Age, e.Hits, e.Tier, e.SurrogateKeys)
+	}
+	return w.Flush()
+}
+
+func (c *CachePurgeCmd) Run() error {
+	f := c.filter()
+	if f == (butler.CacheFilter{}) {
+		return fmt.Errorf("one of --url, --prefix or --surrogate-key must be set")
+	}
+
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post("http://"+c.Admin+"/cache/purge", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("purging cache entries failed: %s", resp.Status)
+	}
+
+	var result struct{ Purged int }
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("purged %d cache entries\n", result.Purged)
+	return nil
+}
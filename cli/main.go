@@ -15,7 +15,11 @@ type ServeCmd struct {
 }
 
 var CLI struct {
-	Serve ServeCmd `cmd:"" help:"Start server."`
+	Serve    ServeCmd    `cmd:"" help:"Start server."`
+	Cache    CacheCmd    `cmd:"" help:"Inspect and purge the cache of a running server."`
+	Split    SplitCmd    `cmd:"" help:"Inspect and change the traffic splits of a running server."`
+	Backends BackendsCmd `cmd:"" help:"List the health of the backends of a running server."`
+	Pools    PoolsCmd    `cmd:"" help:"List the requests in flight and queued for the pools of a running server."`
 }
 
 type iso9601Writer struct{}
@@ -42,5 +46,5 @@ func main() {
 	slog.SetLogLoggerLevel(slog.LevelDebug)
 
 	ctx := kong.Parse(&CLI)
-	ctx.Run()
+	ctx.FatalIfErrorf(ctx.Run())
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"text/tabwriter"
+
+	"github.com/kenkam/butler"
+)
+
+type PoolsCmd struct {
+	Admin string `default:"localhost:7071" help:"Address of the admin API."`
+}
+
+func (c *PoolsCmd) Run() error {
+	resp, err := http.Get("http://" + c.Admin + "/pools")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("listing pools failed: %s", resp.Status)
+	}
+
+	var pools []butler.PoolStats
+	err = json.NewDecoder(resp.Body).Decode(&pools)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SITE\tPOOL\tACTIVE\tQUEUED\tWAITED\tREJECTED\tAVG WAIT\tMAX WAIT")
+	for _, p := range pools {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%.3fs\t%.3fs\n", p.Site, p.Pool, limit(p.Active, p.MaxRequests),
+			limit(p.Queued, p.QueueSize), p.Waited, p.Rejected, p.AverageWaitSeconds, p.MaxWaitSeconds)
+	}
+	return w.Flush()
+}
+
+// limit formats n out of capacity, where a capacity of 0 is unlimited.
+func limit(n int, capacity int) string {
+	if capacity == 0 {
+		return fmt.Sprint(n)
+	}
+	return fmt.Sprintf("%d/%d", n, capacity)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/kenkam/butler"
+)
+
+type SplitListCmd struct {
+	Admin string `default:"localhost:7071" help:"Address of the admin API."`
+}
+
+type SplitSetCmd struct {
+	Admin   string   `default:"localhost:7071" help:"Address of the admin API."`
+	Rule    string   `arg:"" help:"Name of the rule with the split."`
+	Weights []string `arg:"" help:"Weights of targets, such as canary=5."`
+}
+
+type SplitCmd struct {
+	List SplitListCmd `cmd:"" help:"List split weights."`
+	Set  SplitSetCmd  `cmd:"" help:"Set split weights."`
+}
+
+func (c *SplitListCmd) Run() error {
+	resp, err := http.Get("http://" + c.Admin + "/splits")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("listing splits failed: %s", resp.Status)
+	}
+
+	var splits []butler.SplitInfo
+	err = json.NewDecoder(resp.Body).Decode(&splits)
+	if err != nil {
+		return err
+	}
+
+	return printSplits(splits)
+}
+
+func (c *SplitSetCmd) Run() error {
+	weights := map[string]int{}
+	for _, v := range c.Weights {
+		name, weight, ok := strings.Cut(v, "=")
+		w, err := strconv.Atoi(weight)
+		if !ok || err != nil {
+			return fmt.Errorf("invalid weight %q, expected <target>=<weight>", v)
+		}
+		weights[name] = w
+	}
+
+	b, err := json.Marshal(weights)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", "http://"+c.Admin+"/splits/"+url.PathEscape(c.Rule), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("setting split weights failed: %s %s", resp.Status, msg)
+	}
+
+	var splits []butler.SplitInfo
+	err = json.NewDecoder(resp.Body).Decode(&splits)
+	if err != nil {
+		return err
+	}
+
+	return printSplits(splits)
+}
+
+func printSplits(splits []butler.SplitInfo) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SITE\tRULE\tTARGET\tWEIGHT")
+	for _, s := range splits {
+		for _, t := range s.Targets {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", s.Site, s.Rule, t.Name, t.Weight)
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,380 @@
+package butler
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultResolver = "127.0.0.1:53"
+	dnsTimeout      = 5 * time.Second
+	dnsTypeA        = 1
+	dnsTypeCNAME    = 5
+	dnsTypeAAAA     = 28
+	dnsClassIN      = 1
+	dnsMaxUDPSize   = 512
+)
+
+var errNoAddresses = errors.New("no addresses found")
+
+// resolver looks up the A and AAAA records of hosts directly from a DNS
+// server, as net.Resolver does not expose their TTL. Names are looked up as
+// they are, without search domains.
+type resolver struct {
+	server string
+}
+
+func newResolver(server string) *resolver {
+	if server == "" {
+		server = systemNameserver()
+	}
+	return &resolver{server}
+}
+
+// systemNameserver returns the first nameserver of /etc/resolv.conf.
+func systemNameserver() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return defaultResolver
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return defaultResolver
+}
+
+// lookup returns the addresses of host and the shortest TTL of the records
+// they were found through. As many servers fail AAAA queries, it only fails
+// if neither the A nor the AAAA query finds addresses.
+func (r *resolver) lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	var ips []net.IP
+	var errs []error
+	ttl := time.Duration(-1)
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		found, t, err := r.query(ctx, host, qtype)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		ips = append(ips, found...)
+		if len(found) > 0 && (ttl < 0 || t < ttl) {
+			ttl = t
+		}
+	}
+
+	if len(ips) == 0 {
+		if len(errs) > 0 {
+			return nil, 0, errors.Join(errs...)
+		}
+		return nil, 0, fmt.Errorf("%s: %w", host, errNoAddresses)
+	}
+	return ips, ttl, nil
+}
+
+func (r *resolver) query(ctx context.Context, host string, qtype uint16) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+
+	id := uint16(rand.Uint32())
+	q, err := dnsQuery(id, host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := r.exchange(ctx, "udp", q)
+	if err == nil && len(resp) > 2 && resp[2]&0x02 != 0 {
+		// Truncated, so ask again over TCP
+		resp, err = r.exchange(ctx, "tcp", q)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("looking up %s: %w", host, err)
+	}
+
+	return parseDNSResponse(resp, id, qtype)
+}
+
+func (r *resolver) exchange(ctx context.Context, network string, q []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, r.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		_, err = conn.Write(q)
+		if err != nil {
+			return nil, err
+		}
+
+		b := make([]byte, dnsMaxUDPSize)
+		n, err := conn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+
+	// Messages over TCP are prefixed with their length
+	_, err = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(q))), q...))
+	if err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	_, err = io.ReadFull(conn, length[:])
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err = io.ReadFull(conn, b)
+	return b, err
+}
+
+// dnsQuery builds a recursive query for the records of qtype of host.
+func dnsQuery(id uint16, host string, qtype uint16) ([]byte, error) {
+	b := binary.BigEndian.AppendUint16(nil, id)
+	// Recursion desired, and one question
+	b = append(b, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0)
+
+	for label := range strings.SplitSeq(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid host %s", host)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	b = append(b, 0)
+
+	b = binary.BigEndian.AppendUint16(b, qtype)
+	return binary.BigEndian.AppendUint16(b, dnsClassIN), nil
+}
+
+var errMalformedDNSResponse = errors.New("malformed DNS response")
+
+// parseDNSResponse returns the addresses answering a query for qtype, and the
+// shortest TTL of the answers, which include any CNAMEs followed.
+func parseDNSResponse(b []byte, id uint16, qtype uint16) ([]net.IP, time.Duration, error) {
+	if len(b) < 12 || binary.BigEndian.Uint16(b) != id || b[2]&0x80 == 0 {
+		return nil, 0, errMalformedDNSResponse
+	}
+
+	switch rcode := b[3] & 0x0f; rcode {
+	case 0:
+	case 3:
+		return nil, 0, errors.New("no such host")
+	default:
+		return nil, 0, fmt.Errorf("DNS server failed with rcode %d", rcode)
+	}
+
+	qdcount := binary.BigEndian.Uint16(b[4:])
+	ancount := binary.BigEndian.Uint16(b[6:])
+
+	off := 12
+	for range qdcount {
+		end, ok := skipDNSName(b, off)
+		if !ok || end+4 > len(b) {
+			return nil, 0, errMalformedDNSResponse
+		}
+		off = end + 4
+	}
+
+	var ips []net.IP
+	ttl := time.Duration(-1)
+	for range ancount {
+		end, ok := skipDNSName(b, off)
+		if !ok || end+10 > len(b) {
+			return nil, 0, errMalformedDNSResponse
+		}
+
+		rtype := binary.BigEndian.Uint16(b[end:])
+		rttl := time.Duration(binary.BigEndian.Uint32(b[end+4:])) * time.Second
+		length := int(binary.BigEndian.Uint16(b[end+8:]))
+		data := end + 10
+		if data+length > len(b) {
+			return nil, 0, errMalformedDNSResponse
+		}
+		off = data + length
+
+		switch {
+		case rtype == qtype && (rtype == dnsTypeA && length == net.IPv4len || rtype == dnsTypeAAAA && length == net.IPv6len):
+			ips = append(ips, net.IP(slices.Clone(b[data:off])))
+		case rtype != dnsTypeCNAME:
+			continue
+		}
+
+		if ttl < 0 || rttl < ttl {
+			ttl = rttl
+		}
+	}
+
+	return ips, max(ttl, 0), nil
+}
+
+// skipDNSName returns the offset following the name at off, which may end in
+// a pointer to a name elsewhere in the message.
+func skipDNSName(b []byte, off int) (int, bool) {
+	for off < len(b) {
+		length := int(b[off])
+		switch {
+		case length == 0:
+			return off + 1, true
+		case length&0xc0 == 0xc0:
+			return off + 2, off+2 <= len(b)
+		}
+		off += 1 + length
+	}
+	return 0, false
+}
+
+const (
+	// minResolveInterval and maxResolveInterval bound how often backends are
+	// looked up, whatever the TTL of their records
+	minResolveInterval   = time.Second
+	maxResolveInterval   = 5 * time.Minute
+	resolveRetryInterval = 5 * time.Second
+)
+
+// dnsWatcher keeps a pool member for every address the host of a backend
+// resolves to, looking the host up again when its records expire.
+type dnsWatcher struct {
+	b        Backend
+	host     string
+	port     string
+	site     *site
+	resolver *resolver
+	stop     chan struct{}
+
+	mu      sync.Mutex
+	stopped bool
+	members []Backend
+}
+
+func newDNSWatcher(b Backend, st *site) (*dnsWatcher, error) {
+	if network, _ := splitAddr(b.Addr); network == "unix" {
+		return nil, fmt.Errorf("backend %s: unix sockets cannot be resolved", b.Addr)
+	}
+
+	host, port, err := net.SplitHostPort(b.Addr)
+	if err != nil {
+		host, port = b.Addr, ""
+	}
+
+	return &dnsWatcher{b: b, host: host, port: port, site: st, resolver: st.resolver, stop: make(chan struct{})}, nil
+}
+
+func (w *dnsWatcher) run(next time.Duration) {
+	timer := time.NewTimer(next)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-timer.C:
+			timer.Reset(w.refresh())
+		}
+	}
+}
+
+// refresh looks the host up, and adds and removes members to match the
+// addresses found. It returns when to look the host up again. The members are
+// kept if the lookup fails.
+func (w *dnsWatcher) refresh() time.Duration {
+	ips, ttl, err := w.resolver.lookup(context.Background(), w.host)
+	if err != nil {
+		slog.Error(fmt.Sprintf("resolving backend %s failed: %s", w.b.Addr, err))
+		return resolveRetryInterval
+	}
+
+	var members []Backend
+	for _, ip := range ips {
+		members = append(members, w.member(ip))
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.stopped {
+		return 0
+	}
+
+	for _, m := range members {
+		if !slices.ContainsFunc(w.members, m.Equals) {
+			slog.Info(fmt.Sprintf("adding %s for backend %s", m.Addr, w.b.Addr))
+			err := w.site.addBackend(m)
+			if err != nil {
+				slog.Error(fmt.Sprintf("adding %s for backend %s failed: %s", m.Addr, w.b.Addr, err))
+			}
+		}
+	}
+
+	for _, m := range w.members {
+		if !slices.ContainsFunc(members, m.Equals) {
+			slog.Info(fmt.Sprintf("removing %s for backend %s", m.Addr, w.b.Addr))
+			w.site.removeBackend(m)
+		}
+	}
+
+	w.members = members
+	return min(max(ttl, minResolveInterval), maxResolveInterval)
+}
+
+// member is the backend for one of the addresses of the host. It is still
+// sent the host, in the Host header and with SNI.
+func (w *dnsWatcher) member(ip net.IP) Backend {
+	m := w.b
+	m.Resolve = false
+	m.resolvedFrom = w.b.Addr
+
+	if w.port != "" {
+		m.Addr = net.JoinHostPort(ip.String(), w.port)
+	} else if ip.To4() == nil {
+		m.Addr = "[" + ip.String() + "]"
+	} else {
+		m.Addr = ip.String()
+	}
+
+	if m.Scheme == SchemeHTTPS && m.TLS.ServerName == "" {
+		m.TLS.ServerName = w.host
+	}
+	return m
+}
+
+// close stops the watcher and removes its members.
+func (w *dnsWatcher) close() {
+	close(w.stop)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.stopped = true
+	for _, m := range w.members {
+		w.site.removeBackend(m)
+	}
+	w.members = nil
+}
@@ -0,0 +1,362 @@
+package butler
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type stubRecord struct {
+	cname     string
+	ips       []string
+	ttl       uint32
+	truncated bool
+	// fail is the query type answered with SERVFAIL
+	fail uint16
+}
+
+// stubResolver is a DNS server answering from records, over UDP and TCP.
+type stubResolver struct {
+	queries atomic.Int32
+
+	mu      sync.Mutex
+	records map[string]stubRecord
+}
+
+func startStubResolver(t *testing.T, records map[string]stubRecord) (*stubResolver, string) {
+	s := &stubResolver{records: records}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(s.answer(b[:n], true), addr)
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			var length [2]byte
+			io.ReadFull(conn, length[:])
+			q := make([]byte, binary.BigEndian.Uint16(length[:]))
+			io.ReadFull(conn, q)
+
+			resp := s.answer(q, false)
+			conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+			conn.Close()
+		}
+	}()
+
+	return s, pc.LocalAddr().String()
+}
+
+func (s *stubResolver) set(name string, r stubRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[name] = r
+}
+
+func encodeDNSName(name string) []byte {
+	var b []byte
+	for label := range strings.SplitSeq(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func (s *stubResolver) answer(q []byte, udp bool) []byte {
+	s.queries.Add(1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var labels []string
+	off := 12
+	for q[off] != 0 {
+		labels = append(labels, string(q[off+1:off+1+int(q[off])]))
+		off += 1 + int(q[off])
+	}
+	qtype := binary.BigEndian.Uint16(q[off+1:])
+	question := q[12 : off+5]
+
+	resp := append([]byte{q[0], q[1], 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0}, question...)
+
+	var answers [][]byte
+	// The first answer points back at the question name
+	owner := []byte{0xc0, 12}
+	name := strings.Join(labels, ".")
+	for {
+		r, ok := s.records[name]
+		if !ok {
+			if len(answers) == 0 {
+				resp[3] = 0x83
+			}
+			break
+		}
+
+		if r.truncated && udp {
+			resp[2] |= 0x02
+			break
+		}
+
+		if r.fail == qtype {
+			resp[3] = 0x82
+			break
+		}
+
+		rr := func(rtype uint16, data []byte) []byte {
+			a := append(slices.Clone(owner), 0, byte(rtype), 0, dnsClassIN)
+			a = binary.BigEndian.AppendUint32(a, r.ttl)
+			a = binary.BigEndian.AppendUint16(a, uint16(len(data)))
+			return append(a, data...)
+		}
+
+		if r.cname != "" {
+			answers = append(answers, rr(dnsTypeCNAME, encodeDNSName(r.cname)))
+			owner = encodeDNSName(r.cname)
+			name = r.cname
+			continue
+		}
+
+		for _, v := range r.ips {
+			ip := net.ParseIP(v)
+			if ip4 := ip.To4(); ip4 != nil && qtype == dnsTypeA {
+				answers = append(answers, rr(dnsTypeA, ip4))
+			} else if ip4 == nil && qtype == dnsTypeAAAA {
+				answers = append(answers, rr(dnsTypeAAAA, ip))
+			}
+		}
+		break
+	}
+
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(answers)))
+	for _, a := range answers {
+		resp = append(resp, a...)
+	}
+	return resp
+}
+
+func TestResolverLookup(t *testing.T) {
+	many := make([]string, 40)
+	for i := range many {
+		many[i] = net.IPv4(10, 0, 1, byte(i)).String()
+	}
+
+	_, addr := startStubResolver(t, map[string]stubRecord{
+		"a.test":     {ips: []string{"10.0.0.1", "10.0.0.2"}, ttl: 30},
+		"both.test":  {ips: []string{"10.0.0.1", "::1"}, ttl: 30},
+		"alias.test": {cname: "a.test", ttl: 10},
+		"many.test":  {ips: many, ttl: 30, truncated: true},
+		"empty.test": {},
+		"v4.test":    {ips: []string{"10.0.0.1"}, ttl: 30, fail: dnsTypeAAAA},
+		"v6.test":    {ips: []string{"::1"}, ttl: 30, fail: dnsTypeA},
+		"fails.test": {fail: dnsTypeA},
+	})
+	r := newResolver(addr)
+
+	cases := []struct {
+		n    string
+		host string
+		ips  []string
+		ttl  time.Duration
+	}{
+		{"A", "a.test", []string{"10.0.0.1", "10.0.0.2"}, 30 * time.Second},
+		{"AAAA", "both.test", []string{"10.0.0.1", "::1"}, 30 * time.Second},
+		{"CNAME", "alias.test", []string{"10.0.0.1", "10.0.0.2"}, 10 * time.Second},
+		{"Truncated", "many.test", many, 30 * time.Second},
+		{"NoSuchHost", "missing.test", nil, 0},
+		{"NoAddresses", "empty.test", nil, 0},
+		{"AAAAFails", "v4.test", []string{"10.0.0.1"}, 30 * time.Second},
+		{"AFails", "v6.test", []string{"::1"}, 30 * time.Second},
+		{"Fails", "fails.test", nil, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			ips, ttl, err := r.lookup(context.Background(), c.host)
+			if c.ips == nil {
+				if err == nil {
+					t.Fatalf("expected an error but got %v", ips)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, ip := range ips {
+				got = append(got, ip.String())
+			}
+			if !slices.Equal(got, c.ips) || ttl != c.ttl {
+				t.Fatalf("expected %v with a TTL of %s but got %v with %s", c.ips, c.ttl, got, ttl)
+			}
+		})
+	}
+}
+
+// startResolvedUpstreams starts an upstream named after each address, on the
+// same port.
+func startResolvedUpstreams(t *testing.T, host string, addrs ...string) string {
+	port := "0"
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", net.JoinHostPort(addr, port))
+		if err != nil {
+			t.Skipf("cannot listen on %s: %s", addr, err)
+		}
+		_, port, _ = net.SplitHostPort(l.Addr().String())
+
+		s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Host != host+":"+port {
+				w.Write([]byte("wrong host " + r.Host))
+				return
+			}
+			w.Write([]byte(addr))
+		})}
+		go s.Serve(l)
+		t.Cleanup(func() { s.Close() })
+	}
+	return port
+}
+
+func TestResolveBackend(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	port := startResolvedUpstreams(t, "backend.test", "127.0.0.1", "127.0.0.2")
+	stub, resolver := startStubResolver(t, map[string]stubRecord{
+		"backend.test": {ips: []string{"127.0.0.1"}, ttl: 1},
+	})
+
+	b := Backend{Addr: "backend.test:" + port, Path: "/", Resolve: true}
+	s, url := startServer(t, &Config{Listen: 0, ListenTLS: -1, Resolver: resolver, Backends: []Backend{b}})
+
+	if body := getBody(t, url+"/", nil); body != "127.0.0.1" {
+		t.Fatalf("expected the resolved backend but got %q", body)
+	}
+
+	// Waits for requests to be shared between exactly the expected addresses
+	waitFor := func(expected ...string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			got := map[string]bool{}
+			for range 10 {
+				got[getBody(t, url+"/", nil)] = true
+			}
+
+			if len(got) == len(expected) && !slices.ContainsFunc(expected, func(e string) bool { return !got[e] }) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected requests to be sent to %v but got %v", expected, got)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	stub.set("backend.test", stubRecord{ips: []string{"127.0.0.1", "127.0.0.2"}, ttl: 1})
+	waitFor("127.0.0.1", "127.0.0.2")
+
+	stub.set("backend.test", stubRecord{ips: []string{"127.0.0.2"}, ttl: 1})
+	waitFor("127.0.0.2")
+
+	// Members are kept while lookups fail
+	stub.set("backend.test", stubRecord{truncated: true})
+	queries := stub.queries.Load()
+	for stub.queries.Load() < queries+2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitFor("127.0.0.2")
+
+	// As the registrar would
+	s.removeBackend(b)
+	queries = stub.queries.Load()
+	resp, err := http.Get(url + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 once the backend is removed but got %v", resp.StatusCode)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	if q := stub.queries.Load(); q != queries {
+		t.Fatalf("expected lookups to stop but got %v more", q-queries)
+	}
+}
+
+func TestResolveBackendTTL(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	port := startResolvedUpstreams(t, "backend.test", "127.0.0.1")
+	stub, resolver := startStubResolver(t, map[string]stubRecord{
+		"backend.test": {ips: []string{"127.0.0.1"}, ttl: 60},
+	})
+
+	startServer(t, &Config{
+		Listen:    0,
+		ListenTLS: -1,
+		Resolver:  resolver,
+		Backends:  []Backend{{Addr: "backend.test:" + port, Path: "/", Resolve: true}},
+	})
+
+	// One lookup of A and AAAA records, then none until the TTL expires
+	time.Sleep(1500 * time.Millisecond)
+	if q := stub.queries.Load(); q != 2 {
+		t.Fatalf("expected the TTL to be respected but got %v queries", q)
+	}
+}
+
+func TestResolveBackendInvalidSite(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	stub, resolver := startStubResolver(t, map[string]stubRecord{
+		"backend.test": {ips: []string{"127.0.0.1"}, ttl: 1},
+	})
+
+	_, err := NewServer(&Config{
+		Listen:    0,
+		ListenTLS: -1,
+		Resolver:  resolver,
+		Backends:  []Backend{{Addr: "backend.test:80", Path: "/", Resolve: true}},
+		Cache:     Cache{MaxObjectSize: 1},
+	})
+	if err == nil {
+		t.Fatal("expected the cache to be rejected")
+	}
+
+	queries := stub.queries.Load()
+	time.Sleep(1500 * time.Millisecond)
+	if q := stub.queries.Load(); q != queries {
+		t.Fatalf("expected lookups to stop but got %v more", q-queries)
+	}
+}
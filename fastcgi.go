@@ -0,0 +1,476 @@
+package butler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FastCGI record types and roles, see
+// https://fastcgi-archives.github.io/FastCGI_Specification.html
+const (
+	fcgiVersion      = 1
+	fcgiBeginRequest = 1
+	fcgiAbortRequest = 2
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+	fcgiResponder    = 1
+	fcgiKeepConn     = 1
+
+	fcgiHeaderLength = 8
+	fcgiMaxContent   = 65535
+	// fcgiMaxRequests is the number of request ids, as 0 is reserved
+	fcgiMaxRequests         = 65535
+	defaultFCGITimeout      = 60 * time.Second
+	defaultFCGIRequests     = 64
+	defaultFCGIResponseSize = 16 << 20
+)
+
+var errFCGIConnClosed = errors.New("fastcgi connection closed")
+var errFCGIRequestBody = errors.New("failed reading request body")
+var errFCGIResponseTooLarge = errors.New("fastcgi response too large")
+
+// FastCGI forwards requests under Path to a FastCGI application such as PHP-FPM.
+// Addr is host:port, or unix:/path/to/socket. Root is the document root as
+// seen by the application, used to build SCRIPT_FILENAME. If SplitPath is set,
+// e.g. ".php", the request path is split after it into SCRIPT_NAME and
+// PATH_INFO. With Multiplex, concurrent requests share connections, up to
+// MaxRequests per connection. Responses are held in memory, so those larger
+// than MaxResponseSize, 16MiB by default, are sent 502.
+type FastCGI struct {
+	Path            string        `yaml:"Path"`
+	Addr            string        `yaml:"Addr"`
+	Root            string        `yaml:"Root"`
+	Index           string        `yaml:"Index"`
+	SplitPath       string        `yaml:"SplitPath"`
+	Multiplex       bool          `yaml:"Multiplex"`
+	MaxRequests     int           `yaml:"MaxRequests"`
+	MaxResponseSize int64         `yaml:"MaxResponseSize"`
+	Timeout         time.Duration `yaml:"Timeout"`
+}
+
+type fastCGIHandler struct {
+	fcgi   FastCGI
+	client *fcgiClient
+	site   *site
+}
+
+func newFastCGIHandler(f FastCGI, st *site) (fastCGIHandler, error) {
+	if f.Addr == "" {
+		return fastCGIHandler{}, errors.New("FastCGI Addr must be set")
+	}
+
+	if f.Path == "" {
+		f.Path = "/"
+	}
+
+	if f.Index == "" {
+		f.Index = "index.php"
+	}
+
+	if f.Timeout <= 0 {
+		f.Timeout = defaultFCGITimeout
+	}
+
+	if f.MaxResponseSize <= 0 {
+		f.MaxResponseSize = defaultFCGIResponseSize
+	}
+
+	if f.MaxRequests > fcgiMaxRequests {
+		return fastCGIHandler{}, fmt.Errorf("FastCGI MaxRequests must be at most %d", fcgiMaxRequests)
+	}
+
+	maxRequests := 1
+	if f.Multiplex {
+		maxRequests = f.MaxRequests
+		if maxRequests <= 0 {
+			maxRequests = defaultFCGIRequests
+		}
+	}
+
+	network, address := splitAddr(f.Addr)
+	client := &fcgiClient{network: network, address: address, maxRequests: maxRequests, maxResponseSize: f.MaxResponseSize}
+	return fastCGIHandler{f, client, st}, nil
+}
+
+func (h fastCGIHandler) Handle(c *Context) (bool, error) {
+	urlPath, query, _ := strings.Cut(c.Request.Path, "?")
+	if !hasPathPrefix(urlPath, h.fcgi.Path) {
+		return false, nil
+	}
+
+	scriptName, pathInfo := h.splitPath(path.Clean(urlPath))
+	if strings.HasSuffix(urlPath, "/") && pathInfo == "" {
+		scriptName = path.Join(scriptName, h.fcgi.Index)
+	}
+
+	env := cgiEnv(c, scriptName, pathInfo, query, h.fcgi.Root)
+	env = append(env,
+		"SCRIPT_FILENAME="+path.Join(h.fcgi.Root, scriptName),
+		"DOCUMENT_ROOT="+h.fcgi.Root)
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.fcgi.Timeout)
+	defer cancel()
+
+	stdout, done, err := h.client.do(ctx, env, c.Request.BodyReader())
+	if !done {
+		c.closeConn = true
+	}
+
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			slog.Error(fmt.Sprintf("fastcgi %s timed out after %v", h.fcgi.Addr, h.fcgi.Timeout))
+			c.Response = GatewayTimeout()
+		} else {
+			slog.Error(fmt.Sprintf("fastcgi %s failed: %s", h.fcgi.Addr, err))
+			c.Response = BadGateway()
+		}
+		return true, nil
+	}
+
+	r, location, err := parseCGIResponse(bufio.NewReader(bytes.NewReader(stdout)))
+	if err != nil {
+		slog.Error(fmt.Sprintf("fastcgi %s: %s", h.fcgi.Addr, err))
+		c.Response = BadGateway()
+		return true, nil
+	}
+
+	if location != "" {
+		return true, localRedirect(c, h.site, location)
+	}
+
+	c.Response = r
+	return true, nil
+}
+
+// splitPath splits p after the first segment ending in SplitPath, so that
+// /index.php/a/b is SCRIPT_NAME /index.php and PATH_INFO /a/b.
+func (h fastCGIHandler) splitPath(p string) (string, string) {
+	if h.fcgi.SplitPath == "" {
+		return p, ""
+	}
+
+	offset := 0
+	for {
+		i := strings.Index(p[offset:], h.fcgi.SplitPath)
+		if i < 0 {
+			return p, ""
+		}
+
+		end := offset + i + len(h.fcgi.SplitPath)
+		if end == len(p) || p[end] == '/' {
+			return p[:end], p[end:]
+		}
+		offset = end
+	}
+}
+
+// splitAddr splits an address of the form unix:/path into its network and
+// address, defaulting to tcp.
+func splitAddr(addr string) (string, string) {
+	if strings.HasPrefix(addr, "unix:") {
+		return "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	return "tcp", addr
+}
+
+// fcgiClient keeps connections to a FastCGI application open between requests.
+// Each connection carries up to maxRequests requests at a time.
+type fcgiClient struct {
+	network         string
+	address         string
+	maxRequests     int
+	maxResponseSize int64
+
+	mu    sync.Mutex
+	conns []*fcgiConn
+}
+
+type fcgiConn struct {
+	client *fcgiClient
+	conn   net.Conn
+	// wmu serialises records from concurrent requests
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint16]*fcgiStream
+	nextID  uint16
+	closed  bool
+}
+
+type fcgiStream struct {
+	id     uint16
+	stdout bytes.Buffer
+	stderr limitedBuffer
+	done   chan error
+}
+
+// do runs a request and returns its stdout. If done is false, the request body
+// may still be being read and the caller must close the client connection.
+func (cl *fcgiClient) do(ctx context.Context, env []string, stdin io.Reader) ([]byte, bool, error) {
+	fc, s, err := cl.acquire(ctx)
+	if err != nil {
+		return nil, true, err
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		written <- fc.writeRequest(s, env, stdin)
+	}()
+
+	release := func() {
+		err := <-written
+		if err != nil && !errors.Is(err, errFCGIRequestBody) {
+			fc.close(err)
+		}
+		// The id can only be reused once all of its records are written
+		fc.release(s)
+	}
+
+	select {
+	case err = <-s.done:
+		if errors.Is(err, errFCGIResponseTooLarge) {
+			go fc.writeRecord(fcgiAbortRequest, s.id, nil)
+		}
+		release()
+	case <-ctx.Done():
+		go fc.writeRecord(fcgiAbortRequest, s.id, nil)
+		go release()
+		return nil, false, ctx.Err()
+	}
+
+	if err != nil {
+		return nil, true, err
+	}
+	return s.stdout.Bytes(), true, nil
+}
+
+// acquire returns a connection with a free request slot, dialling a new one if
+// all are busy.
+func (cl *fcgiClient) acquire(ctx context.Context) (*fcgiConn, *fcgiStream, error) {
+	cl.mu.Lock()
+	for _, fc := range cl.conns {
+		if s := fc.newStream(); s != nil {
+			cl.mu.Unlock()
+			return fc, s, nil
+		}
+	}
+	cl.mu.Unlock()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, cl.network, cl.address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fc := &fcgiConn{client: cl, conn: conn, streams: make(map[uint16]*fcgiStream)}
+	s := fc.newStream()
+	go fc.readLoop()
+
+	cl.mu.Lock()
+	cl.conns = append(cl.conns, fc)
+	cl.mu.Unlock()
+
+	return fc, s, nil
+}
+
+func (cl *fcgiClient) remove(fc *fcgiConn) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	for i, v := range cl.conns {
+		if v == fc {
+			cl.conns = append(cl.conns[:i], cl.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+func (fc *fcgiConn) newStream() *fcgiStream {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if fc.closed || len(fc.streams) >= fc.client.maxRequests {
+		return nil
+	}
+
+	// Request id 0 is reserved for management records
+	for {
+		fc.nextID++
+		if _, ok := fc.streams[fc.nextID]; fc.nextID != 0 && !ok {
+			break
+		}
+	}
+
+	s := &fcgiStream{id: fc.nextID, stderr: limitedBuffer{max: maxCGIStderr}, done: make(chan error, 1)}
+	fc.streams[s.id] = s
+	return s
+}
+
+func (s *fcgiStream) finish(err error) {
+	select {
+	case s.done <- err:
+	default:
+	}
+}
+
+func (fc *fcgiConn) release(s *fcgiStream) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	delete(fc.streams, s.id)
+}
+
+func (fc *fcgiConn) close(err error) {
+	fc.mu.Lock()
+	if fc.closed {
+		fc.mu.Unlock()
+		return
+	}
+	fc.closed = true
+	streams := slices.Collect(maps.Values(fc.streams))
+	fc.mu.Unlock()
+
+	fc.client.remove(fc)
+	fc.conn.Close()
+
+	for _, s := range streams {
+		s.finish(err)
+	}
+}
+
+func (fc *fcgiConn) writeRequest(s *fcgiStream, env []string, stdin io.Reader) error {
+	begin := []byte{0, fcgiResponder, fcgiKeepConn, 0, 0, 0, 0, 0}
+	err := fc.writeRecord(fcgiBeginRequest, s.id, begin)
+	if err != nil {
+		return err
+	}
+
+	var params []byte
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		params = appendFCGIParam(params, k, v)
+	}
+
+	err = fc.writeStream(fcgiParams, s.id, bytes.NewReader(params))
+	if err != nil {
+		return err
+	}
+
+	err = fc.writeStream(fcgiStdin, s.id, stdin)
+	if errors.Is(err, errFCGIRequestBody) {
+		s.finish(err)
+		if werr := fc.writeRecord(fcgiAbortRequest, s.id, nil); werr != nil {
+			return werr
+		}
+	}
+	return err
+}
+
+// writeStream writes r as a sequence of records, terminated by an empty record.
+func (fc *fcgiConn) writeStream(recType uint8, id uint16, r io.Reader) error {
+	buf := make([]byte, fcgiMaxContent)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if werr := fc.writeRecord(recType, id, buf[:n]); werr != nil {
+				return werr
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", errFCGIRequestBody, err)
+		}
+	}
+
+	return fc.writeRecord(recType, id, nil)
+}
+
+func (fc *fcgiConn) writeRecord(recType uint8, id uint16, content []byte) error {
+	padding := -len(content) & 7
+	header := [fcgiHeaderLength]byte{fcgiVersion, recType}
+	binary.BigEndian.PutUint16(header[2:], id)
+	binary.BigEndian.PutUint16(header[4:], uint16(len(content)))
+	header[6] = byte(padding)
+
+	fc.wmu.Lock()
+	defer fc.wmu.Unlock()
+
+	_, err := fc.conn.Write(append(append(header[:], content...), make([]byte, padding)...))
+	return err
+}
+
+// readLoop demultiplexes records from the application to their streams.
+func (fc *fcgiConn) readLoop() {
+	reader := bufio.NewReader(fc.conn)
+	header := make([]byte, fcgiHeaderLength)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err != nil {
+			fc.close(errFCGIConnClosed)
+			return
+		}
+
+		recType := header[1]
+		id := binary.BigEndian.Uint16(header[2:])
+		content := make([]byte, int(binary.BigEndian.Uint16(header[4:]))+int(header[6]))
+		_, err = io.ReadFull(reader, content)
+		if err != nil {
+			fc.close(errFCGIConnClosed)
+			return
+		}
+		content = content[:binary.BigEndian.Uint16(header[4:])]
+
+		fc.mu.Lock()
+		s, ok := fc.streams[id]
+		fc.mu.Unlock()
+		if !ok {
+			// Records for aborted requests are dropped
+			continue
+		}
+
+		switch recType {
+		case fcgiStdout:
+			if int64(s.stdout.Len()+len(content)) > fc.client.maxResponseSize {
+				s.finish(errFCGIResponseTooLarge)
+				continue
+			}
+			s.stdout.Write(content)
+		case fcgiStderr:
+			s.stderr.Write(content)
+		case fcgiEndRequest:
+			if s.stderr.Len() > 0 {
+				slog.Debug(fmt.Sprintf("fastcgi %s: %s", fc.client.address, &s.stderr))
+			}
+			s.finish(nil)
+		}
+	}
+}
+
+func appendFCGIParam(b []byte, k string, v string) []byte {
+	for _, n := range []int{len(k), len(v)} {
+		if n < 128 {
+			b = append(b, byte(n))
+		} else {
+			b = binary.BigEndian.AppendUint32(b, uint32(n)|1<<31)
+		}
+	}
+	return append(append(b, k...), v...)
+}
@@ -0,0 +1,246 @@
+package butler
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingListener counts the connections accepted by a FastCGI application
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+func startFastCGI(t *testing.T, network string, address string, h http.Handler) *countingListener {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl := &countingListener{Listener: l}
+	go fcgi.Serve(cl, h)
+	t.Cleanup(func() { l.Close() })
+	return cl
+}
+
+func startFastCGIProxy(t *testing.T, f FastCGI) *Server {
+	s, err := NewServer(&Config{
+		Host:      "localhost",
+		Listen:    0,
+		ListenTLS: -1,
+		FastCGI:   []FastCGI{f},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go s.Listen()
+	t.Cleanup(func() { s.Close() })
+	<-s.httpListener.readyCh
+	return s
+}
+
+func TestFastCGI(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env := fcgi.ProcessEnv(r)
+		if r.URL.Path == "/app/slow.php" {
+			time.Sleep(time.Second)
+		}
+
+		b, _ := io.ReadAll(r.Body)
+		w.Header().Set(HeaderContentType, "text/plain")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "%s %s %s %s %s", r.Method, env["SCRIPT_FILENAME"], env["PATH_TRANSLATED"], r.URL.RawQuery, b)
+	})
+
+	cases := []struct {
+		n string
+		a func(t *testing.T) string
+	}{
+		{
+			n: "TCP",
+			a: func(t *testing.T) string {
+				return startFastCGI(t, "tcp", "localhost:0", h).Addr().String()
+			},
+		},
+		{
+			n: "Unix",
+			a: func(t *testing.T) string {
+				return "unix:" + startFastCGI(t, "unix", filepath.Join(t.TempDir(), "fcgi.sock"), h).Addr().String()
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			s := startFastCGIProxy(t, FastCGI{
+				Path:      "/app",
+				Addr:      c.a(t),
+				Root:      "/srv/www",
+				SplitPath: ".php",
+				Timeout:   200 * time.Millisecond,
+			})
+			addr := "http://" + s.httpListener.listener.Addr().String()
+
+			resp, err := http.Post(addr+"/app/index.php/a/b?x=1", "text/plain", strings.NewReader("body"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			expected := "POST /srv/www/app/index.php /srv/www/a/b x=1 body"
+			if resp.StatusCode != http.StatusAccepted || string(b) != expected {
+				t.Fatalf("expected 202 %q but got %v %q", expected, resp.StatusCode, b)
+			}
+
+			resp, err = http.Get(addr + "/app/")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, _ = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(b) != "GET /srv/www/app/index.php   " {
+				t.Fatalf("expected index.php but got %q", b)
+			}
+
+			resp, err = http.Get(addr + "/app/slow.php")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusGatewayTimeout {
+				t.Fatalf("expected 504 but got %v", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestFastCGIConnectionReuse(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	const concurrent = 5
+	var wg sync.WaitGroup
+	wg.Add(concurrent)
+
+	l := startFastCGI(t, "tcp", "localhost:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/barrier" {
+			// Only returns once every request is in flight at the same time
+			wg.Done()
+			wg.Wait()
+		}
+		w.Header().Set(HeaderContentType, "text/plain")
+	}))
+
+	s := startFastCGIProxy(t, FastCGI{Addr: l.Addr().String(), Multiplex: true})
+	addr := "http://" + s.httpListener.listener.Addr().String()
+
+	for range 3 {
+		resp, err := http.Get(addr + "/sequential")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	if n := l.accepted.Load(); n != 1 {
+		t.Fatalf("expected sequential requests to reuse 1 connection but got %v", n)
+	}
+
+	var requests sync.WaitGroup
+	for range concurrent {
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			resp, err := http.Get(addr + "/barrier")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	requests.Wait()
+
+	if n := l.accepted.Load(); n != 1 {
+		t.Fatalf("expected concurrent requests to be multiplexed on 1 connection but got %v", n)
+	}
+}
+
+func TestFastCGIMaxResponseSize(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	l := startFastCGI(t, "tcp", "localhost:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderContentType, "text/plain")
+		if r.URL.Path == "/large" {
+			w.Write([]byte(strings.Repeat("a", 1000)))
+			return
+		}
+		w.Write([]byte("small"))
+	}))
+
+	s := startFastCGIProxy(t, FastCGI{Addr: l.Addr().String(), Multiplex: true, MaxResponseSize: 100})
+	addr := "http://" + s.httpListener.listener.Addr().String()
+
+	cases := []struct {
+		p string
+		s int
+		r string
+	}{
+		{p: "/large", s: http.StatusBadGateway},
+		{p: "/small", s: http.StatusOK, r: "small"},
+	}
+
+	for _, c := range cases {
+		resp, err := http.Get(addr + c.p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != c.s || c.r != "" && string(b) != c.r {
+			t.Fatalf("%s: expected %v %q but got %v %q", c.p, c.s, c.r, resp.StatusCode, b)
+		}
+	}
+}
+
+func TestFastCGIInvalid(t *testing.T) {
+	cases := []struct {
+		n string
+		f FastCGI
+	}{
+		{"NoAddr", FastCGI{Path: "/"}},
+		{"TooManyRequests", FastCGI{Addr: "localhost:9000", Multiplex: true, MaxRequests: 65536}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			_, err := NewServer(&Config{Listen: 0, ListenTLS: -1, FastCGI: []FastCGI{c.f}})
+			if err == nil {
+				t.Fatal("expected the config to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package butler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const (
+	ForwardingXForwarded = "x-forwarded"
+	ForwardingForwarded  = "forwarded"
+	ForwardingBoth       = "both"
+	ForwardingNone       = "none"
+)
+
+const (
+	HeaderForwarded       = "Forwarded"
+	HeaderXForwardedFor   = "X-Forwarded-For"
+	HeaderXForwardedHost  = "X-Forwarded-Host"
+	HeaderXForwardedProto = "X-Forwarded-Proto"
+)
+
+// hopByHopHeaders apply to a single connection, so are never proxied, see
+// RFC 9110 section 7.6.1.
+var hopByHopHeaders = []string{
+	HeaderConnection,
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	HeaderTransferEncoding,
+	HeaderUpgrade,
+}
+
+// Forwarding configures the headers telling backends about the client.
+// Policy is one of x-forwarded (the default), forwarded (RFC 7239), both or
+// none. Forwarding headers sent by clients in TrustedProxies, which are IPs or
+// CIDRs, are appended to; those sent by anyone else are overwritten.
+type Forwarding struct {
+	Policy         string   `yaml:"Policy"`
+	TrustedProxies []string `yaml:"TrustedProxies"`
+}
+
+type forwarding struct {
+	xForwarded bool
+	forwarded  bool
+	trusted    []netip.Prefix
+}
+
+func newForwarding(f Forwarding) (*forwarding, error) {
+	fwd := &forwarding{}
+	switch f.Policy {
+	case "", ForwardingXForwarded:
+		fwd.xForwarded = true
+	case ForwardingForwarded:
+		fwd.forwarded = true
+	case ForwardingBoth:
+		fwd.xForwarded, fwd.forwarded = true, true
+	case ForwardingNone:
+	default:
+		return nil, fmt.Errorf("unknown forwarding policy %s", f.Policy)
+	}
+
+	for _, v := range f.TrustedProxies {
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(v)
+			if aerr != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %s", v)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		fwd.trusted = append(fwd.trusted, prefix.Masked())
+	}
+
+	return fwd, nil
+}
+
+func (f *forwarding) isTrusted(addr netip.Addr) bool {
+	for _, p := range f.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sets the forwarding headers of r, which is being proxied for c.
+func (f *forwarding) apply(r *http.Request, c *Context) {
+	var client netip.Addr
+	if c.Conn != nil {
+		if ap, err := netip.ParseAddrPort(c.Conn.RemoteAddr().String()); err == nil {
+			client = ap.Addr().Unmap()
+		}
+	}
+
+	if !client.IsValid() || !f.isTrusted(client) {
+		for _, h := range []string{HeaderForwarded, HeaderXForwardedFor, HeaderXForwardedHost, HeaderXForwardedProto} {
+			r.Header.Del(h)
+		}
+	}
+
+	if !client.IsValid() {
+		return
+	}
+
+	if f.xForwarded {
+		appendHeader(r.Header, HeaderXForwardedFor, client.String())
+		if r.Header.Get(HeaderXForwardedProto) == "" {
+			r.Header.Set(HeaderXForwardedProto, c.Request.Scheme)
+		}
+		if r.Header.Get(HeaderXForwardedHost) == "" && c.Request.Host != "" {
+			r.Header.Set(HeaderXForwardedHost, c.Request.Host)
+		}
+	}
+
+	if f.forwarded {
+		node := client.String()
+		if client.Is6() {
+			node = `"[` + node + `]"`
+		}
+
+		element := "for=" + node + ";proto=" + c.Request.Scheme
+		if c.Request.Host != "" {
+			element += `;host="` + strings.ReplaceAll(c.Request.Host, `"`, "") + `"`
+		}
+		appendHeader(r.Header, HeaderForwarded, element)
+	}
+}
+
+// appendHeader adds v to the comma separated list in the header named k.
+func appendHeader(h http.Header, k string, v string) {
+	if prior := h.Values(k); len(prior) > 0 {
+		v = strings.Join(prior, ", ") + ", " + v
+	}
+	h.Set(k, v)
+}
+
+// removeHopByHopHeaders removes hop-by-hop headers from h, including any
+// listed in Connection.
+func removeHopByHopHeaders(h http.Header) {
+	for _, v := range h.Values(HeaderConnection) {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// clientIP returns the IP of the client of c, or "" if it is not known.
+func clientIP(c *Context) string {
+	if c.Conn == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(c.Conn.RemoteAddr().String())
+	if err != nil {
+		return c.Conn.RemoteAddr().String()
+	}
+	return host
+}
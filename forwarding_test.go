@@ -0,0 +1,137 @@
+package butler
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestForwardingHeaders(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Connection", "X-Internal")
+		w.Header().Set("X-Internal", "secret")
+		json.NewEncoder(w).Encode(r.Header)
+	}))
+	defer upstream.Close()
+
+	cases := []struct {
+		n          string
+		forwarding Forwarding
+		sent       map[string]string
+		expected   map[string]string
+	}{
+		{
+			"Default",
+			Forwarding{},
+			nil,
+			map[string]string{"X-Forwarded-For": "127.0.0.1", "X-Forwarded-Proto": "http", "X-Forwarded-Host": "example.com", "Forwarded": ""},
+		},
+		{
+			"Overwritten",
+			Forwarding{},
+			map[string]string{"X-Forwarded-For": "1.2.3.4", "X-Forwarded-Proto": "https", "Forwarded": "for=1.2.3.4"},
+			map[string]string{"X-Forwarded-For": "127.0.0.1", "X-Forwarded-Proto": "http", "Forwarded": ""},
+		},
+		{
+			"Trusted",
+			Forwarding{TrustedProxies: []string{"127.0.0.0/8"}},
+			map[string]string{"X-Forwarded-For": "1.2.3.4", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "example.org"},
+			map[string]string{"X-Forwarded-For": "1.2.3.4, 127.0.0.1", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "example.org"},
+		},
+		{
+			"UntrustedProxy",
+			Forwarding{TrustedProxies: []string{"10.0.0.1"}},
+			map[string]string{"X-Forwarded-For": "1.2.3.4"},
+			map[string]string{"X-Forwarded-For": "127.0.0.1"},
+		},
+		{
+			"Forwarded",
+			Forwarding{Policy: ForwardingForwarded},
+			nil,
+			map[string]string{"Forwarded": `for=127.0.0.1;proto=http;host="example.com"`, "X-Forwarded-For": ""},
+		},
+		{
+			"ForwardedTrusted",
+			Forwarding{Policy: ForwardingBoth, TrustedProxies: []string{"127.0.0.1"}},
+			map[string]string{"Forwarded": "for=1.2.3.4"},
+			map[string]string{"Forwarded": `for=1.2.3.4, for=127.0.0.1;proto=http;host="example.com"`, "X-Forwarded-For": "127.0.0.1"},
+		},
+		{
+			"None",
+			Forwarding{Policy: ForwardingNone},
+			map[string]string{"X-Forwarded-For": "1.2.3.4"},
+			map[string]string{"X-Forwarded-For": "", "Forwarded": ""},
+		},
+		{
+			"HopByHop",
+			Forwarding{},
+			map[string]string{"Connection": "X-Secret", "X-Secret": "a", "Keep-Alive": "timeout=5", "TE": "trailers", "Upgrade": "websocket", "X-Kept": "b"},
+			map[string]string{"Connection": "", "X-Secret": "", "Keep-Alive": "", "Te": "", "Upgrade": "", "X-Kept": "b"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			_, proxy := startServer(t, &Config{
+				Host:       "127.0.0.1",
+				Listen:     0,
+				ListenTLS:  -1,
+				Backends:   []Backend{{Addr: upstream.Listener.Addr().String(), Path: "/"}},
+				Forwarding: c.forwarding,
+			})
+
+			req, _ := http.NewRequest("GET", proxy+"/", nil)
+			req.Host = "example.com"
+			for k, v := range c.sent {
+				req.Header.Set(k, v)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			var received http.Header
+			if err := json.NewDecoder(resp.Body).Decode(&received); err != nil {
+				t.Fatal(err)
+			}
+
+			for k, v := range c.expected {
+				if got := strings.Join(received.Values(k), ", "); got != v {
+					t.Fatalf("expected %s %q but got %q", k, v, got)
+				}
+			}
+
+			if resp.Header.Get("Keep-Alive") != "" || resp.Header.Get("X-Internal") != "" {
+				t.Fatalf("expected hop-by-hop response headers to be removed but got %v", resp.Header)
+			}
+		})
+	}
+}
+
+func TestForwardingInvalid(t *testing.T) {
+	cases := []struct {
+		n          string
+		forwarding Forwarding
+	}{
+		{"Policy", Forwarding{Policy: "x-real-ip"}},
+		{"TrustedProxy", Forwarding{TrustedProxies: []string{"localhost"}}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			_, err := NewServer(&Config{Listen: 0, ListenTLS: -1, Forwarding: c.forwarding})
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
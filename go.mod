@@ -3,7 +3,8 @@ module github.com/kenkam/butler
 go 1.24
 
 require (
-	github.com/alecthomas/kong v1.10.0 // indirect
-	golang.org/x/sync v0.13.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	github.com/alecthomas/kong v1.10.0
+	golang.org/x/crypto v0.37.0
+	golang.org/x/sync v0.13.0
+	gopkg.in/yaml.v3 v3.0.1
 )
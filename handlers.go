@@ -1,14 +1,20 @@
 package butler
 
 import (
-	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // If return value is true, should skip all other handlers
@@ -32,48 +38,286 @@ func (r redirectHTTPHandler) Handle(c *Context) (bool, error) {
 	return false, nil
 }
 
+type redirectHandler struct {
+	redirects []Redirect
+}
+
+func (r redirectHandler) Handle(c *Context) (bool, error) {
+	for _, rd := range r.redirects {
+		if c.Request.Path != rd.Path {
+			continue
+		}
+
+		c.Response = rd.response()
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (rd Redirect) response() *Response {
+	if rd.Permanent {
+		return MovedPermanently(rd.Location)
+	}
+	return Found(rd.Location)
+}
+
+// backendHandler proxies requests to the members of the pool with the most
+// specific route.
 type backendHandler struct {
-	b Backend
+	routes     *router
+	forwarding *forwarding
 }
 
 func (b backendHandler) Handle(c *Context) (bool, error) {
-	if strings.HasPrefix(c.Request.Path, b.b.Path) {
+	if p := b.routes.lookup(c.Request.Path); p != nil {
+		return poolHandler{p, b.forwarding}.Handle(c)
+	}
 
-		url := "http://" + b.b.Addr + c.Request.Path
-		r, err := http.NewRequest(c.Request.Method, url, bytes.NewReader(c.Request.Body))
-		if err != nil {
-			return false, err
+	return false, nil
+}
+
+// poolHandler proxies every request to a member of its pool.
+type poolHandler struct {
+	pool       *pool
+	forwarding *forwarding
+}
+
+func (h poolHandler) Handle(c *Context) (bool, error) {
+	retries := 0
+	if isRetryable(c.Request) {
+		retries = h.pool.config.Retries
+	}
+	h.pool.budget.deposit()
+
+	if h.pool.mirror != nil {
+		h.pool.mirror.copy(c, h.forwarding)
+	}
+
+	var tried []*upstream
+	for {
+		u, full := h.pool.acquire(c, tried)
+		if full {
+			c.Response = ServiceUnavailable()
+			c.Response.Headers[HeaderRetryAfter] = []string{h.pool.queue.retryAfter()}
+			return true, nil
 		}
 
-		for k, vs := range c.Request.Headers {
-			for _, v := range vs {
-				r.Header.Add(k, v)
+		if u == nil {
+			if len(tried) > 0 {
+				// Keep the response of the last attempt
+				return true, nil
 			}
-		}
 
-		resp, err := http.DefaultClient.Do(r)
-		if err != nil {
-			c.Response = BadGateway()
+			if h.pool.size() == 0 {
+				c.Response = BadGateway()
+			} else {
+				c.Response = ServiceUnavailable()
+			}
 			return true, nil
 		}
-		defer resp.Body.Close()
+		tried = append(tried, u)
 
-		b, err := io.ReadAll(resp.Body)
+		failed, err := h.proxy(c, u)
 		if err != nil {
 			return false, err
 		}
 
-		c.Response = StatusCode(resp.StatusCode, b)
-		for k, vs := range resp.Header {
-			c.Response.Headers[k] = vs
+		if !failed {
+			h.pool.pin(c, u)
+			return true, nil
+		}
+
+		if len(tried) > retries || !h.pool.budget.withdraw() {
+			return true, nil
+		}
+		slog.Debug(fmt.Sprintf("retrying %s after %s failed", c.Request, u.b.Addr))
+	}
+}
+
+// proxy sends the request to u, returning true if it could not get a response
+// from u so the request may be retried elsewhere.
+func (h poolHandler) proxy(c *Context, u *upstream) (bool, error) {
+	ctx := withClientAddr(context.Background(), c)
+	stopTimeout := context.CancelFunc(func() {})
+	if u.b.Timeout > 0 {
+		ctx, stopTimeout = context.WithTimeout(ctx, u.b.Timeout)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+
+	// Only applies until the response headers have been read
+	var headerTimedOut atomic.Bool
+	headerTimer := time.AfterFunc(u.responseHeaderTimeout(), func() {
+		headerTimedOut.Store(true)
+		cancel()
+	})
+
+	done := func() {
+		headerTimer.Stop()
+		cancel()
+		stopTimeout()
+		h.pool.release(u)
+	}
+
+	body := newTrackedBody(c.Request)
+
+	url := backendURL(u.b, u.rewriter.request(c.Request.Path))
+	r, err := http.NewRequestWithContext(ctx, c.Request.Method, url, body)
+	if err != nil {
+		done()
+		u.breaker.release()
+		return false, err
+	}
+	r.ContentLength = c.Request.ContentLength
+	r.Host = u.host()
+
+	for k, vs := range c.Request.Headers {
+		for _, v := range vs {
+			r.Header.Add(k, v)
 		}
+	}
+	removeHopByHopHeaders(r.Header)
+	h.forwarding.apply(r, c)
+
+	var resp *http.Response
+	var t *tunnel
+	if isUpgrade(c.Request) && u.isHTTP() {
+		r.Header.Set(HeaderConnection, "Upgrade")
+		r.Header.Set(HeaderUpgrade, c.Request.Header(HeaderUpgrade))
+		resp, t, err = dialUpgrade(ctx, u, r)
+	} else {
+		resp, err = u.transport.RoundTrip(r)
+	}
+	if err == nil && !headerTimer.Stop() {
+		// The timer fired just as the headers arrived
+		resp.Body.Close()
+		err = context.Canceled
+	}
+	if errors.Is(err, errRequestBodyTooLarge) {
+		waitForBody(body)
+		done()
+		// Nothing was sent, so this says nothing about the health of u
+		u.breaker.release()
+		c.Response = RequestEntityTooLarge()
+		return false, nil
+	}
+	if err != nil {
+		waitForBody(body)
+		timedOut := headerTimedOut.Load() || errors.Is(ctx.Err(), context.DeadlineExceeded) || isTimeout(err)
+		done()
 
+		slog.Debug(fmt.Sprintf("proxying %s to %s failed: %s", c.Request, u.b.Addr, err))
+		u.breaker.failure()
+		if timedOut {
+			c.Response = GatewayTimeout()
+		} else {
+			c.Response = BadGateway()
+		}
 		return true, nil
 	}
 
+	if resp.StatusCode >= http.StatusInternalServerError {
+		u.breaker.failure()
+	} else {
+		u.breaker.success()
+	}
+
+	upgrade := resp.Header.Get(HeaderUpgrade)
+	removeHopByHopHeaders(resp.Header)
+
+	if t != nil {
+		waitForBody(body)
+		t.done = done
+		c.tunnel = t
+		c.Response = StatusCode(http.StatusSwitchingProtocols, nil)
+		c.Response.Headers[HeaderConnection] = []string{"Upgrade"}
+		c.Response.Headers[HeaderUpgrade] = []string{upgrade}
+	} else {
+		c.Response = Stream(resp.StatusCode, &proxyBody{ReadCloser: resp.Body, request: body, done: done}, resp.ContentLength)
+	}
+
+	for k, vs := range resp.Header {
+		c.Response.Headers[k] = vs
+	}
+
+	if !u.rewriter.isZero() {
+		rewriteResponseHeaders(c, u)
+	}
+
 	return false, nil
 }
 
+// isRetryable reports whether a request can safely be sent again, which
+// requires an idempotent method and no body, as the body is streamed.
+func isRetryable(r *Request) bool {
+	switch r.Method {
+	case RequestGet, RequestHead, RequestOptions, RequestPut, RequestDelete, "TRACE":
+		return r.ContentLength == 0
+	}
+	return false
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// rewriteResponseHeaders maps the paths the backend sees back to the paths the
+// client uses, so that redirects and cookies keep working.
+func rewriteResponseHeaders(c *Context, u *upstream) {
+	for i, v := range c.Response.Headers[HeaderLocation] {
+		c.Response.Headers[HeaderLocation][i] = u.rewriter.location(v, u.host(), c.Request.Scheme, c.Request.Host)
+	}
+
+	for i, v := range c.Response.Headers[HeaderSetCookie] {
+		c.Response.Headers[HeaderSetCookie][i] = u.rewriter.setCookie(v)
+	}
+}
+
+// trackedBody is a request body that can be waited on until the transport has
+// closed it, as transports may still be reading after RoundTrip returns.
+type trackedBody struct {
+	io.Reader
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newTrackedBody(r *Request) io.ReadCloser {
+	body := r.BodyReader()
+	if body == http.NoBody {
+		return http.NoBody
+	}
+
+	return &trackedBody{Reader: body, closed: make(chan struct{})}
+}
+
+func (b *trackedBody) Close() error {
+	b.once.Do(func() { close(b.closed) })
+	return nil
+}
+
+func waitForBody(body io.ReadCloser) {
+	if b, ok := body.(*trackedBody); ok {
+		<-b.closed
+	}
+}
+
+// proxyBody is an upstream response body. Once it is closed, the request body
+// is no longer in use and the connection can move on to the next request.
+type proxyBody struct {
+	io.ReadCloser
+	request io.ReadCloser
+	done    func()
+	once    sync.Once
+}
+
+func (b *proxyBody) Close() error {
+	err := b.ReadCloser.Close()
+	waitForBody(b.request)
+	b.once.Do(b.done)
+	return err
+}
+
 type documentRootHandler struct {
 	docRoot string
 }
@@ -83,7 +327,8 @@ func (s documentRootHandler) Handle(c *Context) (bool, error) {
 		c.Request.Path = "/index.html"
 	}
 
-	path := path.Join(s.docRoot, c.Request.Path)
+	// Clean before joining, so that .. cannot climb out of the document root
+	path := path.Join(s.docRoot, path.Clean("/"+c.Request.Path))
 	data, err := os.ReadFile(path)
 	if err != nil {
 		_, isPathError := err.(*os.PathError)
@@ -0,0 +1,160 @@
+package butler
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func startProxy(t *testing.T, backends ...Backend) string {
+	_, addr := startServer(t, &Config{
+		Listen:    0,
+		ListenTLS: -1,
+		Backends:  backends,
+	})
+	return addr
+}
+
+// startServer starts a server for config, returning it and its http:// address.
+func startServer(t *testing.T, config *Config) (*Server, string) {
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go s.Listen()
+	t.Cleanup(func() { s.Close() })
+	<-s.httpListener.readyCh
+	return s, "http://" + s.httpListener.listener.Addr().String()
+}
+
+func TestBackendStreamsResponse(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	release := make(chan bool)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("second\n"))
+	}))
+	defer upstream.Close()
+
+	proxy := startProxy(t, Backend{Addr: upstream.Listener.Addr().String(), Path: "/"})
+
+	resp, err := http.Get(proxy + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	first := make(chan string)
+	go func() {
+		line, _ := reader.ReadString('\n')
+		first <- line
+	}()
+
+	select {
+	case line := <-first:
+		if line != "first\n" {
+			t.Fatalf("expected first line but got %q", line)
+		}
+	case <-time.After(2 * time.Second):
+		close(release)
+		t.Fatal("response was buffered instead of streamed")
+	}
+
+	close(release)
+	rest, _ := io.ReadAll(reader)
+	if string(rest) != "second\n" {
+		t.Fatalf("expected second line but got %q", rest)
+	}
+}
+
+func TestBackendStreamsRequest(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	received := make(chan bool)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first := make([]byte, 5)
+		io.ReadFull(r.Body, first)
+		received <- true
+
+		rest, _ := io.ReadAll(r.Body)
+		w.Write(append(first, rest...))
+	}))
+	defer upstream.Close()
+
+	proxy := startProxy(t, Backend{Addr: upstream.Listener.Addr().String(), Path: "/"})
+
+	pr, pw := io.Pipe()
+	done := make(chan string)
+	go func() {
+		resp, err := http.Post(proxy+"/", "text/plain", pr)
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		done <- string(b)
+	}()
+
+	pw.Write([]byte("part1"))
+	select {
+	case <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("request body was buffered instead of streamed")
+	}
+
+	pw.Write([]byte("part2"))
+	pw.Close()
+
+	if got := <-done; got != "part1part2" {
+		t.Fatalf("expected echoed body but got %q", got)
+	}
+}
+
+func TestBackendReusesConnections(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	var conns atomic.Int32
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("a", 1024)))
+	}))
+	upstream.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	proxy := startProxy(t, Backend{Addr: upstream.Listener.Addr().String(), Path: "/", MaxIdleConns: 1})
+
+	for range 5 {
+		resp, err := http.Get(proxy + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Transparently decompressed by the client
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !resp.Uncompressed || len(b) != 1024 {
+			t.Fatalf("expected gzipped 1024 bytes but got %v (uncompressed %v)", len(b), resp.Uncompressed)
+		}
+	}
+
+	if n := conns.Load(); n != 1 {
+		t.Fatalf("expected 1 pooled upstream connection but got %v", n)
+	}
+}
@@ -1,11 +1,29 @@
 package butler
 
 const (
-	HeaderAcceptEncoding  = "Accept-Encoding"
-	HeaderContentLength   = "Content-Length"
-	HeaderContentEncoding = "Content-Encoding"
-	HeaderContentType     = "Content-Type"
-	HeaderConnection      = "Connection"
-	HeaderHost            = "Host"
-	HeaderLocation        = "Location"
+	HeaderAcceptEncoding   = "Accept-Encoding"
+	HeaderAge              = "Age"
+	HeaderAuthorization    = "Authorization"
+	HeaderCacheControl     = "Cache-Control"
+	HeaderCacheStatus      = "Cache-Status"
+	HeaderContentLength    = "Content-Length"
+	HeaderContentEncoding  = "Content-Encoding"
+	HeaderContentLocation  = "Content-Location"
+	HeaderContentType      = "Content-Type"
+	HeaderCookie           = "Cookie"
+	HeaderConnection       = "Connection"
+	HeaderDate             = "Date"
+	HeaderETag             = "Etag"
+	HeaderExpires          = "Expires"
+	HeaderHost             = "Host"
+	HeaderIfModifiedSince  = "If-Modified-Since"
+	HeaderIfNoneMatch      = "If-None-Match"
+	HeaderLastModified     = "Last-Modified"
+	HeaderLocation         = "Location"
+	HeaderRange            = "Range"
+	HeaderRetryAfter       = "Retry-After"
+	HeaderSetCookie        = "Set-Cookie"
+	HeaderTransferEncoding = "Transfer-Encoding"
+	HeaderUpgrade          = "Upgrade"
+	HeaderVary             = "Vary"
 )
@@ -0,0 +1,127 @@
+package butler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultMirrorMaxBodySize = 1 << 20
+	defaultMirrorTimeout     = 10 * time.Second
+	// maxMirrorsInFlight bounds the copies waiting on a slow mirror, beyond
+	// which requests are not copied
+	maxMirrorsInFlight = 64
+)
+
+// Mirror copies Percent of a pool's requests, all of them by default, to a
+// shadow Backend. Copies are sent in the background and their responses are
+// discarded, so the mirror never affects clients. Requests with bodies larger
+// than MaxBodySize, 1MiB by default, are not copied.
+type Mirror struct {
+	Backend     Backend `yaml:"Backend"`
+	Percent     float64 `yaml:"Percent"`
+	MaxBodySize int64   `yaml:"MaxBodySize"`
+}
+
+type mirror struct {
+	upstream    *upstream
+	percent     float64
+	maxBodySize int64
+	inFlight    chan struct{}
+}
+
+func newMirror(m Mirror) (*mirror, error) {
+	if m.Percent < 0 || m.Percent > 100 {
+		return nil, fmt.Errorf("mirror %s: Percent must be between 0 and 100", m.Backend.Addr)
+	}
+
+	if m.Backend.Resolve {
+		return nil, fmt.Errorf("mirror %s: Resolve is only supported by the Backends of a site", m.Backend.Addr)
+	}
+
+	u, err := newUpstream(m.Backend)
+	if err != nil {
+		return nil, fmt.Errorf("mirror %s: %w", m.Backend.Addr, err)
+	}
+
+	percent := m.Percent
+	if percent == 0 {
+		percent = 100
+	}
+
+	maxBodySize := m.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = defaultMirrorMaxBodySize
+	}
+
+	return &mirror{upstream: u, percent: percent, maxBodySize: maxBodySize, inFlight: make(chan struct{}, maxMirrorsInFlight)}, nil
+}
+
+// copy sends a copy of the request of c to the mirror, if it is sampled. The
+// body is buffered first, so that it can be sent to both.
+func (m *mirror) copy(c *Context, fwd *forwarding) {
+	if isUpgrade(c.Request) {
+		return
+	}
+
+	if m.percent < 100 && rand.Float64()*100 >= m.percent {
+		return
+	}
+
+	body, complete, err := c.Request.bufferBody(m.maxBodySize)
+	if err != nil || !complete {
+		slog.Debug(fmt.Sprintf("not mirroring %s as its body could not be buffered", c.Request))
+		return
+	}
+
+	select {
+	case m.inFlight <- struct{}{}:
+	default:
+		slog.Debug(fmt.Sprintf("not mirroring %s as %d copies are in flight", c.Request, maxMirrorsInFlight))
+		return
+	}
+
+	timeout := m.upstream.b.Timeout
+	if timeout <= 0 {
+		timeout = defaultMirrorTimeout
+	}
+	ctx, cancel := context.WithTimeout(withClientAddr(context.Background(), c), timeout)
+
+	url := backendURL(m.upstream.b, m.upstream.rewriter.request(c.Request.Path))
+	r, err := http.NewRequestWithContext(ctx, c.Request.Method, url, bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		<-m.inFlight
+		return
+	}
+
+	// Headers are copied now, as handlers may change them once this returns
+	for k, vs := range c.Request.Headers {
+		for _, v := range vs {
+			r.Header.Add(k, v)
+		}
+	}
+	removeHopByHopHeaders(r.Header)
+	fwd.apply(r, c)
+
+	desc := c.Request.String()
+	go func() {
+		defer func() { <-m.inFlight }()
+		defer cancel()
+
+		resp, err := m.upstream.transport.RoundTrip(r)
+		if err != nil {
+			slog.Debug(fmt.Sprintf("mirroring %s to %s failed: %s", desc, m.upstream.b.Addr, err))
+			return
+		}
+
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
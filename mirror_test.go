@@ -0,0 +1,151 @@
+package butler
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "primary %s", b)
+	}))
+	defer primary.Close()
+
+	mirrored := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mirrored <- fmt.Sprintf("%s %s %s %s", r.Method, r.URL.Path, r.Header.Get("X-Test"), b)
+		w.Write([]byte("shadow"))
+	}))
+	defer shadow.Close()
+
+	_, url := startServer(t, &Config{
+		Listen:    0,
+		ListenTLS: -1,
+		Pools: []Pool{{Path: "/", Mirror: &Mirror{
+			Backend:     Backend{Addr: shadow.Listener.Addr().String()},
+			MaxBodySize: 16,
+		}}},
+		Backends: []Backend{{Addr: primary.Listener.Addr().String(), Path: "/"}},
+	})
+
+	cases := []struct {
+		n        string
+		body     string
+		chunked  bool
+		mirrored string
+	}{
+		{"Body", "payload", false, "POST /submit header payload"},
+		{"ChunkedBody", "payload", true, "POST /submit header payload"},
+		{"TooLarge", strings.Repeat("a", 17), false, ""},
+		{"ChunkedTooLarge", strings.Repeat("a", 17), true, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			var body io.Reader = strings.NewReader(c.body)
+			if c.chunked {
+				body = io.MultiReader(body)
+			}
+
+			req, _ := http.NewRequest("POST", url+"/submit", body)
+			req.Header.Set("X-Test", "header")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if string(got) != "primary "+c.body {
+				t.Fatalf("expected the primary response but got %q", got)
+			}
+
+			if c.mirrored == "" {
+				select {
+				case m := <-mirrored:
+					t.Fatalf("expected no copy but got %q", m)
+				case <-time.After(100 * time.Millisecond):
+				}
+				return
+			}
+
+			select {
+			case m := <-mirrored:
+				if m != c.mirrored {
+					t.Fatalf("expected %q but got %q", c.mirrored, m)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the request to be mirrored")
+			}
+		})
+	}
+}
+
+func TestMirrorFailures(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	}))
+	defer slow.Close()
+
+	cases := []struct {
+		n      string
+		mirror Backend
+	}{
+		{"Down", Backend{Addr: deadAddr(t)}},
+		{"Slow", Backend{Addr: slow.Listener.Addr().String()}},
+		{"Erroring", Backend{Addr: slow.Listener.Addr().String(), Timeout: time.Millisecond}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			_, url := startServer(t, &Config{
+				Listen:    0,
+				ListenTLS: -1,
+				Pools:     []Pool{{Path: "/", Mirror: &Mirror{Backend: c.mirror}}},
+				Backends:  []Backend{{Addr: startNamedUpstream(t, "primary"), Path: "/"}},
+			})
+
+			start := time.Now()
+			for range 3 {
+				if got := getBody(t, url+"/", nil); got != "primary" {
+					t.Fatalf("expected %q but got %q", "primary", got)
+				}
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Fatalf("expected the mirror not to slow down requests but they took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestMirrorInvalid(t *testing.T) {
+	cases := []struct {
+		n      string
+		mirror Mirror
+	}{
+		{"Percent", Mirror{Backend: Backend{Addr: "localhost:3000"}, Percent: 150}},
+		{"Protocol", Mirror{Backend: Backend{Addr: "localhost:3000", Protocol: "gopher"}}},
+		{"Resolve", Mirror{Backend: Backend{Addr: "localhost:3000", Resolve: true}}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			_, err := NewServer(&Config{Listen: 0, ListenTLS: -1, Pools: []Pool{{Path: "/", Mirror: &c.mirror}}})
+			if err == nil {
+				t.Fatal("expected an invalid mirror to be rejected")
+			}
+		})
+	}
+}
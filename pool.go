@@ -0,0 +1,603 @@
+package butler
+
+import (
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StrategyRoundRobin       = "round-robin"
+	StrategyWeighted         = "weighted"
+	StrategyLeastConnections = "least-connections"
+	StrategyRandomTwoChoices = "random-two-choices"
+	StrategyConsistentHash   = "consistent-hash"
+)
+
+// Pool configures how requests are balanced across the backends sharing Path
+// and Match. HashKey is used by the consistent-hash strategy, and is one of
+// "ip", "header:<name>" or "cookie:<name>".
+//
+// Requests with idempotent methods and no body that fail to reach a backend
+// are retried on other members up to Retries times. Retries are limited to
+// RetryBudget, 0.2 by default, for every request sent to the pool, so that
+// retries cannot pile onto a pool that is already failing.
+//
+// Mirror, if set, copies requests to a shadow backend, and Sticky pins clients
+// to backends.
+//
+// MaxRequests limits the requests in flight to the pool, and the MaxRequests
+// of its backends those to each backend. Requests beyond the limits wait in a
+// queue of QueueSize, for up to QueueTimeout, 10s by default, before they are
+// sent 503 responses. With no QueueSize, they are sent 503 responses at once.
+//
+// Backends added to the pool once it is serving, such as by the registrar or
+// as DNS records change, ramp up to their full weight over SlowStart, if set.
+// They start with a tenth of their weight, which grows along SlowStartCurve,
+// linear (the default) or exponential. Backends in the config start warm.
+type Pool struct {
+	Path        string  `yaml:"Path"`
+	Match       string  `yaml:"Match"`
+	Strategy    string  `yaml:"Strategy"`
+	HashKey     string  `yaml:"HashKey"`
+	Retries     int     `yaml:"Retries"`
+	RetryBudget float64 `yaml:"RetryBudget"`
+	Mirror      *Mirror `yaml:"Mirror"`
+	Sticky      *Sticky `yaml:"Sticky"`
+
+	MaxRequests  int           `yaml:"MaxRequests"`
+	QueueSize    int           `yaml:"QueueSize"`
+	QueueTimeout time.Duration `yaml:"QueueTimeout"`
+
+	SlowStart      time.Duration `yaml:"SlowStart"`
+	SlowStartCurve string        `yaml:"SlowStartCurve"`
+}
+
+const (
+	SlowStartLinear      = "linear"
+	SlowStartExponential = "exponential"
+
+	// slowStartMinShare is the share of its weight a backend starts with
+	slowStartMinShare = 0.1
+)
+
+// Sticky keeps sending a client to the backend it was first sent to, for
+// backends that keep sessions in memory. With Cookie, butler issues a cookie
+// of that name identifying the backend, which is Secure on https sites and
+// only recognised by the process that issued it. With AppCookie, the value of
+// an existing application cookie, such as a session ID, is hashed to a
+// backend instead. Clients without the cookie are balanced by the Strategy of
+// the pool.
+//
+// A client whose backend has been removed, or whose breaker is open, is sent
+// to another backend, and with Cookie, pinned to that one from then on.
+type Sticky struct {
+	Cookie    string `yaml:"Cookie"`
+	AppCookie string `yaml:"AppCookie"`
+}
+
+const (
+	defaultRetryBudget = 0.2
+	// maxRetryTokens lets retries through in bursts after quiet periods
+	maxRetryTokens = 10
+)
+
+// upstream is a backend in a pool, along with its connections.
+type upstream struct {
+	b         Backend
+	transport http.RoundTripper
+	tlsConfig *tls.Config
+	rewriter  *rewriter
+	breaker   *breaker
+	// active is the number of requests in flight
+	active atomic.Int64
+	// addedAt is when the upstream joined its pool, and ramp the share of its
+	// weight it has ramped up to since. ramp is nil for members that start
+	// warm.
+	addedAt time.Time
+	ramp    func() float64
+}
+
+func newUpstream(b Backend) (*upstream, error) {
+	tlsConfig, err := newUpstreamTLSConfig(b)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := newTransport(b, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	rw, err := newRewriter(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return &upstream{b: b, transport: transport, tlsConfig: tlsConfig, rewriter: rw, breaker: newBreaker(b)}, nil
+}
+
+func (u *upstream) responseHeaderTimeout() time.Duration {
+	if u.b.ResponseHeaderTimeout <= 0 {
+		return defaultResponseHeaderTimeout
+	}
+	return u.b.ResponseHeaderTimeout
+}
+
+// stickyKey keys the IDs in sticky cookies, so that they cannot be matched to
+// backend addresses by hashing guesses. It is not shared between processes,
+// so clients are pinned again after a restart.
+var stickyKey = func() []byte {
+	key := make([]byte, 32)
+	cryptorand.Read(key)
+	return key
+}()
+
+// stickyID identifies the backend in sticky cookies, without revealing its
+// address.
+func (u *upstream) stickyID() string {
+	mac := hmac.New(sha256.New, stickyKey)
+	mac.Write([]byte(u.b.Addr))
+	mac.Write([]byte{0})
+	mac.Write([]byte(u.b.Path))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// host is sent to the backend in the Host header.
+func (u *upstream) host() string {
+	if u.b.resolvedFrom != "" {
+		return u.b.resolvedFrom
+	}
+	return backendHost(u.b)
+}
+
+// hasCapacity reports whether another request may be sent to u.
+func (u *upstream) hasCapacity() bool {
+	return u.b.MaxRequests <= 0 || u.active.Load() < int64(u.b.MaxRequests)
+}
+
+func (u *upstream) isHTTP() bool {
+	return u.b.Protocol == "" || u.b.Protocol == ProtocolHTTP
+}
+
+// weight is the weight of u, scaled by its share while it slow starts.
+func (u *upstream) weight() float64 {
+	w := max(u.b.Weight, 1)
+	return float64(w) * u.share()
+}
+
+// share is the share of its weight u has ramped up to.
+func (u *upstream) share() float64 {
+	if u.ramp == nil {
+		return 1
+	}
+	return u.ramp()
+}
+
+// closeIdleConnections closes pooled connections to a backend that has been removed
+func (u *upstream) closeIdleConnections() {
+	if t, ok := u.transport.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+type pool struct {
+	config   Pool
+	balancer balancer
+	budget   *retryBudget
+	mirror   *mirror
+	now      func() time.Time
+
+	mu      sync.RWMutex
+	members []*upstream
+
+	// active is the number of requests in flight
+	active atomic.Int64
+	// limits guards the queue of requests waiting for capacity
+	limits sync.Mutex
+	queue  *requestQueue
+}
+
+func newPool(config Pool) (*pool, error) {
+	b, err := newBalancer(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Retries < 0 || config.RetryBudget < 0 {
+		return nil, fmt.Errorf("pool %s: Retries and RetryBudget must not be negative", config.Path)
+	}
+
+	ratio := config.RetryBudget
+	if ratio == 0 {
+		ratio = defaultRetryBudget
+	}
+
+	if config.Sticky != nil && (config.Sticky.Cookie == "") == (config.Sticky.AppCookie == "") {
+		return nil, fmt.Errorf("pool %s: exactly one of Sticky Cookie or AppCookie must be set", config.Path)
+	}
+
+	if config.MaxRequests < 0 || config.QueueSize < 0 || config.QueueTimeout < 0 {
+		return nil, fmt.Errorf("pool %s: MaxRequests, QueueSize and QueueTimeout must not be negative", config.Path)
+	}
+
+	if config.SlowStart < 0 || config.SlowStartCurve != "" && config.SlowStartCurve != SlowStartLinear && config.SlowStartCurve != SlowStartExponential {
+		return nil, fmt.Errorf("pool %s: SlowStart must not be negative and SlowStartCurve must be linear or exponential", config.Path)
+	}
+
+	p := &pool{config: config, balancer: b, budget: &retryBudget{ratio: ratio, tokens: maxRetryTokens}, now: time.Now,
+		queue: newRequestQueue(config)}
+	if config.Mirror != nil {
+		p.mirror, err = newMirror(*config.Mirror)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %w", config.Path, err)
+		}
+	}
+
+	return p, nil
+}
+
+// add adds b to the pool, returning false if it is already a member. Unless
+// it is warm, b slow starts.
+func (p *pool) add(b Backend, warm bool) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if slices.ContainsFunc(p.members, func(u *upstream) bool { return u.b.Equals(b) }) {
+		return false, nil
+	}
+
+	u, err := newUpstream(b)
+	if err != nil {
+		return false, err
+	}
+	u.addedAt = p.now()
+	if !warm && p.config.SlowStart > 0 {
+		u.ramp = func() float64 { return p.slowStartShare(p.now().Sub(u.addedAt)) }
+	}
+
+	// Copy on write, so that picks in flight are not affected
+	p.members = append(slices.Clone(p.members), u)
+	return true, nil
+}
+
+// member returns the member for b, or nil if b is not in the pool.
+func (p *pool) member(b Backend) *upstream {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	i := slices.IndexFunc(p.members, func(u *upstream) bool { return u.b.Equals(b) })
+	if i < 0 {
+		return nil
+	}
+	return p.members[i]
+}
+
+// remove removes b from the pool, returning the number of members left.
+func (p *pool) remove(b Backend) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.members = slices.DeleteFunc(slices.Clone(p.members), func(u *upstream) bool {
+		if u.b.Equals(b) {
+			u.closeIdleConnections()
+			return true
+		}
+		return false
+	})
+
+	return len(p.members)
+}
+
+// size returns the number of members in the pool.
+func (p *pool) size() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return len(p.members)
+}
+
+// pick chooses the member to send c to, skipping those already tried, those
+// whose breaker is open and those at capacity. It returns nil if there are
+// none left.
+func (p *pool) pick(c *Context, tried []*upstream) *upstream {
+	p.mu.RLock()
+	members := p.members
+	p.mu.RUnlock()
+
+	candidates := make([]*upstream, 0, len(members))
+	for _, u := range members {
+		if !slices.Contains(tried, u) && u.breaker.available() && u.hasCapacity() {
+			candidates = append(candidates, u)
+		}
+	}
+
+	if u := p.pinned(c, candidates); u != nil && u.breaker.allow() {
+		return u
+	}
+
+	for len(candidates) > 0 {
+		u := candidates[0]
+		if len(candidates) > 1 {
+			u = p.balancer.next(candidates, c)
+		}
+
+		// Another request may have claimed the half-open probe since
+		if u.breaker.allow() {
+			return u
+		}
+		candidates = slices.DeleteFunc(candidates, func(o *upstream) bool { return o == u })
+	}
+
+	return nil
+}
+
+// slowStartShare is the share of its weight a backend that joined age ago
+// has.
+func (p *pool) slowStartShare(age time.Duration) float64 {
+	if age >= p.config.SlowStart {
+		return 1
+	}
+
+	progress := max(float64(age), 0) / float64(p.config.SlowStart)
+	if p.config.SlowStartCurve == SlowStartExponential {
+		return math.Pow(slowStartMinShare, 1-progress)
+	}
+	return slowStartMinShare + (1-slowStartMinShare)*progress
+}
+
+// pinned returns the candidate a sticky client is pinned to, or nil if the
+// client is not pinned or its backend is not a candidate.
+func (p *pool) pinned(c *Context, candidates []*upstream) *upstream {
+	sticky := p.config.Sticky
+	switch {
+	case sticky == nil || len(candidates) == 0:
+		return nil
+	case sticky.AppCookie != "":
+		if c.Request.Cookie(sticky.AppCookie) == "" {
+			return nil
+		}
+		return consistentHashBalancer{"cookie", sticky.AppCookie}.next(candidates, c)
+	}
+
+	id := c.Request.Cookie(sticky.Cookie)
+	if id == "" {
+		return nil
+	}
+
+	i := slices.IndexFunc(candidates, func(u *upstream) bool { return u.stickyID() == id })
+	if i < 0 {
+		slog.Debug(fmt.Sprintf("%s is pinned to an unavailable backend, failing over", c.Request))
+		return nil
+	}
+	return candidates[i]
+}
+
+// pin issues the sticky cookie for u, unless the client already has it.
+func (p *pool) pin(c *Context, u *upstream) {
+	sticky := p.config.Sticky
+	if sticky == nil || sticky.Cookie == "" || c.Response == nil {
+		return
+	}
+
+	id := u.stickyID()
+	if c.Request.Cookie(sticky.Cookie) == id {
+		return
+	}
+
+	cookie := &http.Cookie{Name: sticky.Cookie, Value: id, Path: "/", HttpOnly: true, Secure: c.Request.Scheme == SchemeHTTPS}
+	c.Response.Headers[HeaderSetCookie] = append(c.Response.Headers[HeaderSetCookie], cookie.String())
+}
+
+// health returns the passive health of every member.
+func (p *pool) health() []BackendHealth {
+	p.mu.RLock()
+	members := p.members
+	p.mu.RUnlock()
+
+	health := make([]BackendHealth, 0, len(members))
+	for _, u := range members {
+		h := u.breaker.health()
+		h.Pool = p.config.Path
+		health = append(health, h)
+	}
+	return health
+}
+
+// retryBudget earns ratio of a retry for every request, up to maxRetryTokens.
+type retryBudget struct {
+	ratio float64
+
+	mu     sync.Mutex
+	tokens float64
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = min(b.tokens+b.ratio, maxRetryTokens)
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type balancer interface {
+	// next picks one of members, of which there are at least two
+	next(members []*upstream, c *Context) *upstream
+}
+
+func newBalancer(config Pool) (balancer, error) {
+	switch config.Strategy {
+	case "", StrategyRoundRobin:
+		return &roundRobinBalancer{ramping: weightedBalancer{current: make(map[*upstream]float64)}}, nil
+	case StrategyWeighted:
+		return &weightedBalancer{current: make(map[*upstream]float64)}, nil
+	case StrategyLeastConnections:
+		return leastConnectionsBalancer{}, nil
+	case StrategyRandomTwoChoices:
+		return randomTwoChoicesBalancer{}, nil
+	case StrategyConsistentHash:
+		source, name, _ := strings.Cut(config.HashKey, ":")
+		if source != "ip" && (name == "" || source != "header" && source != "cookie") {
+			return nil, fmt.Errorf("pool %s: HashKey must be ip, header:<name> or cookie:<name>", config.Path)
+		}
+		return consistentHashBalancer{source, name}, nil
+	}
+
+	return nil, fmt.Errorf("pool %s: unknown strategy %s", config.Path, config.Strategy)
+}
+
+// roundRobinBalancer ignores weights, but while members slow start, it
+// weights each by its share instead.
+type roundRobinBalancer struct {
+	n       atomic.Uint64
+	ramping weightedBalancer
+}
+
+func (b *roundRobinBalancer) next(members []*upstream, c *Context) *upstream {
+	if slices.ContainsFunc(members, func(u *upstream) bool { return u.share() < 1 }) {
+		return b.ramping.pick(members, (*upstream).share)
+	}
+	return members[(b.n.Add(1)-1)%uint64(len(members))]
+}
+
+// weightedBalancer is nginx's smooth weighted round-robin, which spreads the
+// picks of heavier members out rather than sending them in bursts.
+type weightedBalancer struct {
+	mu      sync.Mutex
+	current map[*upstream]float64
+}
+
+func (b *weightedBalancer) next(members []*upstream, c *Context) *upstream {
+	return b.pick(members, (*upstream).weight)
+}
+
+func (b *weightedBalancer) pick(members []*upstream, weight func(*upstream) float64) *upstream {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var best *upstream
+	total := 0.0
+	for _, u := range members {
+		w := weight(u)
+		total += w
+		b.current[u] += w
+		if best == nil || b.current[u] > b.current[best] {
+			best = u
+		}
+	}
+	b.current[best] -= total
+
+	// Forget members that have left the pool
+	if len(b.current) > len(members) {
+		for u := range b.current {
+			if !slices.Contains(members, u) {
+				delete(b.current, u)
+			}
+		}
+	}
+
+	return best
+}
+
+type leastConnectionsBalancer struct{}
+
+func (b leastConnectionsBalancer) next(members []*upstream, c *Context) *upstream {
+	// Start at a random member, so that ties are not always won by the first
+	offset := rand.IntN(len(members))
+	best := members[offset]
+	for i := range members {
+		u := members[(offset+i)%len(members)]
+		if load(u) < load(best) {
+			best = u
+		}
+	}
+	return best
+}
+
+// randomTwoChoicesBalancer picks two members at random and sends the request
+// to the less loaded one.
+type randomTwoChoicesBalancer struct{}
+
+func (b randomTwoChoicesBalancer) next(members []*upstream, c *Context) *upstream {
+	i := rand.IntN(len(members))
+	j := rand.IntN(len(members) - 1)
+	if j >= i {
+		j++
+	}
+
+	a, o := members[i], members[j]
+	if load(o) < load(a) {
+		return o
+	}
+	return a
+}
+
+// load is the requests in flight to u for its weight, counting the one about
+// to be sent so that weights matter even when members are idle.
+func load(u *upstream) float64 {
+	return float64(u.active.Load()+1) / u.weight()
+}
+
+// consistentHashBalancer uses weighted rendezvous hashing, so that a key keeps
+// going to the same member, and only the keys of a member that leaves the pool
+// move elsewhere.
+type consistentHashBalancer struct {
+	source string
+	name   string
+}
+
+func (b consistentHashBalancer) next(members []*upstream, c *Context) *upstream {
+	key := b.key(c)
+
+	var best *upstream
+	bestScore := math.Inf(-1)
+	for _, u := range members {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(u.b.Addr))
+
+		// Map the hash into (0, 1), then weight it
+		x := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		score := -u.weight() / math.Log(x)
+		if score > bestScore {
+			best, bestScore = u, score
+		}
+	}
+
+	return best
+}
+
+func (b consistentHashBalancer) key(c *Context) string {
+	switch b.source {
+	case "header":
+		return c.Request.Header(b.name)
+	case "cookie":
+		return c.Request.Cookie(b.name)
+	}
+
+	return clientIP(c)
+}
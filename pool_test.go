@@ -0,0 +1,435 @@
+package butler
+
+import (
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func startNamedUpstream(t *testing.T, name string) string {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream.Listener.Addr().String()
+}
+
+func getBody(t *testing.T, url string, headers map[string]string) string {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, _ := io.ReadAll(resp.Body)
+	return string(b)
+}
+
+func TestPoolStrategies(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	a := startNamedUpstream(t, "a")
+	b := startNamedUpstream(t, "b")
+
+	cases := []struct {
+		n        string
+		strategy string
+		weights  []int
+		expected map[string]int
+	}{
+		{"RoundRobin", StrategyRoundRobin, []int{0, 0}, map[string]int{"a": 6, "b": 6}},
+		{"Default", "", []int{0, 0}, map[string]int{"a": 6, "b": 6}},
+		{"Weighted", StrategyWeighted, []int{3, 1}, map[string]int{"a": 9, "b": 3}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			_, proxy := startServer(t, &Config{
+				Listen:    0,
+				ListenTLS: -1,
+				Backends: []Backend{
+					{Addr: a, Path: "/", Weight: c.weights[0]},
+					{Addr: b, Path: "/", Weight: c.weights[1]},
+				},
+				Pools: []Pool{{Path: "/", Strategy: c.strategy}},
+			})
+			url := proxy + "/"
+
+			got := map[string]int{}
+			for range 12 {
+				got[getBody(t, url, nil)]++
+			}
+
+			for k, v := range c.expected {
+				if got[k] != v {
+					t.Fatalf("expected %v but got %v", c.expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestPoolSpreadsLoad(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	a := startNamedUpstream(t, "a")
+	b := startNamedUpstream(t, "b")
+
+	cases := []struct {
+		n        string
+		strategy string
+	}{
+		{"LeastConnections", StrategyLeastConnections},
+		{"RandomTwoChoices", StrategyRandomTwoChoices},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			p, err := newPool(Pool{Path: "/", Strategy: c.strategy})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.add(Backend{Addr: a, Path: "/"}, true)
+			p.add(Backend{Addr: b, Path: "/"}, true)
+
+			// A busy member should be avoided
+			p.members[0].active.Add(5)
+			for range 10 {
+				if u := p.pick(&Context{Request: &Request{}}, nil); u != p.members[1] {
+					t.Fatalf("expected the idle member but got %v", u.b.Addr)
+				}
+			}
+		})
+	}
+}
+
+func TestPoolConsistentHash(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	a := startNamedUpstream(t, "a")
+	b := startNamedUpstream(t, "b")
+	c := startNamedUpstream(t, "c")
+
+	cases := []struct {
+		n       string
+		hashKey string
+		header  func(key string) map[string]string
+	}{
+		{"Header", "header:X-User", func(key string) map[string]string { return map[string]string{"X-User": key} }},
+		{"Cookie", "cookie:session", func(key string) map[string]string { return map[string]string{"Cookie": "session=" + key} }},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.n, func(t *testing.T) {
+			_, proxy := startServer(t, &Config{
+				Listen:    0,
+				ListenTLS: -1,
+				Backends:  []Backend{{Addr: a, Path: "/"}, {Addr: b, Path: "/"}, {Addr: c, Path: "/"}},
+				Pools:     []Pool{{Path: "/", Strategy: StrategyConsistentHash, HashKey: tc.hashKey}},
+			})
+
+			seen := map[string]bool{}
+			for _, key := range []string{"alice", "bob", "carol", "dave", "erin", "frank"} {
+				first := getBody(t, proxy+"/", tc.header(key))
+				seen[first] = true
+				for range 3 {
+					if got := getBody(t, proxy+"/", tc.header(key)); got != first {
+						t.Fatalf("expected %s to stick to %s but got %s", key, first, got)
+					}
+				}
+			}
+
+			if len(seen) < 2 {
+				t.Fatalf("expected keys to be spread across members but got %v", seen)
+			}
+		})
+	}
+}
+
+func TestPoolInvalidConfig(t *testing.T) {
+	cases := []struct {
+		n    string
+		pool Pool
+	}{
+		{"UnknownStrategy", Pool{Path: "/", Strategy: "fastest"}},
+		{"UnknownMatch", Pool{Path: "/", Match: "regex"}},
+		{"MissingHashKey", Pool{Path: "/", Strategy: StrategyConsistentHash}},
+		{"BadHashKey", Pool{Path: "/", Strategy: StrategyConsistentHash, HashKey: "query:id"}},
+		{"EmptySticky", Pool{Path: "/", Sticky: &Sticky{}}},
+		{"BothSticky", Pool{Path: "/", Sticky: &Sticky{Cookie: "backend", AppCookie: "session"}}},
+		{"NegativeQueueSize", Pool{Path: "/", MaxRequests: 1, QueueSize: -1}},
+		{"NegativeSlowStart", Pool{Path: "/", SlowStart: -time.Second}},
+		{"UnknownSlowStartCurve", Pool{Path: "/", SlowStart: time.Second, SlowStartCurve: "cubic"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			_, err := NewServer(&Config{Listen: 0, ListenTLS: -1, Pools: []Pool{c.pool}})
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestPoolAddedBackendsShareLoad(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	a := startNamedUpstream(t, "a")
+	b := startNamedUpstream(t, "b")
+
+	proxy, addr := startServer(t, &Config{
+		Listen:    0,
+		ListenTLS: -1,
+		Backends:  []Backend{{Addr: a, Path: "/"}},
+	})
+	url := addr + "/"
+
+	// As the registrar would
+	if err := proxy.addBackend(Backend{Addr: b, Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]int{}
+	for range 4 {
+		got[getBody(t, url, nil)]++
+	}
+	if got["a"] != 2 || got["b"] != 2 {
+		t.Fatalf("expected requests to be shared but got %v", got)
+	}
+
+	proxy.removeBackend(Backend{Addr: a, Path: "/"})
+	for range 2 {
+		if body := getBody(t, url, nil); body != "b" {
+			t.Fatalf("expected b but got %s", body)
+		}
+	}
+
+	proxy.removeBackend(Backend{Addr: b, Path: "/"})
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 once the pool is empty but got %v", resp.StatusCode)
+	}
+}
+
+func TestPoolSticky(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	cases := []struct {
+		n      string
+		sticky Sticky
+	}{
+		{"Cookie", Sticky{Cookie: "backend"}},
+		{"AppCookie", Sticky{AppCookie: "session"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			backends := map[string]Backend{}
+			for _, name := range []string{"a", "b", "c"} {
+				backends[name] = Backend{Addr: startNamedUpstream(t, name), Path: "/"}
+			}
+
+			proxy, addr := startServer(t, &Config{
+				Listen:    0,
+				ListenTLS: -1,
+				Pools:     []Pool{{Path: "/", Sticky: &c.sticky}},
+				Backends:  []Backend{backends["a"], backends["b"], backends["c"]},
+			})
+
+			cookies := []*http.Cookie{{Name: "session", Value: "abc123"}}
+			get := func() (string, []*http.Cookie) {
+				req, _ := http.NewRequest("GET", addr+"/", nil)
+				for _, cookie := range cookies {
+					req.AddCookie(cookie)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				b, _ := io.ReadAll(resp.Body)
+				return string(b), resp.Cookies()
+			}
+
+			// Follows the backend a client is pinned to, reporting whether it
+			// was pinned by a new cookie
+			pinned := func() (string, bool) {
+				b, set := get()
+				if c.sticky.Cookie == "" {
+					if len(set) > 0 {
+						t.Fatalf("expected no cookies to be issued but got %v", set)
+					}
+					return b, false
+				}
+
+				if len(set) == 0 {
+					return b, false
+				}
+				if len(set) != 1 || set[0].Name != c.sticky.Cookie || set[0].Value == backends[b].Addr {
+					t.Fatalf("expected an opaque %s cookie but got %v", c.sticky.Cookie, set)
+				}
+				cookies = append(cookies[:1], set[0])
+				return b, true
+			}
+
+			first, issued := pinned()
+			if c.sticky.Cookie != "" && !issued {
+				t.Fatal("expected the first response to pin the client")
+			}
+
+			for range 10 {
+				if b, issued := pinned(); b != first || issued {
+					t.Fatalf("expected the client to stay on %s but got %s", first, b)
+				}
+			}
+
+			// As the registrar would when health checks fail
+			proxy.removeBackend(backends[first])
+
+			second, issued := pinned()
+			if second == first {
+				t.Fatalf("expected the client to fail over from %s", first)
+			}
+			if c.sticky.Cookie != "" && !issued {
+				t.Fatal("expected the client to be pinned to the new backend")
+			}
+
+			for range 10 {
+				if b, issued := pinned(); b != second || issued {
+					t.Fatalf("expected the client to stay on %s but got %s", second, b)
+				}
+			}
+		})
+	}
+}
+
+func TestPoolSlowStart(t *testing.T) {
+	cases := []struct {
+		n        string
+		strategy string
+		curve    string
+		cold     int
+		age      time.Duration
+		share    float64
+	}{
+		{"Joined", "", "", 1, 0, 0.1},
+		{"Halfway", "", "", 1, 5 * time.Second, 0.55},
+		{"Done", "", "", 1, 10 * time.Second, 1},
+		{"ExponentialJoined", "", SlowStartExponential, 1, 0, 0.1},
+		{"ExponentialHalfway", "", SlowStartExponential, 1, 5 * time.Second, 0.316},
+		{"ExponentialDone", "", SlowStartExponential, 1, 10 * time.Second, 1},
+		{"TwoJoined", "", "", 2, 0, 0.1},
+		{"WeightedJoined", StrategyWeighted, "", 2, 0, 0.1},
+		{"WeightedHalfway", StrategyWeighted, "", 1, 5 * time.Second, 0.55},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			p, err := newPool(Pool{Path: "/", Strategy: c.strategy, SlowStart: 10 * time.Second, SlowStartCurve: c.curve})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			now := time.Now()
+			p.now = func() time.Time { return now }
+			p.add(Backend{Addr: "warm:80"}, true)
+			now = now.Add(time.Minute)
+			for i := range c.cold {
+				p.add(Backend{Addr: "cold" + strconv.Itoa(i) + ":80"}, false)
+			}
+			now = now.Add(c.age)
+
+			if share := p.slowStartShare(c.age); math.Abs(share-c.share) > 0.001 {
+				t.Fatalf("expected a share of %v but got %v", c.share, share)
+			}
+
+			got := map[string]int{}
+			for range 10000 {
+				got[p.pick(&Context{Request: &Request{}}, nil).b.Addr]++
+			}
+
+			// Each new backend's weight is scaled down by its share
+			expected := c.share / (1 + float64(c.cold)*c.share)
+			for i := range c.cold {
+				if share := float64(got["cold"+strconv.Itoa(i)+":80"]) / 10000; math.Abs(share-expected) > 0.02 {
+					t.Fatalf("expected each new backend to get %.2f of requests but got %v", expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestPoolSlowStartConfig(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	s, _ := startServer(t, &Config{
+		Listen:    0,
+		ListenTLS: -1,
+		Pools:     []Pool{{Path: "/", SlowStart: time.Hour}},
+		Backends:  []Backend{{Addr: "a:80", Path: "/"}, {Addr: "b:80", Path: "/"}},
+	})
+	if err := s.addBackend(Backend{Addr: "c:80", Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p := s.sites.defaultSite.routes.lookup("/")
+	got := map[string]int{}
+	for range 2100 {
+		got[p.pick(&Context{Request: &Request{}}, nil).b.Addr]++
+	}
+
+	// The backends in the config are warm, and the one added since starts
+	// with a tenth of their weight
+	if got["a:80"] < 950 || got["b:80"] < 950 || got["c:80"] < 50 || got["c:80"] > 150 {
+		t.Fatalf("expected the backends in the config to start warm but got %v", got)
+	}
+}
+
+func TestPoolStickyCookie(t *testing.T) {
+	p, err := newPool(Pool{Path: "/", Sticky: &Sticky{Cookie: "backend"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.add(Backend{Addr: "a:80", Path: "/"}, true)
+	u := p.members[0]
+
+	for _, scheme := range []string{"http", "https"} {
+		c := &Context{Request: &Request{Scheme: scheme}, Response: StatusCode(http.StatusOK, nil)}
+		p.pin(c, u)
+
+		cookie, err := http.ParseSetCookie(c.Response.Headers[HeaderSetCookie][0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cookie.Secure != (scheme == "https") || !cookie.HttpOnly || cookie.Value != u.stickyID() {
+			t.Fatalf("expected a cookie for %s that is only Secure over https but got %v", scheme, cookie)
+		}
+	}
+
+	// The ID cannot be worked out from the address alone
+	id := u.stickyID()
+	key := stickyKey
+	defer func() { stickyKey = key }()
+	stickyKey = []byte("another process")
+	if u.stickyID() == id {
+		t.Fatal("expected the ID to depend on the key of the process")
+	}
+}
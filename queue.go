@@ -0,0 +1,247 @@
+package butler
+
+import (
+	"container/list"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const defaultQueueTimeout = 10 * time.Second
+
+// PoolStats describes the requests in flight to a pool and waiting in its
+// queue, as listed by the admin API.
+type PoolStats struct {
+	Site        string `json:"Site,omitempty"`
+	Pool        string `json:"Pool"`
+	Active      int    `json:"Active"`
+	MaxRequests int    `json:"MaxRequests"`
+	Queued      int    `json:"Queued"`
+	QueueSize   int    `json:"QueueSize"`
+	// Waited is the number of requests that have waited in the queue, and
+	// Rejected the number sent 503 responses, either because the queue was
+	// full or because they waited longer than QueueTimeout
+	Waited             int64   `json:"Waited"`
+	Rejected           int64   `json:"Rejected"`
+	AverageWaitSeconds float64 `json:"AverageWaitSeconds"`
+	MaxWaitSeconds     float64 `json:"MaxWaitSeconds"`
+}
+
+// requestQueue holds the requests waiting for a pool, or its members, to have
+// capacity. It is guarded by pool.limits, except for queued which lets
+// requests skip the lock while nothing is waiting.
+type requestQueue struct {
+	size    int
+	timeout time.Duration
+	waiting *list.List
+	queued  atomic.Int64
+
+	waited    int64
+	rejected  int64
+	totalWait time.Duration
+	maxWait   time.Duration
+}
+
+type queuedRequest struct {
+	ready chan struct{}
+	elem  *list.Element
+}
+
+func newRequestQueue(config Pool) *requestQueue {
+	timeout := config.QueueTimeout
+	if timeout <= 0 {
+		timeout = defaultQueueTimeout
+	}
+	return &requestQueue{size: config.QueueSize, timeout: timeout, waiting: list.New()}
+}
+
+// retryAfter is sent to clients turned away by a full pool.
+func (q *requestQueue) retryAfter() string {
+	return strconv.Itoa(max(int(q.timeout.Round(time.Second)/time.Second), 1))
+}
+
+func (q *requestQueue) push() *queuedRequest {
+	w := &queuedRequest{ready: make(chan struct{}, 1)}
+	w.elem = q.waiting.PushBack(w)
+	q.queued.Add(1)
+	return w
+}
+
+func (q *requestQueue) remove(w *queuedRequest) {
+	q.waiting.Remove(w.elem)
+	q.queued.Add(-1)
+}
+
+// wakeNext lets the request at the front of the queue try again.
+func (q *requestQueue) wakeNext() {
+	if front := q.waiting.Front(); front != nil {
+		select {
+		case front.Value.(*queuedRequest).ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (q *requestQueue) recordWait(d time.Duration, rejected bool) {
+	q.waited++
+	q.totalWait += d
+	q.maxWait = max(q.maxWait, d)
+	if rejected {
+		q.rejected++
+	}
+}
+
+// acquire picks the member to send c to, as pick does, and reserves one of
+// the requests it and the pool may have in flight, which release returns.
+// While they are at capacity, c waits in the queue in turn. It returns nil
+// and true if c was turned away from a full queue or waited too long.
+func (p *pool) acquire(c *Context, tried []*upstream) (*upstream, bool) {
+	q := p.queue
+
+	// Without requests waiting ahead of c, the lock is not needed
+	if q.queued.Load() == 0 {
+		u, full := p.reserve(c, tried)
+		if !full {
+			return u, false
+		}
+	}
+
+	p.limits.Lock()
+	if q.waiting.Len() >= q.size {
+		q.rejected++
+		p.limits.Unlock()
+		slog.Debug(fmt.Sprintf("rejecting %s as the queue of pool %s is full", c.Request, p.config.Path))
+		return nil, true
+	}
+
+	w := q.push()
+	queuedAt := p.now()
+	ahead := q.waiting.Len() - 1
+	p.limits.Unlock()
+	slog.Debug(fmt.Sprintf("queueing %s for pool %s behind %d requests", c.Request, p.config.Path, ahead))
+
+	// Capacity may have been released before c was queued
+	turn := ahead == 0
+
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+
+	// leave removes c from the queue, letting the next request try
+	leave := func(rejected bool) {
+		p.limits.Lock()
+		defer p.limits.Unlock()
+
+		q.remove(w)
+		q.recordWait(p.now().Sub(queuedAt), rejected)
+		q.wakeNext()
+	}
+
+	for {
+		if turn {
+			u, full := p.reserve(c, tried)
+			if !full {
+				leave(false)
+				return u, false
+			}
+		}
+
+		select {
+		case <-w.ready:
+			turn = true
+		case <-timer.C:
+			slog.Debug(fmt.Sprintf("rejecting %s as it waited %s for pool %s", c.Request, q.timeout, p.config.Path))
+			leave(true)
+			return nil, true
+		}
+	}
+}
+
+// reserve picks a member for c and reserves a request on it, reporting
+// whether the pool, or every member c could be sent to, is at capacity.
+func (p *pool) reserve(c *Context, tried []*upstream) (*upstream, bool) {
+	if !reserveRequest(&p.active, p.config.MaxRequests) {
+		return nil, true
+	}
+
+	skip := tried
+	for {
+		u := p.pick(c, skip)
+		if u == nil {
+			break
+		}
+
+		if reserveRequest(&u.active, u.b.MaxRequests) {
+			return u, false
+		}
+		// Another request reached the member's limit first
+		u.breaker.release()
+		skip = append(slices.Clone(skip), u)
+	}
+	p.active.Add(-1)
+
+	p.mu.RLock()
+	members := p.members
+	p.mu.RUnlock()
+
+	full := slices.ContainsFunc(members, func(u *upstream) bool {
+		return !slices.Contains(tried, u) && u.breaker.available() && !u.hasCapacity()
+	})
+	return nil, full
+}
+
+// reserveRequest adds a request to active unless it would exceed limit, where
+// a limit of 0 is unlimited.
+func reserveRequest(active *atomic.Int64, limit int) bool {
+	if limit <= 0 {
+		active.Add(1)
+		return true
+	}
+
+	for {
+		n := active.Load()
+		if n >= int64(limit) {
+			return false
+		}
+		if active.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// release returns the request reserved on u by acquire.
+func (p *pool) release(u *upstream) {
+	p.active.Add(-1)
+	u.active.Add(-1)
+
+	if p.queue.queued.Load() == 0 {
+		return
+	}
+
+	p.limits.Lock()
+	defer p.limits.Unlock()
+	p.queue.wakeNext()
+}
+
+func (p *pool) stats() PoolStats {
+	p.limits.Lock()
+	defer p.limits.Unlock()
+
+	q := p.queue
+	s := PoolStats{
+		Pool:           p.config.Path,
+		Active:         int(p.active.Load()),
+		MaxRequests:    p.config.MaxRequests,
+		Queued:         q.waiting.Len(),
+		QueueSize:      q.size,
+		Waited:         q.waited,
+		Rejected:       q.rejected,
+		MaxWaitSeconds: q.maxWait.Seconds(),
+	}
+	if q.waited > 0 {
+		s.AverageWaitSeconds = q.totalWait.Seconds() / float64(q.waited)
+	}
+	return s
+}
@@ -0,0 +1,263 @@
+package butler
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type queueResult struct {
+	path       string
+	status     int
+	retryAfter string
+}
+
+// startBlockingUpstream starts an upstream that reports the path of each
+// request it receives, then holds the request until it is released.
+func startBlockingUpstream(t *testing.T, arrivals chan<- string, release <-chan struct{}) string {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrivals <- r.URL.Path
+		<-release
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream.Listener.Addr().String()
+}
+
+func queueGet(t *testing.T, url string, path string) queueResult {
+	resp, err := http.Get(url + path)
+	if err != nil {
+		t.Error(err)
+		return queueResult{path: path}
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return queueResult{path, resp.StatusCode, resp.Header.Get("Retry-After")}
+}
+
+func waitForStats(t *testing.T, p *pool, done func(PoolStats) bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !done(p.stats()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the pool, got %+v", p.stats())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPoolQueue(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	arrivals := make(chan string, 10)
+	release := make(chan struct{})
+	addr := startBlockingUpstream(t, arrivals, release)
+
+	s, url := startServer(t, &Config{
+		Listen:    0,
+		ListenTLS: -1,
+		Pools:     []Pool{{Path: "/", MaxRequests: 1, QueueSize: 2, QueueTimeout: 5 * time.Second}},
+		Backends:  []Backend{{Addr: addr, Path: "/"}},
+	})
+	p := s.sites.defaultSite.allPools()[0]
+
+	results := make(chan queueResult, 3)
+	go func() { results <- queueGet(t, url, "/a") }()
+	if path := <-arrivals; path != "/a" {
+		t.Fatalf("expected /a but got %s", path)
+	}
+
+	// Queued in the order they arrive
+	for i, path := range []string{"/b", "/c"} {
+		go func() { results <- queueGet(t, url, path) }()
+		waitForStats(t, p, func(s PoolStats) bool { return s.Queued == i+1 })
+	}
+
+	if r := queueGet(t, url, "/d"); r.status != http.StatusServiceUnavailable || r.retryAfter != "5" {
+		t.Fatalf("expected a full queue to send 503 with Retry-After but got %+v", r)
+	}
+
+	for _, expected := range []string{"/b", "/c"} {
+		release <- struct{}{}
+		if path := <-arrivals; path != expected {
+			t.Fatalf("expected %s to be sent next but got %s", expected, path)
+		}
+	}
+	release <- struct{}{}
+
+	for range 3 {
+		if r := <-results; r.status != http.StatusOK {
+			t.Fatalf("expected queued requests to succeed but got %+v", r)
+		}
+	}
+
+	waitForStats(t, p, func(s PoolStats) bool { return s.Active == 0 })
+	if s := p.stats(); s.Queued != 0 || s.Waited != 2 || s.Rejected != 1 || s.MaxWaitSeconds <= 0 || s.AverageWaitSeconds <= 0 {
+		t.Fatalf("expected the queue to be recorded but got %+v", s)
+	}
+}
+
+func TestPoolQueueTimeout(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	arrivals := make(chan string, 10)
+	release := make(chan struct{})
+	addr := startBlockingUpstream(t, arrivals, release)
+
+	s, url := startServer(t, &Config{
+		Listen:    0,
+		ListenTLS: -1,
+		Pools:     []Pool{{Path: "/", MaxRequests: 1, QueueSize: 1, QueueTimeout: 100 * time.Millisecond}},
+		Backends:  []Backend{{Addr: addr, Path: "/"}},
+	})
+	p := s.sites.defaultSite.allPools()[0]
+
+	results := make(chan queueResult, 1)
+	go func() { results <- queueGet(t, url, "/a") }()
+	<-arrivals
+
+	start := time.Now()
+	r := queueGet(t, url, "/b")
+	if r.status != http.StatusServiceUnavailable || r.retryAfter != "1" || time.Since(start) < 100*time.Millisecond {
+		t.Fatalf("expected the request to wait, then be sent 503 but got %+v", r)
+	}
+
+	release <- struct{}{}
+	if r := <-results; r.status != http.StatusOK {
+		t.Fatalf("expected the first request to succeed but got %+v", r)
+	}
+
+	if s := p.stats(); s.Waited != 1 || s.Rejected != 1 || s.MaxWaitSeconds < 0.1 {
+		t.Fatalf("expected the timeout to be recorded but got %+v", s)
+	}
+}
+
+func TestBackendMaxRequests(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	arrivals := make(chan string, 10)
+	release := make(chan struct{})
+	a := startBlockingUpstream(t, arrivals, release)
+	b := startBlockingUpstream(t, arrivals, release)
+
+	_, url := startServer(t, &Config{
+		Listen:    0,
+		ListenTLS: -1,
+		Backends:  []Backend{{Addr: a, Path: "/", MaxRequests: 1}, {Addr: b, Path: "/", MaxRequests: 1}},
+	})
+
+	results := make(chan queueResult, 2)
+	for _, path := range []string{"/a", "/b"} {
+		go func() { results <- queueGet(t, url, path) }()
+		<-arrivals
+	}
+
+	if r := queueGet(t, url, "/c"); r.status != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 once every backend is at capacity but got %+v", r)
+	}
+
+	for range 2 {
+		release <- struct{}{}
+		if r := <-results; r.status != http.StatusOK {
+			t.Fatalf("expected requests within the limit to succeed but got %+v", r)
+		}
+	}
+
+	go func() { results <- queueGet(t, url, "/d") }()
+	<-arrivals
+	release <- struct{}{}
+	if r := <-results; r.status != http.StatusOK {
+		t.Fatalf("expected capacity to be released but got %+v", r)
+	}
+}
+
+func TestPoolAcquireConcurrent(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	cases := []struct {
+		n        string
+		config   Pool
+		backends []Backend
+		limit    int64
+	}{
+		{"Unlimited", Pool{Path: "/"}, []Backend{{Addr: "a:80"}, {Addr: "b:80"}}, 0},
+		{"Pool", Pool{Path: "/", MaxRequests: 3, QueueSize: 100}, []Backend{{Addr: "a:80"}, {Addr: "b:80"}}, 3},
+		{"Backends", Pool{Path: "/", QueueSize: 100}, []Backend{{Addr: "a:80", MaxRequests: 1}, {Addr: "b:80", MaxRequests: 1}}, 2},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			p, err := newPool(c.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, b := range c.backends {
+				p.add(b, true)
+			}
+
+			var inFlight, most atomic.Int64
+			var wg sync.WaitGroup
+			for range 50 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					u, full := p.acquire(&Context{Request: &Request{}}, nil)
+					if u == nil || full {
+						t.Error("expected every request to be sent in turn")
+						return
+					}
+
+					n := inFlight.Add(1)
+					for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+					}
+					time.Sleep(time.Millisecond)
+					inFlight.Add(-1)
+					p.release(u)
+				}()
+			}
+			wg.Wait()
+
+			if c.limit > 0 && most.Load() > c.limit {
+				t.Fatalf("expected at most %v requests in flight but got %v", c.limit, most.Load())
+			}
+			if s := p.stats(); s.Active != 0 || s.Queued != 0 || s.Rejected != 0 {
+				t.Fatalf("expected every request to be released but got %+v", s)
+			}
+		})
+	}
+}
+
+func TestPoolReleasesUnusedProbe(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	p, err := newPool(Pool{Path: "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.add(Backend{Addr: "a:80", MaxRequests: 1, BreakerThreshold: 1, BreakerCooldown: time.Second}, true)
+	u := p.members[0]
+
+	u.breaker.failure()
+	now := time.Now().Add(time.Second)
+	var calls atomic.Int32
+	u.breaker.now = func() time.Time {
+		// Another request reaches the member's limit just after the probe is
+		// claimed, before the request is reserved
+		if calls.Add(1) == 2 {
+			u.active.Add(1)
+		}
+		return now
+	}
+
+	if got, full := p.reserve(&Context{Request: &Request{}}, nil); got != nil || !full {
+		t.Fatalf("expected the member to be full but got %v", got)
+	}
+	u.active.Add(-1)
+
+	if got, _ := p.reserve(&Context{Request: &Request{}}, nil); got != u {
+		t.Fatalf("expected the probe to be sent once the member has capacity, but the breaker is %s", u.breaker.health().State)
+	}
+}
@@ -12,12 +12,68 @@ import (
 type Backend struct {
 	Addr string `yaml:"Addr"`
 	Path string `yaml:"Path"`
+	// Match is either prefix (the default), matching Path and everything
+	// below it, or exact
+	Match string `yaml:"Match"`
+	// Protocol is one of http (the default), scgi or uwsgi
+	Protocol string `yaml:"Protocol"`
+	// MaxBufferedBody limits chunked request bodies sent to scgi and uwsgi
+	// backends, which are buffered as the protocols need their length up
+	// front, 8MiB by default. Larger bodies are sent 413.
+	MaxBufferedBody int64 `yaml:"MaxBufferedBody"`
+	// Scheme is http (the default) or https, which is configured by TLS
+	Scheme string      `yaml:"Scheme"`
+	TLS    UpstreamTLS `yaml:"TLS"`
+	// MaxIdleConns and MaxConns size the pool of HTTP connections to the
+	// backend. MaxConns of 0 is unlimited.
+	MaxIdleConns int           `yaml:"MaxIdleConns"`
+	MaxConns     int           `yaml:"MaxConns"`
+	IdleTimeout  time.Duration `yaml:"IdleTimeout"`
+	// MaxRequests limits the requests in flight to the backend, beyond which
+	// its pool queues them. 0 is unlimited.
+	MaxRequests int `yaml:"MaxRequests"`
+	// Weight is used by the weighted, least-connections, random-two-choices
+	// and consistent-hash strategies, defaulting to 1
+	Weight int `yaml:"Weight"`
+	// StripPrefix and AddPrefix are applied to the path before Rewrites.
+	// Location and Set-Cookie paths in responses are mapped back.
+	StripPrefix string    `yaml:"StripPrefix"`
+	AddPrefix   string    `yaml:"AddPrefix"`
+	Rewrites    []Rewrite `yaml:"Rewrites"`
+	// ConnectTimeout defaults to 30s and ResponseHeaderTimeout to 60s. Timeout
+	// limits the whole exchange, including the response body, and is
+	// unlimited by default.
+	ConnectTimeout        time.Duration `yaml:"ConnectTimeout"`
+	ResponseHeaderTimeout time.Duration `yaml:"ResponseHeaderTimeout"`
+	Timeout               time.Duration `yaml:"Timeout"`
+	// BreakerThreshold consecutive errors, timeouts or 5xx responses, 5 by
+	// default, eject the backend for BreakerCooldown, 10s by default. The
+	// cooldown doubles each time the backend fails again once it is over, up
+	// to BreakerMaxCooldown, 5m by default. A negative threshold disables the
+	// breaker.
+	BreakerThreshold   int           `yaml:"BreakerThreshold"`
+	BreakerCooldown    time.Duration `yaml:"BreakerCooldown"`
+	BreakerMaxCooldown time.Duration `yaml:"BreakerMaxCooldown"`
+	// TunnelIdleTimeout closes upgraded connections, such as WebSockets, that
+	// have been idle in both directions for this long, 5m by default. Timeout
+	// does not apply once a connection is upgraded.
+	TunnelIdleTimeout time.Duration `yaml:"TunnelIdleTimeout"`
+	// Resolve looks up the host of Addr with the Resolver of the site, and
+	// adds a member to the pool for every address it resolves to. The host is
+	// looked up again whenever its records expire, adding and removing
+	// members as they change. Only the Backends of a site may be resolved.
+	Resolve bool `yaml:"Resolve"`
+
+	// resolvedFrom is the Addr a member added by Resolve was looked up from
+	resolvedFrom string
 }
 
 func (b Backend) Equals(o Backend) bool {
-	return b.Addr == o.Addr && b.Path == o.Path
+	return b.Addr == o.Addr && b.Path == o.Path && b.Match == o.Match
 }
 
+const healthCheckTimeout = 5 * time.Second
+
 type registrar struct {
 	port               int
 	backingServer      *Server
@@ -29,6 +85,9 @@ type registrar struct {
 
 type healthCheck struct {
 	b Backend
+	// transport is used until b joins a pool, after which checks share the
+	// transport of its member
+	transport http.RoundTripper
 }
 
 type putHandler struct {
@@ -66,22 +125,39 @@ func (p *putHandler) Handle(c *Context) (bool, error) {
 		return true, nil
 	}
 
+	body, err := c.Request.ReadBody()
+	if err != nil {
+		return false, err
+	}
+
 	b := Backend{}
-	err := json.Unmarshal(c.Request.Body, &b)
+	err = json.Unmarshal(body, &b)
 	if err != nil {
 		c.Response = BadRequest()
 		return true, nil
 	}
 
-	h := healthCheck{b}
+	u, err := newUpstream(b)
+	if err != nil {
+		c.Response = BadRequest()
+		return true, nil
+	}
+	defer u.closeIdleConnections()
+
+	h := healthCheck{b, u.transport}
 	healthy, err := checkHealth(h, p.r)
 	if !healthy || err != nil {
 		c.Response = BadRequest()
 		return true, nil
 	}
 
+	err = p.r.backingServer.addBackend(h.b)
+	if err != nil {
+		c.Response = BadRequest()
+		return true, nil
+	}
+
 	p.r.registerCh <- h
-	p.r.backingServer.addBackend(h.b)
 	c.Response = StatusCode(http.StatusNoContent, nil)
 	return true, nil
 }
@@ -137,12 +213,39 @@ func healthCheckLoop(h healthCheck, r *registrar) {
 }
 
 func checkHealth(h healthCheck, r *registrar) (bool, error) {
-	resp, err := http.Get("http://" + h.b.Addr + "/health")
+	transport := h.transport
+	if r != nil {
+		if u := r.backingServer.member(h.b); u != nil {
+			transport = u.transport
+		}
+	}
+
+	// Only connections made for this check alone are closed afterwards
+	owned := transport == nil
+	if owned {
+		tlsConfig, err := newUpstreamTLSConfig(h.b)
+		if err != nil {
+			return false, err
+		}
+
+		transport, err = newTransport(h.b, tlsConfig)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	client := &http.Client{Transport: transport, Timeout: healthCheckTimeout}
+	if owned {
+		defer client.CloseIdleConnections()
+	}
+
+	resp, err := client.Get(backendURL(h.b, "/health"))
 	if err != nil {
 		slog.Debug(fmt.Sprintf("%v is unhealthy: %v", h.b, err))
 		r.unregisterCh <- h
 		return false, err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 && resp.StatusCode >= 300 {
 		slog.Debug(fmt.Sprintf("%v is unhealthy: status code: %v", h.b, resp.StatusCode))
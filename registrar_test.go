@@ -5,7 +5,10 @@ import (
 	"encoding/json"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 )
 
@@ -69,3 +72,37 @@ func TestRegisteringBackend(t *testing.T) {
 		t.Fatalf("expected 200 but got %v", resp.StatusCode)
 	}
 }
+
+func TestHealthCheckSharesMemberTransport(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	var conns atomic.Int32
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	s, url := startServer(t, &Config{Listen: 0, ListenTLS: -1, Registrar: true, RegistrarListen: 0})
+	<-s.registrar.registrationServer.httpListener.readyCh
+
+	b := Backend{Addr: upstream.Listener.Addr().String(), Path: "/"}
+	if err := s.addBackend(b); err != nil {
+		t.Fatal(err)
+	}
+
+	getBody(t, url+"/", nil)
+	for range 3 {
+		healthy, err := checkHealth(healthCheck{b: b}, s.registrar)
+		if !healthy || err != nil {
+			t.Fatalf("expected the backend to be healthy: %v", err)
+		}
+	}
+
+	if n := conns.Load(); n != 1 {
+		t.Fatalf("expected health checks to reuse the pooled connection but got %v connections", n)
+	}
+}
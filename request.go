@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httputil"
 	"strconv"
 	"strings"
 )
@@ -18,6 +20,9 @@ const (
 var errConnectionClosed = errors.New("connection closed")
 var errMalformedRequest = errors.New("malformed request")
 
+// maxLineLength bounds the request line and each header line
+const maxLineLength = 64 * 1024
+
 type Request struct {
 	Scheme  string
 	Host    string
@@ -25,57 +30,31 @@ type Request struct {
 	Path    string
 	Headers map[string][]string
 	Body    []byte
+	// ContentLength is -1 if the body is chunked
+	ContentLength int64
+
+	// body streams the request body from the connection until ReadBody is called
+	body     io.Reader
+	bodyRead bool
 }
 
+// ParseRequest reads the request line and headers from conn. The body is not
+// read up front, handlers stream it with BodyReader or buffer it with ReadBody.
+// Pass the same *bufio.Reader for every request on a connection so that
+// buffered data is not lost between requests.
 func ParseRequest(conn io.Reader, scheme string) (*Request, error) {
-	scanner := bufio.NewScanner(conn)
+	reader := bufio.NewReader(conn)
 	headers := make(map[string][]string)
 	request := &Request{Headers: headers, Scheme: scheme}
-	headersRead := false
-
-	scanLines := func(data []byte, atEOF bool) (advance int, token []byte, err error) {
-		if atEOF && len(data) == 0 {
-			return 0, nil, nil
-		}
-
-		// We've read the headers, so just read all the way to the end for the body
-		if headersRead {
-			i := len(data)
-			return i, dropCR(data[0:i]), nil
-		}
-
-		if i := bytes.IndexByte(data, '\n'); i >= 0 {
-			// If this is a blank new line
-			if len(dropCR(data[0:i])) == 0 {
-				// and it's a GET or HEAD request, we stop parsing the request body
-				if request.Method == RequestGet || request.Method == RequestHead {
-					return 0, nil, bufio.ErrFinalToken
-				}
-				headersRead = true
-			}
-
-			return i + 1, dropCR(data[0:i]), nil
-		}
-
-		// If we're at EOF, we have a final, non-terminated line. Return it.
-		if atEOF {
-			return len(data), dropCR(data), nil
-		}
 
-		// Request more data.
-		return 0, nil, nil
+	controlData, err := readLine(reader)
+	if err == errMalformedRequest {
+		return nil, err
 	}
-
-	scanner.Split(scanLines)
-
-	if !scanner.Scan() {
+	if err != nil && controlData == "" {
 		return nil, errConnectionClosed
 	}
 
-	if scanner.Err() != nil {
-		return nil, scanner.Err()
-	}
-	controlData := scanner.Text()
 	cdTokens := strings.Fields(controlData)
 
 	if len(cdTokens) < 3 {
@@ -86,14 +65,18 @@ func ParseRequest(conn io.Reader, scheme string) (*Request, error) {
 	request.Method, request.Path = cdTokens[0], cdTokens[1]
 
 	// Parse headers
-	for scanner.Scan() && !headersRead {
-		line := scanner.Text()
+	for {
+		line, err := readLine(reader)
+		if err == errMalformedRequest {
+			return nil, err
+		}
 
-		hTokens := strings.Split(line, ":")
-		if len(hTokens) == 0 {
-			continue
+		if line == "" {
+			break
 		}
 
+		hTokens := strings.Split(line, ":")
+
 		hName := hTokens[0]
 		hValue, ok := request.Headers[hName]
 		if !ok {
@@ -108,36 +91,207 @@ func ParseRequest(conn io.Reader, scheme string) (*Request, error) {
 		if hName == HeaderHost {
 			request.Host = hValue[0]
 		}
+
+		if err != nil {
+			break
+		}
 	}
 
-	if request.Method == RequestGet || request.Method == RequestHead {
+	// Every method is framed the same way, so that a body is never read as the
+	// next request on the connection
+	hLength := request.HeaderValues(HeaderContentLength)
+	hEncoding := request.HeaderValues(HeaderTransferEncoding)
+	if len(hEncoding) > 0 {
+		codings := strings.Split(strings.Join(hEncoding, ","), ",")
+		if len(hLength) > 0 || !strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			return nil, errMalformedRequest
+		}
+
+		request.ContentLength = -1
+		request.body = &chunkedBody{reader: reader, chunked: httputil.NewChunkedReader(reader)}
 		return request, nil
 	}
 
-	hLength, ok := request.Headers[HeaderContentLength]
-	if !ok || len(hLength) == 0 {
+	if len(hLength) == 0 {
 		return request, nil
 	}
 
-	remaining, err := strconv.Atoi(hLength[0])
-	if err != nil {
+	// Repeated lengths, even equal ones, are as ambiguous as conflicting ones
+	if len(hLength) > 1 || strings.Contains(hLength[0], ",") {
 		return nil, errMalformedRequest
 	}
 
-	// Parse request body
-	for remaining > 0 && scanner.Scan() {
-		b := scanner.Bytes()
-		remaining -= len(b)
-		request.Body = append(request.Body, b...)
+	remaining, err := strconv.ParseInt(hLength[0], 10, 64)
+	if err != nil || remaining < 0 {
+		return nil, errMalformedRequest
 	}
 
+	request.ContentLength = remaining
+	request.body = io.LimitReader(reader, remaining)
 	return request, nil
 }
 
+// BodyReader streams the request body. If the body has already been buffered by
+// ReadBody, it is read from Body instead.
+func (r *Request) BodyReader() io.Reader {
+	if r.bodyRead {
+		return bytes.NewReader(r.Body)
+	}
+
+	if r.body == nil || r.ContentLength == 0 {
+		return http.NoBody
+	}
+
+	return r.body
+}
+
+// ReadBody buffers the rest of the request body into Body.
+func (r *Request) ReadBody() ([]byte, error) {
+	if r.bodyRead || r.body == nil {
+		return r.Body, nil
+	}
+
+	b, err := io.ReadAll(r.body)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Body = append(r.Body, b...)
+	r.bodyRead = true
+	return r.Body, nil
+}
+
+// bufferBody reads up to limit bytes of the body into Body, reporting whether
+// that was all of it. Either way, BodyReader still returns the whole body.
+func (r *Request) bufferBody(limit int64) ([]byte, bool, error) {
+	if r.bodyRead || r.body == nil || r.ContentLength == 0 {
+		return r.Body, true, nil
+	}
+
+	if r.ContentLength > limit {
+		return nil, false, nil
+	}
+
+	b, err := io.ReadAll(io.LimitReader(r.body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if int64(len(b)) > limit {
+		r.body = io.MultiReader(bytes.NewReader(b), r.body)
+		return nil, false, nil
+	}
+
+	r.Body = append(r.Body, b...)
+	r.bodyRead = true
+	return r.Body, true, nil
+}
+
+// discardBody reads any of the body a handler left unread, so the connection is
+// positioned at the start of the next request.
+func (r *Request) discardBody() error {
+	if r.bodyRead || r.body == nil {
+		return nil
+	}
+
+	_, err := io.Copy(io.Discard, r.body)
+	return err
+}
+
+// Header returns the first value of the named header, which is matched case
+// insensitively.
+func (r Request) Header(name string) string {
+	vs := r.HeaderValues(name)
+	if len(vs) == 0 {
+		return ""
+	}
+	return vs[0]
+}
+
+// Cookie returns the value of the named cookie, or "" if it was not sent.
+func (r Request) Cookie(name string) string {
+	hr := &http.Request{Header: http.Header{HeaderCookie: r.HeaderValues(HeaderCookie)}}
+	if cookie, err := hr.Cookie(name); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// HeaderValues returns every value of the named header, which is matched case
+// insensitively.
+func (r Request) HeaderValues(name string) []string {
+	if vs, ok := r.Headers[name]; ok {
+		return vs
+	}
+
+	var values []string
+	for k, vs := range r.Headers {
+		if strings.EqualFold(k, name) {
+			values = append(values, vs...)
+		}
+	}
+	return values
+}
+
+// Query returns the raw query string of the request target.
+func (r Request) Query() string {
+	_, q, _ := strings.Cut(r.Path, "?")
+	return q
+}
+
+// chunkedBody decodes a chunked body, then consumes the trailer once the last
+// chunk has been read.
+type chunkedBody struct {
+	reader  *bufio.Reader
+	chunked io.Reader
+	done    bool
+}
+
+func (b *chunkedBody) Read(p []byte) (int, error) {
+	if b.done {
+		return 0, io.EOF
+	}
+
+	n, err := b.chunked.Read(p)
+	if err == io.EOF {
+		b.done = true
+		for {
+			line, lerr := readLine(b.reader)
+			if lerr != nil && lerr != io.EOF {
+				return n, lerr
+			}
+			if line == "" {
+				break
+			}
+		}
+	}
+	return n, err
+}
+
 func (r Request) String() string {
 	return fmt.Sprintf("%s %s", r.Method, r.Path)
 }
 
+// readLine reads a line without its line ending. A final line without a line
+// ending is returned along with io.EOF.
+func readLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		b, err := reader.ReadSlice('\n')
+		line = append(line, b...)
+		if len(line) > maxLineLength {
+			return "", errMalformedRequest
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		return string(dropCR(line)), err
+	}
+}
+
 func dropCR(data []byte) []byte {
 	if len(data) > 0 && data[len(data)-1] == '\r' {
 		return data[0 : len(data)-1]
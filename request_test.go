@@ -1,6 +1,7 @@
 package butler
 
 import (
+	"bufio"
 	"strings"
 	"testing"
 )
@@ -39,3 +40,86 @@ Ignored body
 		t.Fatal("request should not have read body")
 	}
 }
+
+func TestParseRequestBody(t *testing.T) {
+	cases := []struct {
+		r string
+		b string
+		n string
+	}{
+		{
+			r: "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello world",
+			b: "hello",
+			n: "ContentLength",
+		},
+		{
+			r: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n",
+			b: "hello world",
+			n: "Chunked",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			r, err := ParseRequest(strings.NewReader(c.r), "http")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := r.ReadBody()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(b) != c.b {
+				t.Fatalf("expected body %q but got %q", c.b, b)
+			}
+		})
+	}
+}
+
+func TestParsePipelinedRequests(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("POST /a HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"3\r\nabc\r\n0\r\nX-Trailer: 1\r\n\r\n" +
+		"POST /b HTTP/1.1\r\nContent-Length: 3\r\n\r\nxyz" +
+		"GET /c HTTP/1.1\r\ncontent-length: 24\r\n\r\nGET /smuggled HTTP/1.1\r\n" +
+		"HEAD /d HTTP/1.1\r\n\r\n"))
+
+	for _, p := range []string{"/a", "/b", "/c", "/d"} {
+		r, err := ParseRequest(reader, "http")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.Path != p {
+			t.Fatalf("expected %v but got %v", p, r.Path)
+		}
+
+		// Leave the body unread, as a handler that ignores it would
+		if err := r.discardBody(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParseRequestFraming(t *testing.T) {
+	cases := []struct {
+		n string
+		r string
+	}{
+		{"ConflictingLengths", "POST / HTTP/1.1\r\nContent-Length: 3\r\nContent-Length: 5\r\n\r\nhello"},
+		{"RepeatedLengths", "POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello"},
+		{"LengthList", "POST / HTTP/1.1\r\nContent-Length: 5, 5\r\n\r\nhello"},
+		{"LengthAndChunked", "POST / HTTP/1.1\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"},
+		{"NotChunked", "POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\nhello"},
+		{"InvalidLength", "GET / HTTP/1.1\r\nContent-Length: -1\r\n\r\n"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			if _, err := ParseRequest(strings.NewReader(c.r), "http"); err != errMalformedRequest {
+				t.Fatalf("expected the request to be rejected but got %v", err)
+			}
+		})
+	}
+}
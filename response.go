@@ -1,11 +1,14 @@
 package butler
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/http/httputil"
 	"strconv"
 )
 
@@ -14,6 +17,8 @@ type Response struct {
 	StatusCode  int
 	Headers     map[string][]string
 	Content     []byte
+	// Body is streamed to the client instead of Content if it is set
+	Body io.ReadCloser
 }
 
 func Ok(content []byte) *Response {
@@ -34,11 +39,34 @@ func MovedPermanently(location string) *Response {
 	return r
 }
 
+func Found(location string) *Response {
+	msg := fmt.Sprintf("%v %v", http.StatusFound, "Found")
+	r := StatusCode(http.StatusFound, fmt.Appendf(nil, hTemplate, msg, msg))
+
+	r.Headers[HeaderLocation] = []string{location}
+	return r
+}
+
+func InternalServerError() *Response {
+	msg := fmt.Sprintf("%v %v", http.StatusInternalServerError, "Internal Server Error")
+	return StatusCode(http.StatusInternalServerError, fmt.Appendf(nil, hTemplate, msg, msg))
+}
+
 func BadGateway() *Response {
 	msg := fmt.Sprintf("%v %v", http.StatusBadGateway, "Bad Gateway")
 	return StatusCode(http.StatusBadGateway, fmt.Appendf(nil, hTemplate, msg, msg))
 }
 
+func ServiceUnavailable() *Response {
+	msg := fmt.Sprintf("%v %v", http.StatusServiceUnavailable, "Service Unavailable")
+	return StatusCode(http.StatusServiceUnavailable, fmt.Appendf(nil, hTemplate, msg, msg))
+}
+
+func GatewayTimeout() *Response {
+	msg := fmt.Sprintf("%v %v", http.StatusGatewayTimeout, "Gateway Timeout")
+	return StatusCode(http.StatusGatewayTimeout, fmt.Appendf(nil, hTemplate, msg, msg))
+}
+
 func UnsupportedMediaType() *Response {
 	msg := fmt.Sprintf("%v %v", http.StatusUnsupportedMediaType, "Unsupported Media Type")
 	return StatusCode(http.StatusUnsupportedMediaType, fmt.Appendf(nil, hTemplate, msg, msg))
@@ -49,13 +77,49 @@ func BadRequest() *Response {
 	return StatusCode(http.StatusBadRequest, fmt.Appendf(nil, hTemplate, msg, msg))
 }
 
+func Unauthorized() *Response {
+	msg := fmt.Sprintf("%v %v", http.StatusUnauthorized, "Unauthorized")
+	return StatusCode(http.StatusUnauthorized, fmt.Appendf(nil, hTemplate, msg, msg))
+}
+
+func Forbidden() *Response {
+	msg := fmt.Sprintf("%v %v", http.StatusForbidden, "Forbidden")
+	return StatusCode(http.StatusForbidden, fmt.Appendf(nil, hTemplate, msg, msg))
+}
+
+func MethodNotAllowed() *Response {
+	msg := fmt.Sprintf("%v %v", http.StatusMethodNotAllowed, "Method Not Allowed")
+	return StatusCode(http.StatusMethodNotAllowed, fmt.Appendf(nil, hTemplate, msg, msg))
+}
+
+func Conflict() *Response {
+	msg := fmt.Sprintf("%v %v", http.StatusConflict, "Conflict")
+	return StatusCode(http.StatusConflict, fmt.Appendf(nil, hTemplate, msg, msg))
+}
+
+func RequestEntityTooLarge() *Response {
+	msg := fmt.Sprintf("%v %v", http.StatusRequestEntityTooLarge, "Request Entity Too Large")
+	return StatusCode(http.StatusRequestEntityTooLarge, fmt.Appendf(nil, hTemplate, msg, msg))
+}
+
 func NotFound() *Response {
 	msg := fmt.Sprintf("%v %v", http.StatusNotFound, "Not Found")
 	return StatusCode(http.StatusNotFound, fmt.Appendf(nil, hTemplate, msg, msg))
 }
 
 func StatusCode(statusCode int, content []byte) *Response {
-	return &Response{"HTTP/1.1", statusCode, make(map[string][]string), content}
+	return &Response{"HTTP/1.1", statusCode, make(map[string][]string), content, nil}
+}
+
+// Stream returns a response that streams body to the client. If contentLength
+// is negative, the body is sent with chunked transfer encoding.
+func Stream(statusCode int, body io.ReadCloser, contentLength int64) *Response {
+	r := StatusCode(statusCode, nil)
+	r.Body = body
+	if contentLength >= 0 {
+		r.Headers[HeaderContentLength] = []string{strconv.FormatInt(contentLength, 10)}
+	}
+	return r
 }
 
 func (r Response) Bytes(compressGzip bool, headersOnly bool) []byte {
@@ -81,7 +145,7 @@ func (r Response) Bytes(compressGzip bool, headersOnly bool) []byte {
 
 	statusCode := fmt.Sprintf("%s %d %s\n", r.HttpVersion, r.StatusCode, http.StatusText(r.StatusCode))
 
-	if rLength > 0 {
+	if rLength > 0 || r.StatusCode >= 200 && r.StatusCode != http.StatusNoContent && r.StatusCode != http.StatusNotModified {
 		r.Headers[HeaderContentLength] = []string{strconv.Itoa(rLength)}
 	}
 
@@ -103,6 +167,86 @@ func (r Response) Bytes(compressGzip bool, headersOnly bool) []byte {
 	return b
 }
 
+// Write writes the response to w, streaming Body if it is set.
+func (r Response) Write(w io.Writer, compressGzip bool, headersOnly bool) (int64, error) {
+	if r.Body == nil {
+		n, err := w.Write(r.Bytes(compressGzip, headersOnly))
+		return int64(n), err
+	}
+	defer r.Body.Close()
+
+	hasBody := r.StatusCode >= 200 && r.StatusCode != http.StatusNoContent && r.StatusCode != http.StatusNotModified
+	if compressGzip && hasBody {
+		delete(r.Headers, HeaderContentLength)
+		r.Headers[HeaderContentEncoding] = []string{"gzip"}
+	}
+
+	chunked := hasBody && len(r.Headers[HeaderContentLength]) == 0
+	if chunked {
+		r.Headers[HeaderTransferEncoding] = []string{"chunked"}
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s %d %s\n", r.HttpVersion, r.StatusCode, http.StatusText(r.StatusCode))
+	bw.Write(r.headerBytes())
+	bw.WriteString("\n")
+
+	if headersOnly || !hasBody {
+		return int64(bw.Buffered()), bw.Flush()
+	}
+
+	var body io.Writer = bw
+	var chunkedWriter io.WriteCloser
+	if chunked {
+		chunkedWriter = httputil.NewChunkedWriter(bw)
+		body = chunkedWriter
+	}
+
+	var gzipWriter *gzip.Writer
+	if compressGzip {
+		gzipWriter = gzip.NewWriter(body)
+		body = gzipWriter
+	}
+
+	written := int64(bw.Buffered())
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Body.Read(buf)
+		if n > 0 {
+			if _, werr := body.Write(buf[:n]); werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+
+			// Flush as data arrives, so that slow upstreams stream to the client
+			if gzipWriter != nil {
+				gzipWriter.Flush()
+			}
+			if werr := bw.Flush(); werr != nil {
+				return written, werr
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+
+	if gzipWriter != nil {
+		gzipWriter.Close()
+	}
+
+	if chunkedWriter != nil {
+		chunkedWriter.Close()
+		bw.WriteString("\r\n")
+	}
+
+	return written, bw.Flush()
+}
+
 func (r Response) headerBytes() []byte {
 	b := []byte{}
 	for k, vs := range r.Headers {
@@ -0,0 +1,131 @@
+package butler
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Rewrite replaces matches of Regex in the path and query of a proxied request
+// with Replacement, which may refer to submatches as $1 or ${name}.
+type Rewrite struct {
+	Regex       string `yaml:"Regex"`
+	Replacement string `yaml:"Replacement"`
+}
+
+// rewriter maps request targets from the client's view of a backend to the
+// backend's own, and maps paths in responses back again. Regex rewrites are
+// not reversible, so only the prefixes are mapped back.
+type rewriter struct {
+	stripPrefix string
+	addPrefix   string
+	rewrites    []compiledRewrite
+}
+
+type compiledRewrite struct {
+	regex       *regexp.Regexp
+	replacement string
+}
+
+func newRewriter(b Backend) (*rewriter, error) {
+	rw := &rewriter{
+		stripPrefix: trimPrefixPath(b.StripPrefix),
+		addPrefix:   trimPrefixPath(b.AddPrefix),
+	}
+
+	for _, r := range b.Rewrites {
+		re, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return nil, err
+		}
+		rw.rewrites = append(rw.rewrites, compiledRewrite{re, r.Replacement})
+	}
+
+	return rw, nil
+}
+
+// trimPrefixPath normalises a prefix to start with a slash and not end with
+// one, so that "/" and "" are both no prefix at all.
+func trimPrefixPath(p string) string {
+	if p == "" {
+		return ""
+	}
+	return strings.TrimSuffix(cleanRoutePath(p), "/")
+}
+
+// request rewrites the request target, which is a path and optional query.
+func (rw *rewriter) request(target string) string {
+	p, query, hasQuery := strings.Cut(target, "?")
+
+	if rw.stripPrefix != "" && hasPathPrefix(p, rw.stripPrefix) {
+		p = strings.TrimPrefix(p, rw.stripPrefix)
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+	}
+	p = rw.addPrefix + p
+
+	target = p
+	if hasQuery {
+		target += "?" + query
+	}
+
+	for _, r := range rw.rewrites {
+		target = r.regex.ReplaceAllString(target, r.replacement)
+	}
+	return target
+}
+
+// path maps a path on the backend back to the path the client would use.
+func (rw *rewriter) path(p string) string {
+	if rw.addPrefix != "" {
+		if !hasPathPrefix(p, rw.addPrefix) {
+			return p
+		}
+		p = strings.TrimPrefix(p, rw.addPrefix)
+		if p == "" {
+			p = "/"
+		}
+	}
+	return rw.stripPrefix + p
+}
+
+// location maps a Location header back. Absolute URLs pointing at the backend
+// are made to point at host, the address the client used.
+func (rw *rewriter) location(location string, backendAddr string, scheme string, host string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+
+	if u.IsAbs() {
+		if u.Host != backendAddr {
+			return location
+		}
+		u.Scheme, u.Host = scheme, host
+	} else if u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		// Relative references resolve against the rewritten path already
+		return location
+	}
+
+	u.Path = rw.path(u.Path)
+	u.RawPath = ""
+	return u.String()
+}
+
+// setCookie maps the Path attribute of a Set-Cookie header back.
+func (rw *rewriter) setCookie(cookie string) string {
+	attrs := strings.Split(cookie, ";")
+	for i, attr := range attrs {
+		name, value, ok := strings.Cut(strings.TrimSpace(attr), "=")
+		if ok && strings.EqualFold(name, "Path") && strings.HasPrefix(value, "/") {
+			attrs[i] = " " + name + "=" + rw.path(value)
+		}
+	}
+	return strings.Join(attrs, ";")
+}
+
+// isZero reports whether the rewriter leaves requests as they are.
+func (rw *rewriter) isZero() bool {
+	return rw.stripPrefix == "" && rw.addPrefix == "" && len(rw.rewrites) == 0
+}
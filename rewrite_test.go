@@ -0,0 +1,126 @@
+package butler
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRewriterRequest(t *testing.T) {
+	cases := []struct {
+		n        string
+		b        Backend
+		target   string
+		expected string
+	}{
+		{"None", Backend{}, "/ui/app.js?v=1", "/ui/app.js?v=1"},
+		{"Strip", Backend{StripPrefix: "/ui"}, "/ui/app.js?v=1", "/app.js?v=1"},
+		{"StripTrailingSlash", Backend{StripPrefix: "/ui/"}, "/ui/app.js", "/app.js"},
+		{"StripAll", Backend{StripPrefix: "/ui"}, "/ui", "/"},
+		{"StripSegments", Backend{StripPrefix: "/ui"}, "/uiadmin", "/uiadmin"},
+		{"Add", Backend{AddPrefix: "/v1"}, "/users?page=2", "/v1/users?page=2"},
+		{"StripAndAdd", Backend{StripPrefix: "/api", AddPrefix: "/internal/v2"}, "/api/users", "/internal/v2/users"},
+		{"Regex", Backend{Rewrites: []Rewrite{{`^/users/([0-9]+)$`, "/user?id=$1"}}}, "/users/42", "/user?id=42"},
+		{"RegexQuery", Backend{Rewrites: []Rewrite{{`([?&])token=[^&]*&?`, "$1"}}}, "/a?token=x&b=1", "/a?b=1"},
+		{"RegexAfterStrip", Backend{StripPrefix: "/ui", Rewrites: []Rewrite{{`\.htm$`, ".html"}}}, "/ui/index.htm", "/index.html"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			rw, err := newRewriter(c.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rw.request(c.target); got != c.expected {
+				t.Fatalf("expected %s but got %s", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestRewriterResponse(t *testing.T) {
+	rw, err := newRewriter(Backend{StripPrefix: "/ui", AddPrefix: "/app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locations := []struct {
+		n        string
+		location string
+		expected string
+	}{
+		{"Path", "/app/login?next=%2F", "/ui/login?next=%2F"},
+		{"Root", "/app", "/ui/"},
+		{"OutsidePrefix", "/other", "/other"},
+		{"Backend", "http://10.0.0.1:3000/app/login", "https://example.com/ui/login"},
+		{"Elsewhere", "https://auth.example.com/app/login", "https://auth.example.com/app/login"},
+		{"Relative", "login", "login"},
+	}
+
+	for _, c := range locations {
+		t.Run(c.n, func(t *testing.T) {
+			if got := rw.location(c.location, "10.0.0.1:3000", "https", "example.com"); got != c.expected {
+				t.Fatalf("expected %s but got %s", c.expected, got)
+			}
+		})
+	}
+
+	cookie := rw.setCookie("session=abc; path=/app/account; HttpOnly")
+	if cookie != "session=abc; path=/ui/account; HttpOnly" {
+		t.Fatalf("unexpected cookie %s", cookie)
+	}
+}
+
+func TestBackendRewrites(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+			http.Redirect(w, r, "/home", http.StatusFound)
+			return
+		}
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer upstream.Close()
+
+	proxy := startProxy(t, Backend{
+		Addr:        upstream.Listener.Addr().String(),
+		Path:        "/ui",
+		StripPrefix: "/ui",
+		Rewrites:    []Rewrite{{`^/legacy/(.*)$`, "/$1"}},
+	})
+
+	if got := getBody(t, proxy+"/ui/legacy/page?a=1", nil); got != "/page?a=1" {
+		t.Fatalf("expected rewritten target but got %s", got)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(proxy + "/ui/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if location := resp.Header.Get("Location"); location != "/ui/home" {
+		t.Fatalf("expected Location /ui/home but got %s", location)
+	}
+	if cookie := resp.Header.Get("Set-Cookie"); cookie != "session=abc; Path=/ui/" {
+		t.Fatalf("expected cookie path /ui/ but got %s", cookie)
+	}
+}
+
+func TestBackendInvalidRewrite(t *testing.T) {
+	_, err := NewServer(&Config{
+		Listen:    0,
+		ListenTLS: -1,
+		Backends:  []Backend{{Addr: "localhost:1", Path: "/", Rewrites: []Rewrite{{Regex: "("}}}},
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
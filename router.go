@@ -0,0 +1,237 @@
+package butler
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	MatchPrefix = "prefix"
+	MatchExact  = "exact"
+)
+
+// route identifies where a pool is mounted. Prefix routes match their path and
+// everything below it, exact routes match only their path.
+type route struct {
+	path  string
+	exact bool
+}
+
+func newRoute(p string, match string) (route, error) {
+	switch match {
+	case "", MatchPrefix:
+		return route{cleanRoutePath(p), false}, nil
+	case MatchExact:
+		return route{cleanRoutePath(p), true}, nil
+	}
+
+	return route{}, fmt.Errorf("route %s: unknown match %s", p, match)
+}
+
+func cleanRoutePath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// pathSegments splits p into its segments, so that routes only ever match
+// whole segments.
+func pathSegments(p string) []string {
+	p = cleanRoutePath(p)
+	if p == "/" {
+		return nil
+	}
+	return strings.Split(p[1:], "/")
+}
+
+// router is a radix tree of path segments, mapping routes to pools. Lookups
+// pick the longest matching route, preferring an exact route over a prefix
+// route with the same path.
+type router struct {
+	mu   sync.RWMutex
+	root *routeNode
+}
+
+type routeNode struct {
+	// segments is the label of the edge from the parent
+	segments []string
+	// children are keyed by the first segment of their label
+	children map[string]*routeNode
+	exact    *pool
+	prefix   *pool
+}
+
+func newRouter() *router {
+	return &router{root: &routeNode{}}
+}
+
+// lookup returns the pool of the longest route matching the request path p,
+// or nil if no route matches.
+func (rt *router) lookup(p string) *pool {
+	p, _, _ = strings.Cut(p, "?")
+	segments := pathSegments(p)
+
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	n := rt.root
+	var best *pool
+	for {
+		if n.prefix != nil {
+			best = n.prefix
+		}
+
+		if len(segments) == 0 {
+			if n.exact != nil {
+				return n.exact
+			}
+			return best
+		}
+
+		child, ok := n.children[segments[0]]
+		if !ok || !hasSegmentPrefix(segments, child.segments) {
+			return best
+		}
+
+		segments = segments[len(child.segments):]
+		n = child
+	}
+}
+
+// get returns the pool mounted at r, or nil if there is none.
+func (rt *router) get(r route) *pool {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	n := rt.root
+	segments := pathSegments(r.path)
+	for len(segments) > 0 {
+		child, ok := n.children[segments[0]]
+		if !ok || !hasSegmentPrefix(segments, child.segments) {
+			return nil
+		}
+
+		segments = segments[len(child.segments):]
+		n = child
+	}
+
+	if r.exact {
+		return n.exact
+	}
+	return n.prefix
+}
+
+// all returns every mounted pool.
+func (rt *router) all() []*pool {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	var pools []*pool
+	var walk func(n *routeNode)
+	walk = func(n *routeNode) {
+		for _, p := range []*pool{n.exact, n.prefix} {
+			if p != nil {
+				pools = append(pools, p)
+			}
+		}
+		for _, child := range n.children {
+			walk(child)
+		}
+	}
+	walk(rt.root)
+	return pools
+}
+
+// insert mounts p at r, replacing any pool already there.
+func (rt *router) insert(r route, p *pool) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	n := rt.root
+	segments := pathSegments(r.path)
+	for len(segments) > 0 {
+		child, ok := n.children[segments[0]]
+		if !ok {
+			child = &routeNode{segments: segments}
+			if n.children == nil {
+				n.children = make(map[string]*routeNode)
+			}
+			n.children[segments[0]] = child
+			n = child
+			break
+		}
+
+		common := commonSegments(segments, child.segments)
+		if common < len(child.segments) {
+			// Split the edge, so that the common segments lead to a new node
+			split := &routeNode{
+				segments: child.segments[:common],
+				children: map[string]*routeNode{child.segments[common]: child},
+			}
+			child.segments = child.segments[common:]
+			n.children[segments[0]] = split
+			child = split
+		}
+
+		segments = segments[common:]
+		n = child
+	}
+
+	if r.exact {
+		n.exact = p
+	} else {
+		n.prefix = p
+	}
+}
+
+// remove unmounts the pool at r, merging nodes that are no longer needed.
+func (rt *router) remove(r route) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	rt.root.remove(pathSegments(r.path), r.exact)
+}
+
+func (n *routeNode) remove(segments []string, exact bool) {
+	if len(segments) == 0 {
+		if exact {
+			n.exact = nil
+		} else {
+			n.prefix = nil
+		}
+		return
+	}
+
+	child, ok := n.children[segments[0]]
+	if !ok || !hasSegmentPrefix(segments, child.segments) {
+		return
+	}
+	child.remove(segments[len(child.segments):], exact)
+
+	if child.exact != nil || child.prefix != nil {
+		return
+	}
+
+	switch len(child.children) {
+	case 0:
+		delete(n.children, segments[0])
+	case 1:
+		for _, grandchild := range child.children {
+			grandchild.segments = append(slices.Clone(child.segments), grandchild.segments...)
+			n.children[segments[0]] = grandchild
+		}
+	}
+}
+
+func hasSegmentPrefix(segments []string, prefix []string) bool {
+	return len(segments) >= len(prefix) && slices.Equal(segments[:len(prefix)], prefix)
+}
+
+func commonSegments(a []string, b []string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
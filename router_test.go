@@ -0,0 +1,147 @@
+package butler
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"testing"
+)
+
+func TestRouterLookup(t *testing.T) {
+	pools := map[string]*pool{}
+	rt := newRouter()
+	for _, r := range []route{
+		{"/", false},
+		{"/ui", false},
+		{"/ui/admin", false},
+		{"/api/v1", false},
+		{"/api/v1/health", true},
+		{"/api/v2/users", false},
+		{"/status", true},
+	} {
+		p := &pool{config: Pool{Path: r.path}}
+		pools[fmt.Sprint(r)] = p
+		rt.insert(r, p)
+	}
+
+	cases := []struct {
+		n        string
+		path     string
+		expected route
+	}{
+		{"Root", "/", route{"/", false}},
+		{"Prefix", "/ui", route{"/ui", false}},
+		{"BelowPrefix", "/ui/app.js", route{"/ui", false}},
+		{"WholeSegments", "/uiadmin", route{"/", false}},
+		{"Longest", "/ui/admin/users", route{"/ui/admin", false}},
+		{"TrailingSlash", "/ui/admin/", route{"/ui/admin", false}},
+		{"Query", "/ui/admin?page=2", route{"/ui/admin", false}},
+		{"Exact", "/api/v1/health", route{"/api/v1/health", true}},
+		{"BelowExact", "/api/v1/health/db", route{"/api/v1", false}},
+		{"SplitEdge", "/api/v2", route{"/", false}},
+		{"BelowSplitEdge", "/api/v2/users/1", route{"/api/v2/users", false}},
+		{"ExactOnly", "/status/1", route{"/", false}},
+		{"DotDot", "/ui/../api/v1/x", route{"/api/v1", false}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			if p := rt.lookup(c.path); p != pools[fmt.Sprint(c.expected)] {
+				t.Fatalf("expected %v but got %v", c.expected, p)
+			}
+		})
+	}
+}
+
+func TestRouterRemove(t *testing.T) {
+	rt := newRouter()
+	a := &pool{config: Pool{Path: "/a/b"}}
+	c := &pool{config: Pool{Path: "/a/b/c/d"}}
+	e := &pool{config: Pool{Path: "/a/b/e"}}
+	rt.insert(route{"/a/b", false}, a)
+	rt.insert(route{"/a/b/c/d", false}, c)
+	rt.insert(route{"/a/b/e", true}, e)
+
+	rt.remove(route{"/a/b", false})
+	if p := rt.lookup("/a/b/x"); p != nil {
+		t.Fatalf("expected no route but got %v", p.config.Path)
+	}
+	if p := rt.lookup("/a/b/c/d/x"); p != c {
+		t.Fatal("expected /a/b/c/d to survive the removal of its parent")
+	}
+
+	rt.remove(route{"/a/b/e", true})
+	if len(rt.root.children) != 1 || len(rt.root.children["a"].segments) != 4 {
+		t.Fatal("expected the remaining route to be merged into one edge")
+	}
+	if p := rt.lookup("/a/b/c/d"); p != c {
+		t.Fatal("expected /a/b/c/d to match after merging")
+	}
+
+	rt.remove(route{"/a/b/c/d", false})
+	if len(rt.root.children) != 0 {
+		t.Fatal("expected an empty tree")
+	}
+}
+
+func TestRouterManyRoutes(t *testing.T) {
+	rt := newRouter()
+	for i := range 5000 {
+		rt.insert(route{fmt.Sprintf("/tenants/%d/api", i), false}, &pool{config: Pool{Path: fmt.Sprint(i)}})
+	}
+
+	for _, i := range []int{0, 1234, 4999} {
+		p := rt.lookup(fmt.Sprintf("/tenants/%d/api/users", i))
+		if p == nil || p.config.Path != fmt.Sprint(i) {
+			t.Fatalf("expected route %d but got %v", i, p)
+		}
+	}
+
+	if p := rt.lookup("/tenants/5000/api"); p != nil {
+		t.Fatalf("expected no route but got %v", p.config.Path)
+	}
+}
+
+func BenchmarkRouterLookup(b *testing.B) {
+	rt := newRouter()
+	for i := range 5000 {
+		rt.insert(route{fmt.Sprintf("/tenants/%d/api", i), false}, &pool{})
+	}
+
+	for b.Loop() {
+		rt.lookup("/tenants/4321/api/users/1")
+	}
+}
+
+func TestBackendMostSpecificRouteWins(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	root := startNamedUpstream(t, "root")
+	ui := startNamedUpstream(t, "ui")
+	health := startNamedUpstream(t, "health")
+
+	proxy := startProxy(t,
+		Backend{Addr: root, Path: "/"},
+		Backend{Addr: ui, Path: "/ui"},
+		Backend{Addr: health, Path: "/ui/health", Match: MatchExact},
+	)
+
+	cases := []struct {
+		path     string
+		expected string
+	}{
+		{"/ui", "ui"},
+		{"/ui/index.html", "ui"},
+		{"/uiadmin", "root"},
+		{"/ui/health", "health"},
+		{"/ui/health/db", "ui"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			if got := getBody(t, proxy+c.path, nil); got != c.expected {
+				t.Fatalf("expected %s but got %s", c.expected, got)
+			}
+		})
+	}
+}
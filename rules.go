@@ -0,0 +1,378 @@
+package butler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Rule sends the requests matching Match to exactly one of Backends, Split,
+// Root, Redirect or Respond. Rules are evaluated before any other handler of
+// a site, highest Priority first, and in the order they are configured when
+// Priority is the same.
+type Rule struct {
+	Name     string  `yaml:"Name"`
+	Priority int     `yaml:"Priority"`
+	Match    Matcher `yaml:"Match"`
+
+	// Backends are balanced by Strategy, HashKey and Sticky, and copied to
+	// Mirror, as in a Pool
+	Backends []Backend `yaml:"Backends"`
+	Strategy string    `yaml:"Strategy"`
+	HashKey  string    `yaml:"HashKey"`
+	Mirror   *Mirror   `yaml:"Mirror"`
+	Sticky   *Sticky   `yaml:"Sticky"`
+
+	Split *Split `yaml:"Split"`
+
+	// Root serves static files
+	Root string `yaml:"Root"`
+
+	Redirect  string `yaml:"Redirect"`
+	Permanent bool   `yaml:"Permanent"`
+
+	Respond *FixedResponse `yaml:"Respond"`
+}
+
+// Matcher matches requests. Every condition that is set must match, so an
+// empty Matcher matches every request. Conditions are combined with AND
+// through All and with OR through Any.
+type Matcher struct {
+	// Host is a host name, or a wildcard such as *.example.com
+	Host    string   `yaml:"Host"`
+	Methods []string `yaml:"Methods"`
+	// Path matches the path and everything below it, by whole segments
+	Path      string         `yaml:"Path"`
+	PathRegex string         `yaml:"PathRegex"`
+	Headers   []ValueMatcher `yaml:"Headers"`
+	Query     []ValueMatcher `yaml:"Query"`
+	All       []Matcher      `yaml:"All"`
+	Any       []Matcher      `yaml:"Any"`
+}
+
+// ValueMatcher matches a header or query parameter by Value or Regex, or by
+// its presence if neither is set.
+type ValueMatcher struct {
+	Name  string `yaml:"Name"`
+	Value string `yaml:"Value"`
+	Regex string `yaml:"Regex"`
+}
+
+type FixedResponse struct {
+	Status  int               `yaml:"Status"`
+	Body    string            `yaml:"Body"`
+	Headers map[string]string `yaml:"Headers"`
+}
+
+type rule struct {
+	name    string
+	matcher matcher
+	handler handler
+}
+
+type matcher struct {
+	host      string
+	methods   []string
+	path      string
+	pathRegex *regexp.Regexp
+	headers   []valueMatcher
+	query     []valueMatcher
+	all       []matcher
+	any       []matcher
+}
+
+type valueMatcher struct {
+	name  string
+	value string
+	regex *regexp.Regexp
+}
+
+func newRule(r Rule, fwd *forwarding) (rule, error) {
+	m, err := newMatcher(r.Match)
+	if err != nil {
+		return rule{}, fmt.Errorf("rule %s: %w", r.Name, err)
+	}
+
+	actions := 0
+	var h handler
+	if len(r.Backends) > 0 {
+		actions++
+		p, err := newRulePool(r.Name, r.Backends, Pool{Strategy: r.Strategy, HashKey: r.HashKey, Mirror: r.Mirror, Sticky: r.Sticky})
+		if err != nil {
+			return rule{}, fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+		h = poolHandler{p, fwd}
+	}
+
+	if r.Split != nil {
+		actions++
+		sp, err := newSplit(r.Name, *r.Split, fwd)
+		if err != nil {
+			return rule{}, fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+		h = sp
+	}
+
+	if r.Root != "" {
+		actions++
+		h = documentRootHandler{r.Root}
+	}
+
+	if r.Redirect != "" {
+		actions++
+		h = ruleRedirectHandler{Redirect{Location: r.Redirect, Permanent: r.Permanent}}
+	}
+
+	if r.Respond != nil {
+		actions++
+		if r.Respond.Status < 100 || r.Respond.Status > 599 {
+			return rule{}, fmt.Errorf("rule %s: invalid status %d", r.Name, r.Respond.Status)
+		}
+		h = fixedResponseHandler{*r.Respond}
+	}
+
+	if actions != 1 {
+		return rule{}, fmt.Errorf("rule %s: exactly one of Backends, Split, Root, Redirect or Respond must be set", r.Name)
+	}
+
+	return rule{r.Name, m, h}, nil
+}
+
+// newRulePool creates a pool of backends that is not routed by path.
+func newRulePool(name string, backends []Backend, config Pool) (*pool, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("Backends must be set")
+	}
+
+	config.Path = name
+	p, err := newPool(config)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range backends {
+		if b.Resolve {
+			return nil, fmt.Errorf("backend %s: Resolve is only supported by the Backends of a site", b.Addr)
+		}
+
+		_, err := p.add(b, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func newMatcher(m Matcher) (matcher, error) {
+	cm := matcher{host: normalizeHost(m.Host), path: m.Path}
+
+	for _, method := range m.Methods {
+		cm.methods = append(cm.methods, strings.ToUpper(method))
+	}
+
+	if m.PathRegex != "" {
+		re, err := regexp.Compile(m.PathRegex)
+		if err != nil {
+			return matcher{}, err
+		}
+		cm.pathRegex = re
+	}
+
+	var err error
+	cm.headers, err = newValueMatchers(m.Headers)
+	if err != nil {
+		return matcher{}, err
+	}
+
+	cm.query, err = newValueMatchers(m.Query)
+	if err != nil {
+		return matcher{}, err
+	}
+
+	for _, v := range m.All {
+		sub, err := newMatcher(v)
+		if err != nil {
+			return matcher{}, err
+		}
+		cm.all = append(cm.all, sub)
+	}
+
+	for _, v := range m.Any {
+		sub, err := newMatcher(v)
+		if err != nil {
+			return matcher{}, err
+		}
+		cm.any = append(cm.any, sub)
+	}
+
+	return cm, nil
+}
+
+func newValueMatchers(vs []ValueMatcher) ([]valueMatcher, error) {
+	var matchers []valueMatcher
+	for _, v := range vs {
+		if v.Name == "" {
+			return nil, errors.New("matchers must have a Name")
+		}
+
+		vm := valueMatcher{name: v.Name, value: v.Value}
+		if v.Regex != "" {
+			re, err := regexp.Compile(v.Regex)
+			if err != nil {
+				return nil, err
+			}
+			vm.regex = re
+		}
+		matchers = append(matchers, vm)
+	}
+	return matchers, nil
+}
+
+// matchPath returns the path of r that rules match, cleaned as the router
+// cleans it, so that //admin or /x/../admin cannot slip past a rule on /admin.
+func matchPath(r *Request) string {
+	p, _, _ := strings.Cut(r.Path, "?")
+	return cleanRoutePath(p)
+}
+
+func (m matcher) matches(r *Request, p string, query url.Values) bool {
+	if m.host != "" && !matchHost(m.host, normalizeHost(r.Host)) {
+		return false
+	}
+
+	if len(m.methods) > 0 && !slices.Contains(m.methods, r.Method) {
+		return false
+	}
+
+	if m.path != "" && !hasPathPrefix(p, m.path) {
+		return false
+	}
+
+	if m.pathRegex != nil && !m.pathRegex.MatchString(p) {
+		return false
+	}
+
+	for _, vm := range m.headers {
+		if !vm.matches(r.HeaderValues(vm.name)) {
+			return false
+		}
+	}
+
+	for _, vm := range m.query {
+		if !vm.matches(query[vm.name]) {
+			return false
+		}
+	}
+
+	for _, sub := range m.all {
+		if !sub.matches(r, p, query) {
+			return false
+		}
+	}
+
+	if len(m.any) > 0 && !slices.ContainsFunc(m.any, func(sub matcher) bool { return sub.matches(r, p, query) }) {
+		return false
+	}
+
+	return true
+}
+
+func (vm valueMatcher) matches(values []string) bool {
+	if len(values) == 0 {
+		return false
+	}
+
+	if vm.value == "" && vm.regex == nil {
+		return true
+	}
+
+	return slices.ContainsFunc(values, func(v string) bool {
+		if vm.regex != nil {
+			return vm.regex.MatchString(v)
+		}
+		return v == vm.value
+	})
+}
+
+func matchHost(pattern string, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix)
+	}
+	return host == pattern
+}
+
+// rulesHandler dispatches requests to the action of the first matching rule.
+type rulesHandler struct {
+	rules []rule
+}
+
+func newRulesHandler(rules []Rule, fwd *forwarding) (rulesHandler, error) {
+	sorted := slices.Clone(rules)
+	slices.SortStableFunc(sorted, func(a, b Rule) int {
+		return b.Priority - a.Priority
+	})
+
+	h := rulesHandler{}
+	for _, r := range sorted {
+		cr, err := newRule(r, fwd)
+		if err != nil {
+			return rulesHandler{}, err
+		}
+		h.rules = append(h.rules, cr)
+	}
+	return h, nil
+}
+
+// pools returns the pools of the rules that send requests to backends.
+func (h rulesHandler) pools() []*pool {
+	var pools []*pool
+	for _, r := range h.rules {
+		switch rh := r.handler.(type) {
+		case poolHandler:
+			pools = append(pools, rh.pool)
+		case *split:
+			for _, t := range rh.targets {
+				pools = append(pools, t.handler.pool)
+			}
+		}
+	}
+	return pools
+}
+
+func (h rulesHandler) Handle(c *Context) (bool, error) {
+	query, _ := url.ParseQuery(c.Request.Query())
+	p := matchPath(c.Request)
+
+	for _, r := range h.rules {
+		if r.matcher.matches(c.Request, p, query) {
+			return r.handler.Handle(c)
+		}
+	}
+
+	return false, nil
+}
+
+type ruleRedirectHandler struct {
+	redirect Redirect
+}
+
+func (h ruleRedirectHandler) Handle(c *Context) (bool, error) {
+	c.Response = h.redirect.response()
+	return true, nil
+}
+
+type fixedResponseHandler struct {
+	response FixedResponse
+}
+
+func (h fixedResponseHandler) Handle(c *Context) (bool, error) {
+	c.Response = StatusCode(h.response.Status, []byte(h.response.Body))
+	for k, v := range h.response.Headers {
+		c.Response.Headers[http.CanonicalHeaderKey(k)] = []string{v}
+	}
+	return true, nil
+}
@@ -0,0 +1,226 @@
+package butler
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestRulesMatch(t *testing.T) {
+	cases := []struct {
+		n        string
+		matcher  Matcher
+		request  Request
+		expected bool
+	}{
+		{"Empty", Matcher{}, Request{Path: "/"}, true},
+		{"Host", Matcher{Host: "api.example.com"}, Request{Host: "API.example.com:8080"}, true},
+		{"OtherHost", Matcher{Host: "api.example.com"}, Request{Host: "www.example.com"}, false},
+		{"WildcardHost", Matcher{Host: "*.example.com"}, Request{Host: "api.example.com"}, true},
+		{"Method", Matcher{Methods: []string{"get", "POST"}}, Request{Method: "POST"}, true},
+		{"OtherMethod", Matcher{Methods: []string{"GET"}}, Request{Method: "DELETE"}, false},
+		{"Path", Matcher{Path: "/api"}, Request{Path: "/api/users?page=1"}, true},
+		{"PathSegments", Matcher{Path: "/api"}, Request{Path: "/apis"}, false},
+		{"PathDoubleSlash", Matcher{Path: "/admin"}, Request{Path: "//admin"}, true},
+		{"PathDotDot", Matcher{Path: "/admin"}, Request{Path: "/x/../admin/users"}, true},
+		{"PathRegexDotDot", Matcher{PathRegex: `^/admin`}, Request{Path: "/x/../admin"}, true},
+		{"PathRegex", Matcher{PathRegex: `^/v[0-9]+/`}, Request{Path: "/v2/users"}, true},
+		{"OtherPathRegex", Matcher{PathRegex: `^/v[0-9]+/`}, Request{Path: "/vx/users"}, false},
+		{"HeaderPresent", Matcher{Headers: []ValueMatcher{{Name: "X-Canary"}}}, Request{Headers: map[string][]string{"x-canary": {""}}}, true},
+		{"HeaderMissing", Matcher{Headers: []ValueMatcher{{Name: "X-Canary"}}}, Request{}, false},
+		{"HeaderValue", Matcher{Headers: []ValueMatcher{{Name: "X-Env", Value: "beta"}}}, Request{Headers: map[string][]string{"X-Env": {"beta"}}}, true},
+		{"OtherHeaderValue", Matcher{Headers: []ValueMatcher{{Name: "X-Env", Value: "beta"}}}, Request{Headers: map[string][]string{"X-Env": {"prod"}}}, false},
+		{"HeaderRegex", Matcher{Headers: []ValueMatcher{{Name: "User-Agent", Regex: "(?i)bot"}}}, Request{Headers: map[string][]string{"User-Agent": {"GoogleBot/2.1"}}}, true},
+		{"Query", Matcher{Query: []ValueMatcher{{Name: "debug", Value: "1"}}}, Request{Path: "/?a=b&debug=1"}, true},
+		{"QueryMissing", Matcher{Query: []ValueMatcher{{Name: "debug"}}}, Request{Path: "/?a=b"}, false},
+		{"All", Matcher{All: []Matcher{{Methods: []string{"GET"}}, {Path: "/api"}}}, Request{Method: "GET", Path: "/api"}, true},
+		{"NotAll", Matcher{All: []Matcher{{Methods: []string{"GET"}}, {Path: "/api"}}}, Request{Method: "GET", Path: "/"}, false},
+		{"Any", Matcher{Any: []Matcher{{Host: "a.com"}, {Host: "b.com"}}}, Request{Host: "b.com"}, true},
+		{"NotAny", Matcher{Any: []Matcher{{Host: "a.com"}, {Host: "b.com"}}}, Request{Host: "c.com"}, false},
+		{"AndAny", Matcher{Path: "/api", Any: []Matcher{{Host: "a.com"}, {Host: "b.com"}}}, Request{Host: "a.com", Path: "/"}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			m, err := newMatcher(c.matcher)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := rulesHandler{[]rule{{matcher: m, handler: fixedResponseHandler{FixedResponse{Status: 200}}}}}
+			handled, err := h.Handle(&Context{Request: &c.request})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if handled != c.expected {
+				t.Fatalf("expected match to be %v", c.expected)
+			}
+		})
+	}
+}
+
+func TestRulesInvalid(t *testing.T) {
+	cases := []struct {
+		n    string
+		rule Rule
+	}{
+		{"NoAction", Rule{}},
+		{"TwoActions", Rule{Root: "/tmp", Redirect: "/"}},
+		{"BadRegex", Rule{Match: Matcher{PathRegex: "("}, Redirect: "/"}},
+		{"BadNestedRegex", Rule{Match: Matcher{Any: []Matcher{{Headers: []ValueMatcher{{Name: "A", Regex: "["}}}}}, Redirect: "/"}},
+		{"UnnamedHeader", Rule{Match: Matcher{Headers: []ValueMatcher{{Value: "a"}}}, Redirect: "/"}},
+		{"BadStatus", Rule{Respond: &FixedResponse{Status: 1000}}},
+		{"BadStrategy", Rule{Backends: []Backend{{Addr: "localhost:1"}}, Strategy: "fastest"}},
+		{"ResolvedBackend", Rule{Backends: []Backend{{Addr: "localhost:1", Resolve: true}}}},
+		{"ResolvedSplitBackend", Rule{Name: "split", Split: &Split{Targets: []SplitTarget{{Name: "a", Weight: 1, Backends: []Backend{{Addr: "localhost:1", Resolve: true}}}}}}},
+		{"UnnamedSplit", Rule{Split: &Split{Targets: []SplitTarget{{Name: "a", Weight: 1, Backends: []Backend{{Addr: "localhost:1"}}}}}}},
+		{"EmptySplit", Rule{Name: "split", Split: &Split{}}},
+		{"SplitWithoutBackends", Rule{Name: "split", Split: &Split{Targets: []SplitTarget{{Name: "a", Weight: 1}}}}},
+		{"DuplicateSplitTargets", Rule{Name: "split", Split: &Split{Targets: []SplitTarget{
+			{Name: "a", Weight: 1, Backends: []Backend{{Addr: "localhost:1"}}},
+			{Name: "a", Weight: 1, Backends: []Backend{{Addr: "localhost:2"}}},
+		}}}},
+		{"ZeroSplitWeights", Rule{Name: "split", Split: &Split{Targets: []SplitTarget{{Name: "a", Backends: []Backend{{Addr: "localhost:1"}}}}}}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			_, err := NewServer(&Config{Listen: 0, ListenTLS: -1, Rules: []Rule{c.rule}})
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestRulesDispatch(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	api := startNamedUpstream(t, "api")
+	beta := startNamedUpstream(t, "beta")
+	root := writeDocumentRoot(t, "static")
+
+	config := `
+Listen: 0
+ListenTLS: -1
+Rules:
+  - Name: maintenance
+    Match:
+      Query:
+        - Name: maintenance
+    Respond:
+      Status: 503
+      Body: down for maintenance
+      Headers:
+        retry-after: "120"
+  - Name: api
+    Match:
+      Path: /api
+    Backends:
+      - Addr: ` + api + `
+  - Name: beta
+    Priority: 10
+    Match:
+      Path: /api
+      Any:
+        - Headers:
+            - Name: X-Beta
+        - Query:
+            - Name: beta
+              Value: "1"
+    Backends:
+      - Addr: ` + beta + `
+  - Name: old
+    Match:
+      PathRegex: ^/old/
+      Methods: [GET, HEAD]
+    Redirect: /new
+    Permanent: true
+  - Name: static
+    Priority: -1
+    Root: ` + root + `
+`
+
+	c := &Config{}
+	if err := yaml.Unmarshal([]byte(config), c); err != nil {
+		t.Fatal(err)
+	}
+	_, proxy := startServer(t, c)
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	cases := []struct {
+		n        string
+		path     string
+		headers  map[string]string
+		status   int
+		expected string
+	}{
+		{"Pool", "/api/users", nil, 200, "api"},
+		{"HigherPriorityByHeader", "/api/users", map[string]string{"X-Beta": "yes"}, 200, "beta"},
+		{"HigherPriorityByQuery", "/api/users?beta=1", nil, 200, "beta"},
+		{"Fixed", "/api/users?maintenance", nil, 503, "down for maintenance"},
+		{"Redirect", "/old/page", nil, 301, ""},
+		{"Static", "/", nil, 200, "static"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.n, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", proxy+tc.path, nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != tc.status {
+				t.Fatalf("expected status %v but got %v", tc.status, resp.StatusCode)
+			}
+			if tc.expected != "" && string(b) != tc.expected {
+				t.Fatalf("expected %q but got %q", tc.expected, b)
+			}
+			if tc.status == 503 && resp.Header.Get("Retry-After") != "120" {
+				t.Fatalf("expected Retry-After but got %v", resp.Header)
+			}
+			if tc.status == 301 && resp.Header.Get("Location") != "/new" {
+				t.Fatalf("expected Location /new but got %v", resp.Header)
+			}
+		})
+	}
+}
+
+func TestRulesMatchCleanPaths(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	admin := startNamedUpstream(t, "admin")
+	_, proxy := startServer(t, &Config{
+		Listen:    0,
+		ListenTLS: -1,
+		Rules:     []Rule{{Name: "deny", Match: Matcher{Path: "/admin"}, Respond: &FixedResponse{Status: http.StatusForbidden}}},
+		Backends:  []Backend{{Addr: admin, Path: "/admin"}},
+	})
+
+	for _, p := range []string{"/admin", "//admin", "/x/../admin", "/admin/./users"} {
+		t.Run(p, func(t *testing.T) {
+			resp, err := http.Get(proxy + p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusForbidden {
+				t.Fatalf("expected the rule to deny %s but got %v", p, resp.StatusCode)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package butler
 
 import (
+	"bufio"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -16,42 +17,63 @@ import (
 )
 
 type Config struct {
-	Host               string    `yaml:"Host"`
-	Listen             int       `yaml:"Listen"`
-	ListenTLS          int       `yaml:"ListenTLS"`
-	RedirectHTTP       bool      `yaml:"RedirectHTTP"`
-	Backends           []Backend `yaml:"Backends"`
-	CertificateFile    string    `yaml:"CertificateFile"`
-	CertificateKeyFile string    `yaml:"CertificateKeyFile"`
-	DocumentRoot       string    `yaml:"DocumentRoot"`
-	Registrar          bool      `yaml:"Registrar"`
-	RegistrarListen    int       `yaml:"RegistrarListen"`
+	Host               string          `yaml:"Host"`
+	Listen             int             `yaml:"Listen"`
+	ListenTLS          int             `yaml:"ListenTLS"`
+	RedirectHTTP       bool            `yaml:"RedirectHTTP"`
+	Backends           []Backend       `yaml:"Backends"`
+	Pools              []Pool          `yaml:"Pools"`
+	Rules              []Rule          `yaml:"Rules"`
+	Forwarding         Forwarding      `yaml:"Forwarding"`
+	Cache              Cache           `yaml:"Cache"`
+	Redirects          []Redirect      `yaml:"Redirects"`
+	CGI                []CGI           `yaml:"CGI"`
+	FastCGI            []FastCGI       `yaml:"FastCGI"`
+	WebDAV             []WebDAV        `yaml:"WebDAV"`
+	CertificateFile    string          `yaml:"CertificateFile"`
+	CertificateKeyFile string          `yaml:"CertificateKeyFile"`
+	DocumentRoot       string          `yaml:"DocumentRoot"`
+	Sites              map[string]Site `yaml:"Sites"`
+	Resolver           string          `yaml:"Resolver"`
+	Registrar          bool            `yaml:"Registrar"`
+	RegistrarListen    int             `yaml:"RegistrarListen"`
+	Admin              bool            `yaml:"Admin"`
+	AdminListen        int             `yaml:"AdminListen"`
 }
 
 type Server struct {
 	Host         string
 	DocumentRoot string
 
-	certificate   tls.Certificate
+	sites         *siteTable
 	httpListener  *listener
 	httpsListener *listener
 	registrar     *registrar
+	admin         *admin
 }
 
 type listener struct {
 	port     int
 	listener net.Listener
 	readyCh  chan bool
-	// TODO: Listeners should just use the same handlers, move these 2 handlers to Server
-	// TODO: Handlers access needs a mutex
-	handlers        []handler
-	fallbackHandler handler
+	// handlers run before the request is routed to a site
+	handlers []handler
+	sites    *siteTable
 }
 
+const serverSoftware = "butler/0.1"
+
 type Context struct {
 	Conn     net.Conn
 	Request  *Request
 	Response *Response
+
+	localRedirects int
+	// closeConn is set by handlers that could not leave the connection ready
+	// for the next request
+	closeConn bool
+	// tunnel is spliced with the connection once the response is written
+	tunnel *tunnel
 }
 
 func NewServerYaml(yamlFile string) (*Server, error) {
@@ -89,44 +111,28 @@ func NewServer(c *Config) (*Server, error) {
 		return nil, errors.New("either Listen or ListenTLS must be set")
 	}
 
-	if c.ListenTLS > -1 && (c.CertificateFile == "" || c.CertificateKeyFile == "") {
+	sites, err := newSiteTable(c)
+	if err != nil {
+		return nil, err
+	}
+	s.sites = sites
+
+	if c.ListenTLS > -1 && !sites.hasCertificate() {
+		sites.close()
 		return nil, errors.New("ListenTLS and both CertificateFile and CertificateKeyFile must be set")
 	}
 
 	if c.ListenTLS > -1 {
-		tl := listener{port: c.ListenTLS, readyCh: make(chan bool, 1), handlers: make([]handler, 0)}
-		cert, err := tls.LoadX509KeyPair(c.CertificateFile, c.CertificateKeyFile)
-		if err != nil {
-			return nil, err
-		}
-		s.certificate = cert
-
-		for _, v := range c.Backends {
-			tl.handlers = append(tl.handlers, backendHandler{v})
-		}
-
-		if c.DocumentRoot != "" {
-			tl.handlers = append(tl.handlers, documentRootHandler{c.DocumentRoot})
-		}
-
-		s.httpsListener = &tl
+		s.httpsListener = &listener{port: c.ListenTLS, readyCh: make(chan bool, 1), handlers: make([]handler, 0), sites: sites}
 	}
 
 	if c.Listen > -1 {
-		tl := listener{port: c.Listen, readyCh: make(chan bool, 1), handlers: make([]handler, 0)}
+		tl := listener{port: c.Listen, readyCh: make(chan bool, 1), handlers: make([]handler, 0), sites: sites}
 
 		if c.RedirectHTTP {
 			tl.handlers = append(tl.handlers, redirectHTTPHandler{c})
 		}
 
-		for _, v := range c.Backends {
-			tl.handlers = append(tl.handlers, backendHandler{v})
-		}
-
-		if c.DocumentRoot != "" {
-			tl.fallbackHandler = documentRootHandler{c.DocumentRoot}
-		}
-
 		s.httpListener = &tl
 	}
 
@@ -134,11 +140,21 @@ func NewServer(c *Config) (*Server, error) {
 		r, err := newRegistrar(c.RegistrarListen, s)
 
 		if err != nil {
+			sites.close()
 			return nil, err
 		}
 		s.registrar = r
 	}
 
+	if c.Admin {
+		a, err := newAdmin(c.AdminListen, s)
+		if err != nil {
+			sites.close()
+			return nil, err
+		}
+		s.admin = a
+	}
+
 	return s, nil
 }
 
@@ -156,7 +172,7 @@ func (server *Server) Listen() error {
 		g.Go(func() error {
 			return server.listen(server.httpsListener, func(addr string) (net.Listener, error) {
 				return tls.Listen("tcp", addr, &tls.Config{
-					Certificates: []tls.Certificate{server.certificate},
+					GetCertificate: server.sites.getCertificate,
 				})
 			}, "https")
 		})
@@ -168,6 +184,12 @@ func (server *Server) Listen() error {
 		})
 	}
 
+	if server.admin != nil {
+		g.Go(func() error {
+			return server.admin.Listen()
+		})
+	}
+
 	return g.Wait()
 }
 
@@ -184,6 +206,11 @@ func (server Server) Close() error {
 		server.registrar.Close()
 	}
 
+	if server.admin != nil {
+		server.admin.Close()
+	}
+
+	server.sites.close()
 	return nil
 }
 
@@ -206,55 +233,28 @@ func (server *Server) listen(listener *listener, createListener func(address str
 		}
 
 		slog.Debug("accepted connection from " + conn.RemoteAddr().String())
-		go listener.listenAndHandleRequests(conn, "http")
+		go listener.listenAndHandleRequests(conn, scheme)
 	}
 }
 
-func (server *Server) addBackend(b Backend) {
-	if server.httpListener != nil {
-		server.httpListener.addBackend(b)
-	}
-
-	if server.httpsListener != nil {
-		server.httpsListener.addBackend(b)
-	}
+func (server *Server) addBackend(b Backend) error {
+	return server.sites.defaultSite.addBackend(b)
 }
 
 func (server *Server) removeBackend(b Backend) {
-	if server.httpListener != nil {
-		server.httpListener.removeBackend(b)
-	}
-
-	if server.httpsListener != nil {
-		server.httpsListener.removeBackend(b)
-	}
-}
-
-func (listener *listener) addBackend(b Backend) {
-	for _, h := range listener.handlers {
-		if bh, ok := h.(backendHandler); ok && bh.b.Equals(b) {
-			slog.Debug(fmt.Sprintf("backend %v already exists", bh.b))
-			return
-		}
-	}
-
-	listener.handlers = append(listener.handlers, backendHandler{b})
+	server.sites.defaultSite.removeBackend(b)
 }
 
-func (listener *listener) removeBackend(b Backend) {
-	listener.handlers = slices.DeleteFunc(listener.handlers, func(h handler) bool {
-		if bh, ok := h.(backendHandler); ok && bh.b.Equals(b) {
-			return true
-		}
-		return false
-	})
+func (server *Server) member(b Backend) *upstream {
+	return server.sites.defaultSite.member(b)
 }
 
 func (listener *listener) listenAndHandleRequests(conn net.Conn, scheme string) {
+	reader := bufio.NewReader(conn)
 	for {
 		c := &Context{Conn: conn}
 
-		r, err := ParseRequest(conn, scheme)
+		r, err := ParseRequest(reader, scheme)
 		if err != nil {
 			switch err {
 			case errConnectionClosed:
@@ -279,13 +279,41 @@ func (listener *listener) listenAndHandleRequests(conn net.Conn, scheme string)
 		err = listener.handleRequest(c)
 		if err != nil {
 			slog.Error(fmt.Sprintf("failed handling request %s for %s: %s", c.Request, c.Conn.RemoteAddr(), err))
+			if c.Response != nil && c.Response.Body != nil {
+				c.Response.Body.Close()
+			}
 			c.Conn.Close()
 			return
 		}
 
+		if c.closeConn && c.Response != nil {
+			// So that the client does not send another request on the connection
+			c.Response.Headers[HeaderConnection] = []string{"close"}
+		}
+
 		err = c.flush()
 		if err != nil {
 			slog.Error(fmt.Sprintf("failed writing response for %s: %s", c.Conn.RemoteAddr(), err))
+			if c.tunnel != nil {
+				c.tunnel.close()
+			}
+			c.Conn.Close()
+			return
+		}
+
+		if c.tunnel != nil {
+			c.tunnel.splice(c.Conn, reader)
+			return
+		}
+
+		if c.closeConn {
+			c.Conn.Close()
+			return
+		}
+
+		err = c.Request.discardBody()
+		if err != nil {
+			slog.Debug(fmt.Sprintf("failed reading request body for %s: %s", c.Conn.RemoteAddr(), err))
 			c.Conn.Close()
 			return
 		}
@@ -316,8 +344,8 @@ func (listener *listener) handleRequest(c *Context) error {
 		}
 	}
 
-	if !handled && listener.fallbackHandler != nil {
-		_, err := listener.fallbackHandler.Handle(c)
+	if !handled {
+		err := listener.sites.lookup(c.Request.Host).handleRequest(c)
 		if err != nil {
 			return err
 		}
@@ -337,8 +365,8 @@ func (c *Context) flush() error {
 
 	if c.Request != nil {
 		hEncoding, hasEncodingHeader := c.Request.Headers[HeaderAcceptEncoding]
-		responseGzipped := slices.Contains(c.Response.Headers[HeaderContentEncoding], "gzip")
-		if hasEncodingHeader && !responseGzipped && c.Response.Content != nil {
+		responseEncoded := len(c.Response.Headers[HeaderContentEncoding]) > 0
+		if hasEncodingHeader && !responseEncoded && (c.Response.Content != nil || c.Response.Body != nil) {
 			v := strings.Split(hEncoding[0], ", ")
 			if slices.Contains(v, "gzip") {
 				gzip = true
@@ -348,9 +376,9 @@ func (c *Context) flush() error {
 		headersOnly = c.Request.Method == RequestHead
 	}
 
-	c.Response.Headers["Server"] = []string{"butler/0.1"}
+	c.Response.Headers["Server"] = []string{serverSoftware}
 
-	written, err := c.Conn.Write(c.Response.Bytes(gzip, headersOnly))
+	written, err := c.Response.Write(c.Conn, gzip, headersOnly)
 	if err != nil {
 		return err
 	}
@@ -1,11 +1,15 @@
 package butler
 
 import (
+	"bufio"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -95,6 +99,57 @@ Connection: close
 	}
 }
 
+func TestServerFramesEveryBody(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	_, url := startServer(t, &Config{Host: "localhost", Listen: 0, ListenTLS: -1, DocumentRoot: "./testdata"})
+
+	smuggled := "GET /index.html HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	cases := []struct {
+		n        string
+		request  string
+		statuses []int
+	}{
+		{"ContentLength", "GET /index.html HTTP/1.1\r\nHost: localhost\r\nContent-Length: " + strconv.Itoa(len(smuggled)) + "\r\n\r\n" + smuggled,
+			[]int{http.StatusOK, http.StatusNotFound}},
+		{"Chunked", "GET /index.html HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" + strconv.FormatInt(int64(len(smuggled)), 16) + "\r\n" + smuggled + "\r\n0\r\n\r\n",
+			[]int{http.StatusOK, http.StatusNotFound}},
+		{"ConflictingLengths", "GET /index.html HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\nContent-Length: " + strconv.Itoa(len(smuggled)) + "\r\n\r\n" + smuggled,
+			[]int{http.StatusBadRequest}},
+		{"LengthAndChunked", "GET /index.html HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\nTransfer-Encoding: chunked\r\n\r\n" + smuggled,
+			[]int{http.StatusBadRequest}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			conn.Write([]byte(c.request + "GET /missing.html HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			reader := bufio.NewReader(conn)
+			var got []int
+			for {
+				resp, err := http.ReadResponse(reader, &http.Request{Method: "GET"})
+				if err != nil {
+					break
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				got = append(got, resp.StatusCode)
+			}
+
+			if !slices.Equal(got, c.statuses) {
+				t.Fatalf("expected responses %v but got %v", c.statuses, got)
+			}
+		})
+	}
+}
+
 func TestBackend(t *testing.T) {
 	cases := []struct {
 		p string
@@ -0,0 +1,456 @@
+package butler
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Site is a name-based virtual host. Requests are routed to a site by
+// matching the Host header against the keys of Config.Sites, e.g.
+// "example.com" or "*.example.com".
+type Site struct {
+	DocumentRoot       string     `yaml:"DocumentRoot"`
+	Backends           []Backend  `yaml:"Backends"`
+	Pools              []Pool     `yaml:"Pools"`
+	Rules              []Rule     `yaml:"Rules"`
+	Forwarding         Forwarding `yaml:"Forwarding"`
+	Cache              Cache      `yaml:"Cache"`
+	Redirects          []Redirect `yaml:"Redirects"`
+	CGI                []CGI      `yaml:"CGI"`
+	FastCGI            []FastCGI  `yaml:"FastCGI"`
+	WebDAV             []WebDAV   `yaml:"WebDAV"`
+	CertificateFile    string     `yaml:"CertificateFile"`
+	CertificateKeyFile string     `yaml:"CertificateKeyFile"`
+	// Resolver is the address of the DNS server that backends with Resolve
+	// are looked up with, the first nameserver of /etc/resolv.conf by default
+	Resolver string `yaml:"Resolver"`
+}
+
+type Redirect struct {
+	Path      string `yaml:"Path"`
+	Location  string `yaml:"Location"`
+	Permanent bool   `yaml:"Permanent"`
+}
+
+type site struct {
+	name        string
+	certificate *tls.Certificate
+	// pools configures the pools created as backends are added
+	pools  map[route]Pool
+	routes *router
+	// cache is nil unless the site caches backend responses
+	cache *cache
+	// splits are the rules whose weights can be changed at runtime
+	splits []*split
+	// rulePools are the pools of rules, which are not routed by path
+	rulePools []*pool
+	resolver  *resolver
+
+	mu              sync.RWMutex
+	handlers        []handler
+	fallbackHandler handler
+	// watchers resolve the backends with Resolve
+	watchers []*dnsWatcher
+	// serving is set once the site is created, after which added backends
+	// slow start
+	serving bool
+}
+
+// defaultSite is built from the top level of Config and serves every request
+// whose host does not match one of Config.Sites.
+func (c *Config) defaultSite() Site {
+	return Site{
+		DocumentRoot:       c.DocumentRoot,
+		Backends:           c.Backends,
+		Pools:              c.Pools,
+		Rules:              c.Rules,
+		Forwarding:         c.Forwarding,
+		Cache:              c.Cache,
+		Redirects:          c.Redirects,
+		CGI:                c.CGI,
+		FastCGI:            c.FastCGI,
+		WebDAV:             c.WebDAV,
+		CertificateFile:    c.CertificateFile,
+		CertificateKeyFile: c.CertificateKeyFile,
+		Resolver:           c.Resolver,
+	}
+}
+
+func newSite(name string, s Site) (*site, error) {
+	if (s.CertificateFile == "") != (s.CertificateKeyFile == "") {
+		return nil, fmt.Errorf("site %s: both CertificateFile and CertificateKeyFile must be set", name)
+	}
+
+	st := &site{name: name, handlers: make([]handler, 0), pools: make(map[route]Pool), routes: newRouter(),
+		resolver: newResolver(s.Resolver)}
+
+	if s.CertificateFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.CertificateFile, s.CertificateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		st.certificate = &cert
+	}
+
+	fwd, err := newForwarding(s.Forwarding)
+	if err != nil {
+		return nil, fmt.Errorf("site %s: %w", name, err)
+	}
+
+	if len(s.Rules) > 0 {
+		h, err := newRulesHandler(s.Rules, fwd)
+		if err != nil {
+			return nil, fmt.Errorf("site %s: %w", name, err)
+		}
+		st.handlers = append(st.handlers, h)
+		st.rulePools = h.pools()
+
+		for _, r := range h.rules {
+			if sp, ok := r.handler.(*split); ok {
+				st.splits = append(st.splits, sp)
+			}
+		}
+	}
+
+	if len(s.Redirects) > 0 {
+		st.handlers = append(st.handlers, redirectHandler{s.Redirects})
+	}
+
+	for _, v := range s.WebDAV {
+		h, err := newWebDAVHandler(v, s.DocumentRoot)
+		if err != nil {
+			return nil, fmt.Errorf("site %s: %w", name, err)
+		}
+		st.handlers = append(st.handlers, h)
+	}
+
+	for _, v := range s.CGI {
+		if v.Dir == "" && s.DocumentRoot == "" {
+			return nil, fmt.Errorf("site %s: CGI Dir or DocumentRoot must be set", name)
+		}
+		st.handlers = append(st.handlers, newCGIHandler(v, s.DocumentRoot, st))
+	}
+
+	for _, v := range s.FastCGI {
+		h, err := newFastCGIHandler(v, st)
+		if err != nil {
+			return nil, fmt.Errorf("site %s: %w", name, err)
+		}
+		st.handlers = append(st.handlers, h)
+	}
+
+	for _, v := range s.Pools {
+		r, err := newRoute(v.Path, v.Match)
+		if err != nil {
+			return nil, fmt.Errorf("site %s: %w", name, err)
+		}
+
+		if _, ok := st.pools[r]; ok {
+			return nil, fmt.Errorf("site %s: duplicate pool %s", name, v.Path)
+		}
+
+		if _, err := newPool(v); err != nil {
+			return nil, fmt.Errorf("site %s: %w", name, err)
+		}
+		st.pools[r] = v
+	}
+
+	for _, v := range s.Backends {
+		err := st.addBackend(v)
+		if err != nil {
+			st.close()
+			return nil, fmt.Errorf("site %s: %w", name, err)
+		}
+	}
+
+	var backends handler = backendHandler{st.routes, fwd}
+	if s.Cache != (Cache{}) {
+		st.cache, err = newCache(s.Cache)
+		if err != nil {
+			st.close()
+			return nil, fmt.Errorf("site %s: %w", name, err)
+		}
+		backends = cacheHandler{st.cache, backends}
+	}
+	st.handlers = append(st.handlers, backends)
+
+	if s.DocumentRoot != "" {
+		st.fallbackHandler = documentRootHandler{s.DocumentRoot}
+	}
+
+	st.mu.Lock()
+	st.serving = true
+	st.mu.Unlock()
+	return st, nil
+}
+
+// allPools returns the pools of rules and of routes.
+func (st *site) allPools() []*pool {
+	return append(slices.Clone(st.rulePools), st.routes.all()...)
+}
+
+// addBackend adds b to the pool for its route, creating the pool if needed.
+func (st *site) addBackend(b Backend) error {
+	r, err := newRoute(b.Path, b.Match)
+	if err != nil {
+		return err
+	}
+
+	if b.Resolve {
+		return st.resolveBackend(b)
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if p := st.routes.get(r); p != nil {
+		added, err := p.add(b, !st.serving)
+		if !added && err == nil {
+			slog.Debug(fmt.Sprintf("backend %v already exists", b))
+		}
+		return err
+	}
+
+	config, ok := st.pools[r]
+	if !ok {
+		config = Pool{Path: b.Path, Match: b.Match}
+	}
+
+	p, err := newPool(config)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.add(b, !st.serving)
+	if err != nil {
+		return err
+	}
+
+	st.routes.insert(r, p)
+	return nil
+}
+
+// resolveBackend adds a member for every address b resolves to, and keeps
+// them up to date as DNS changes.
+func (st *site) resolveBackend(b Backend) error {
+	w, err := newDNSWatcher(b, st)
+	if err != nil {
+		return err
+	}
+
+	if net.ParseIP(w.host) != nil {
+		// There is nothing to look up
+		b.Resolve = false
+		return st.addBackend(b)
+	}
+
+	st.mu.Lock()
+	if slices.ContainsFunc(st.watchers, func(o *dnsWatcher) bool { return o.b.Equals(b) }) {
+		st.mu.Unlock()
+		slog.Debug(fmt.Sprintf("backend %v already exists", b))
+		return nil
+	}
+	st.watchers = append(st.watchers, w)
+	st.mu.Unlock()
+
+	next := w.refresh()
+	go w.run(next)
+	return nil
+}
+
+// member returns the upstream for b from any pool of the site, or nil.
+func (st *site) member(b Backend) *upstream {
+	for _, p := range st.allPools() {
+		if u := p.member(b); u != nil {
+			return u
+		}
+	}
+	return nil
+}
+
+// removeBackend removes b from its pool, and removes the route once the pool
+// is empty.
+func (st *site) removeBackend(b Backend) {
+	r, err := newRoute(b.Path, b.Match)
+	if err != nil {
+		return
+	}
+
+	if b.Resolve {
+		st.mu.Lock()
+		i := slices.IndexFunc(st.watchers, func(w *dnsWatcher) bool { return w.b.Equals(b) })
+		var w *dnsWatcher
+		if i >= 0 {
+			w = st.watchers[i]
+			st.watchers = slices.Delete(st.watchers, i, i+1)
+		}
+		st.mu.Unlock()
+
+		if w != nil {
+			w.close()
+			return
+		}
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if p := st.routes.get(r); p != nil && p.remove(b) == 0 {
+		st.routes.remove(r)
+	}
+}
+
+// close stops resolving backends.
+func (st *site) close() {
+	st.mu.Lock()
+	watchers := st.watchers
+	st.watchers = nil
+	st.mu.Unlock()
+
+	for _, w := range watchers {
+		w.close()
+	}
+}
+
+func (st *site) handleRequest(c *Context) error {
+	st.mu.RLock()
+	handlers := st.handlers
+	fallbackHandler := st.fallbackHandler
+	st.mu.RUnlock()
+
+	handled := false
+	for _, h := range handlers {
+		skip, err := h.Handle(c)
+		if err != nil {
+			return err
+		}
+
+		if skip {
+			handled = true
+			break
+		}
+	}
+
+	if !handled && fallbackHandler != nil {
+		_, err := fallbackHandler.Handle(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type siteTable struct {
+	defaultSite *site
+	exact       map[string]*site
+	// wildcards are sorted longest suffix first, so the most specific wins
+	wildcards []*site
+}
+
+func newSiteTable(c *Config) (*siteTable, error) {
+	d, err := newSite("", c.defaultSite())
+	if err != nil {
+		return nil, err
+	}
+
+	t := &siteTable{defaultSite: d, exact: make(map[string]*site)}
+	for name, s := range c.Sites {
+		name = normalizeHost(name)
+		if name == "" || name == "*" {
+			t.close()
+			return nil, errors.New("site names must not be empty, use the top level config for the default site")
+		}
+
+		st, err := newSite(name, s)
+		if err != nil {
+			t.close()
+			return nil, err
+		}
+
+		if strings.HasPrefix(name, "*.") {
+			t.wildcards = append(t.wildcards, st)
+		} else {
+			t.exact[name] = st
+		}
+	}
+
+	slices.SortFunc(t.wildcards, func(a, b *site) int {
+		return len(b.name) - len(a.name)
+	})
+
+	return t, nil
+}
+
+func (t *siteTable) lookup(host string) *site {
+	host = normalizeHost(host)
+	if st, ok := t.exact[host]; ok {
+		return st
+	}
+
+	for _, st := range t.wildcards {
+		// "*.example.com" matches any subdomain of example.com, but not example.com itself
+		if strings.HasSuffix(host, st.name[1:]) {
+			return st
+		}
+	}
+
+	return t.defaultSite
+}
+
+// all returns every site, the default site first.
+func (t *siteTable) all() []*site {
+	sites := []*site{t.defaultSite}
+	for _, st := range t.exact {
+		sites = append(sites, st)
+	}
+	return append(sites, t.wildcards...)
+}
+
+func (t *siteTable) close() {
+	for _, st := range t.all() {
+		st.close()
+	}
+}
+
+func (t *siteTable) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	st := t.lookup(hello.ServerName)
+	if st.certificate != nil {
+		return st.certificate, nil
+	}
+
+	if t.defaultSite.certificate != nil {
+		return t.defaultSite.certificate, nil
+	}
+
+	return nil, fmt.Errorf("no certificate for %s", hello.ServerName)
+}
+
+func (t *siteTable) hasCertificate() bool {
+	if t.defaultSite.certificate != nil {
+		return true
+	}
+
+	for _, st := range t.exact {
+		if st.certificate != nil {
+			return true
+		}
+	}
+
+	return slices.ContainsFunc(t.wildcards, func(st *site) bool {
+		return st.certificate != nil
+	})
+}
+
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
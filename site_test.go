@@ -0,0 +1,216 @@
+package butler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeDocumentRoot(t *testing.T, content string) string {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "index.html"), []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeCertificate(t *testing.T, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestSiteRouting(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	s, err := NewServer(&Config{
+		Host:         "localhost",
+		Listen:       0,
+		ListenTLS:    -1,
+		DocumentRoot: writeDocumentRoot(t, "default"),
+		Sites: map[string]Site{
+			"a.example.com":         {DocumentRoot: writeDocumentRoot(t, "a")},
+			"*.example.com":         {DocumentRoot: writeDocumentRoot(t, "wildcard")},
+			"*.staging.example.com": {DocumentRoot: writeDocumentRoot(t, "staging")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go s.Listen()
+	defer s.Close()
+	<-s.httpListener.readyCh
+
+	cases := []struct {
+		h string
+		b string
+		n string
+	}{
+		{h: "a.example.com", b: "a", n: "Exact"},
+		{h: "A.Example.com:8080", b: "a", n: "ExactWithPortAndCase"},
+		{h: "b.example.com", b: "wildcard", n: "Wildcard"},
+		{h: "x.y.example.com", b: "wildcard", n: "WildcardNested"},
+		{h: "x.staging.example.com", b: "staging", n: "WildcardLongestSuffix"},
+		{h: "example.com", b: "default", n: "WildcardDoesNotMatchApex"},
+		{h: "other.org", b: "default", n: "Default"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "http://"+s.httpListener.listener.Addr().String()+"/", nil)
+			req.Host = c.h
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, _ := io.ReadAll(resp.Body)
+			if string(b) != c.b {
+				t.Fatalf("expected %q but got %q", c.b, b)
+			}
+		})
+	}
+}
+
+func TestSiteRedirects(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	s, _ := NewServer(&Config{
+		Host:      "localhost",
+		Listen:    0,
+		ListenTLS: -1,
+		Sites: map[string]Site{
+			"example.com": {
+				Redirects: []Redirect{
+					{Path: "/old", Location: "/new", Permanent: true},
+					{Path: "/tmp", Location: "/elsewhere"},
+				},
+			},
+		},
+	})
+
+	go s.Listen()
+	defer s.Close()
+	<-s.httpListener.readyCh
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	cases := []struct {
+		p string
+		s int
+		l string
+	}{
+		{p: "/old", s: http.StatusMovedPermanently, l: "/new"},
+		{p: "/tmp", s: http.StatusFound, l: "/elsewhere"},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", "http://"+s.httpListener.listener.Addr().String()+c.p, nil)
+		req.Host = "example.com"
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != c.s || resp.Header.Get(HeaderLocation) != c.l {
+			t.Fatalf("expected %v %v but got %v %v", c.s, c.l, resp.StatusCode, resp.Header.Get(HeaderLocation))
+		}
+	}
+}
+
+func TestSiteCertificates(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	defaultCert, defaultKey := writeCertificate(t, "default.test")
+	siteCert, siteKey := writeCertificate(t, "site.test")
+
+	s, err := NewServer(&Config{
+		Host:               "localhost",
+		Listen:             -1,
+		ListenTLS:          0,
+		CertificateFile:    defaultCert,
+		CertificateKeyFile: defaultKey,
+		Sites: map[string]Site{
+			"site.test": {CertificateFile: siteCert, CertificateKeyFile: siteKey},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go s.Listen()
+	defer s.Close()
+	<-s.httpsListener.readyCh
+
+	for _, name := range []string{"default.test", "site.test"} {
+		conn, err := tls.Dial("tcp", s.httpsListener.listener.Addr().String(), &tls.Config{
+			ServerName:         name,
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		conn.Close()
+		if got != name {
+			t.Fatalf("expected certificate for %v but got %v", name, got)
+		}
+	}
+
+	// Unknown names fall back to the default certificate
+	conn, err := tls.Dial("tcp", s.httpsListener.listener.Addr().String(), &tls.Config{
+		ServerName:         "unknown.test",
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if got := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; got != "default.test" {
+		t.Fatalf("expected default certificate but got %v", got)
+	}
+}
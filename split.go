@@ -0,0 +1,216 @@
+package butler
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+)
+
+// Split divides the requests of a rule between Targets in proportion to their
+// Weight, e.g. 95 and 5 to send 5% of requests to a canary. Requests matching
+// the Match of a target, such as one carrying a canary header, are always
+// sent to it. If Cookie is set, the target a client is assigned is kept in
+// that cookie, so that the client stays on one target until its weight is
+// set to 0.
+//
+// Weights can be changed through the admin API while the server is running.
+type Split struct {
+	Cookie  string        `yaml:"Cookie"`
+	Targets []SplitTarget `yaml:"Targets"`
+}
+
+// SplitTarget is a pool of Backends, balanced by Strategy and HashKey as in a
+// Pool.
+type SplitTarget struct {
+	Name     string    `yaml:"Name"`
+	Weight   int       `yaml:"Weight"`
+	Match    *Matcher  `yaml:"Match"`
+	Backends []Backend `yaml:"Backends"`
+	Strategy string    `yaml:"Strategy"`
+	HashKey  string    `yaml:"HashKey"`
+}
+
+// SplitInfo describes a split and its current weights, as listed by the admin
+// API.
+type SplitInfo struct {
+	Site    string            `json:"Site,omitempty"`
+	Rule    string            `json:"Rule"`
+	Cookie  string            `json:"Cookie,omitempty"`
+	Targets []SplitTargetInfo `json:"Targets"`
+}
+
+type SplitTargetInfo struct {
+	Name   string `json:"Name"`
+	Weight int    `json:"Weight"`
+}
+
+type split struct {
+	name    string
+	cookie  string
+	targets []splitTarget
+
+	mu      sync.RWMutex
+	weights []int
+}
+
+type splitTarget struct {
+	name string
+	// matcher is nil unless requests can select the target
+	matcher *matcher
+	handler poolHandler
+}
+
+func newSplit(name string, s Split, fwd *forwarding) (*split, error) {
+	if name == "" {
+		return nil, errors.New("rules with a Split must have a Name")
+	}
+
+	if len(s.Targets) == 0 {
+		return nil, errors.New("a Split must have Targets")
+	}
+
+	sp := &split{name: name, cookie: s.Cookie}
+	for _, t := range s.Targets {
+		if t.Name == "" || slices.ContainsFunc(sp.targets, func(o splitTarget) bool { return o.name == t.Name }) {
+			return nil, fmt.Errorf("split targets must have unique names, got %q", t.Name)
+		}
+
+		st := splitTarget{name: t.Name}
+		if t.Match != nil {
+			m, err := newMatcher(*t.Match)
+			if err != nil {
+				return nil, fmt.Errorf("split target %s: %w", t.Name, err)
+			}
+			st.matcher = &m
+		}
+
+		p, err := newRulePool(name+"/"+t.Name, t.Backends, Pool{Strategy: t.Strategy, HashKey: t.HashKey})
+		if err != nil {
+			return nil, fmt.Errorf("split target %s: %w", t.Name, err)
+		}
+		st.handler = poolHandler{p, fwd}
+
+		sp.targets = append(sp.targets, st)
+		sp.weights = append(sp.weights, t.Weight)
+	}
+
+	err := validateWeights(sp.weights)
+	if err != nil {
+		return nil, err
+	}
+
+	return sp, nil
+}
+
+func validateWeights(weights []int) error {
+	total := 0
+	for _, w := range weights {
+		if w < 0 {
+			return errors.New("split weights must not be negative")
+		}
+		total += w
+	}
+
+	if total == 0 {
+		return errors.New("split weights must not all be 0")
+	}
+	return nil
+}
+
+func (sp *split) Handle(c *Context) (bool, error) {
+	query, _ := url.ParseQuery(c.Request.Query())
+	p := matchPath(c.Request)
+	for _, t := range sp.targets {
+		if t.matcher != nil && t.matcher.matches(c.Request, p, query) {
+			return t.handler.Handle(c)
+		}
+	}
+
+	sp.mu.RLock()
+	i := sp.assigned(c.Request)
+	assign := i < 0
+	if assign {
+		i = sp.pick()
+	}
+	sp.mu.RUnlock()
+
+	handled, err := sp.targets[i].handler.Handle(c)
+	if err == nil && assign && sp.cookie != "" && c.Response != nil {
+		cookie := &http.Cookie{Name: sp.cookie, Value: sp.targets[i].name, Path: "/", HttpOnly: true}
+		c.Response.Headers[HeaderSetCookie] = append(c.Response.Headers[HeaderSetCookie], cookie.String())
+	}
+	return handled, err
+}
+
+// assigned returns the target named by the cookie of r, or -1 if there is none
+// or it no longer has any weight. sp.mu must be held.
+func (sp *split) assigned(r *Request) int {
+	if sp.cookie == "" {
+		return -1
+	}
+
+	name := r.Cookie(sp.cookie)
+	for i, t := range sp.targets {
+		if t.name == name && sp.weights[i] > 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// pick returns a target at random, in proportion to the weights. sp.mu must be
+// held.
+func (sp *split) pick() int {
+	total := 0
+	for _, w := range sp.weights {
+		total += w
+	}
+
+	n := rand.IntN(total)
+	for i, w := range sp.weights {
+		if n < w {
+			return i
+		}
+		n -= w
+	}
+	return len(sp.weights) - 1
+}
+
+func (sp *split) info(site string) SplitInfo {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+
+	info := SplitInfo{Site: site, Rule: sp.name, Cookie: sp.cookie}
+	for i, t := range sp.targets {
+		info.Targets = append(info.Targets, SplitTargetInfo{t.name, sp.weights[i]})
+	}
+	return info
+}
+
+// setWeights changes the weights of the named targets, leaving the others as
+// they are.
+func (sp *split) setWeights(weights map[string]int) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	updated := slices.Clone(sp.weights)
+	for name, w := range weights {
+		i := slices.IndexFunc(sp.targets, func(t splitTarget) bool { return t.name == name })
+		if i < 0 {
+			return fmt.Errorf("split %s has no target %s", sp.name, name)
+		}
+		updated[i] = w
+	}
+
+	err := validateWeights(updated)
+	if err != nil {
+		return err
+	}
+
+	sp.weights = updated
+	return nil
+}
@@ -0,0 +1,191 @@
+package butler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func startSplit(t *testing.T, stable int, canary int) (string, string) {
+	config := `
+Listen: 0
+ListenTLS: -1
+Admin: true
+AdminListen: 0
+Rules:
+  - Name: api
+    Split:
+      Cookie: version
+      Targets:
+        - Name: stable
+          Weight: ` + strconv.Itoa(stable) + `
+          Backends:
+            - Addr: ` + startNamedUpstream(t, "stable") + `
+        - Name: canary
+          Weight: ` + strconv.Itoa(canary) + `
+          Match:
+            Headers:
+              - Name: X-Canary
+                Value: "1"
+          Backends:
+            - Addr: ` + startNamedUpstream(t, "canary") + `
+`
+
+	c := &Config{}
+	if err := yaml.Unmarshal([]byte(config), c); err != nil {
+		t.Fatal(err)
+	}
+	s, url := startServer(t, c)
+	<-s.admin.adminServer.httpListener.readyCh
+	return url, "http://" + s.admin.adminServer.httpListener.listener.Addr().String()
+}
+
+func setWeights(t *testing.T, adminURL string, rule string, weights map[string]int) int {
+	b, _ := json.Marshal(weights)
+	req, _ := http.NewRequest("PUT", adminURL+"/splits/"+rule, bytes.NewReader(b))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestSplitWeights(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	url, _ := startSplit(t, 80, 20)
+
+	counts := map[string]int{}
+	for range 1000 {
+		counts[getBody(t, url, nil)]++
+	}
+
+	if counts["canary"] < 100 || counts["canary"] > 300 {
+		t.Fatalf("expected about 20%% of requests to be sent to the canary but got %v", counts)
+	}
+}
+
+func TestSplitHeader(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	url, _ := startSplit(t, 100, 0)
+
+	for range 10 {
+		if b := getBody(t, url, nil); b != "stable" {
+			t.Fatalf("expected stable but got %q", b)
+		}
+		if b := getBody(t, url, map[string]string{"X-Canary": "1"}); b != "canary" {
+			t.Fatalf("expected the header to select the canary but got %q", b)
+		}
+	}
+}
+
+func TestSplitSticky(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	url, adminURL := startSplit(t, 50, 50)
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	cookies := resp.Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "version" || cookies[0].Value != string(b) {
+		t.Fatalf("expected a cookie assigning the client to %s but got %v", b, cookies)
+	}
+	assigned := cookies[0].Value
+
+	get := func() (string, []*http.Cookie) {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.AddCookie(cookies[0])
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b), resp.Cookies()
+	}
+
+	for range 20 {
+		if b, set := get(); b != assigned || len(set) > 0 {
+			t.Fatalf("expected the client to stay on %s but got %s and cookies %v", assigned, b, set)
+		}
+	}
+
+	// Taking the weight away from a target moves its clients
+	other := "stable"
+	if assigned == "stable" {
+		other = "canary"
+	}
+	if status := setWeights(t, adminURL, "api", map[string]int{assigned: 0, other: 1}); status != http.StatusOK {
+		t.Fatalf("expected weights to be set but got %v", status)
+	}
+
+	b2, set := get()
+	if b2 != other || len(set) != 1 || set[0].Value != other {
+		t.Fatalf("expected the client to be moved to %s but got %s and cookies %v", other, b2, set)
+	}
+}
+
+func TestSplitAdmin(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	url, adminURL := startSplit(t, 100, 0)
+
+	cases := []struct {
+		n       string
+		rule    string
+		weights map[string]int
+		status  int
+	}{
+		{"UnknownRule", "web", map[string]int{"stable": 1}, http.StatusNotFound},
+		{"UnknownTarget", "api", map[string]int{"beta": 1}, http.StatusBadRequest},
+		{"Negative", "api", map[string]int{"stable": -1}, http.StatusBadRequest},
+		{"AllZero", "api", map[string]int{"stable": 0}, http.StatusBadRequest},
+		{"Empty", "api", map[string]int{}, http.StatusBadRequest},
+		{"Set", "api", map[string]int{"stable": 0, "canary": 100}, http.StatusOK},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			if status := setWeights(t, adminURL, c.rule, c.weights); status != c.status {
+				t.Fatalf("expected %v but got %v", c.status, status)
+			}
+		})
+	}
+
+	for range 10 {
+		if b := getBody(t, url, nil); b != "canary" {
+			t.Fatalf("expected the new weights to send requests to the canary but got %q", b)
+		}
+	}
+
+	resp, err := http.Get(adminURL + "/splits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var splits []SplitInfo
+	err = json.NewDecoder(resp.Body).Decode(&splits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []SplitTargetInfo{{"stable", 0}, {"canary", 100}}
+	if len(splits) != 1 || splits[0].Rule != "api" || splits[0].Cookie != "version" ||
+		len(splits[0].Targets) != 2 || splits[0].Targets[0] != expected[0] || splits[0].Targets[1] != expected[1] {
+		t.Fatalf("expected the split weights to be listed but got %+v", splits)
+	}
+}
@@ -0,0 +1,448 @@
+package butler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ProtocolHTTP  = "http"
+	ProtocolSCGI  = "scgi"
+	ProtocolUWSGI = "uwsgi"
+)
+
+const (
+	SchemeHTTP  = "http"
+	SchemeHTTPS = "https"
+)
+
+// UpstreamTLS configures connections to https backends. CAFile replaces the
+// system roots used to verify the backend, CertificateFile and
+// CertificateKeyFile are presented for mTLS, and ServerName overrides the
+// name sent with SNI and verified, which defaults to the host of Addr.
+// InsecureSkipVerify is for development only.
+type UpstreamTLS struct {
+	CAFile             string `yaml:"CAFile"`
+	CertificateFile    string `yaml:"CertificateFile"`
+	CertificateKeyFile string `yaml:"CertificateKeyFile"`
+	ServerName         string `yaml:"ServerName"`
+	InsecureSkipVerify bool   `yaml:"InsecureSkipVerify"`
+}
+
+const (
+	defaultMaxIdleConns          = 16
+	defaultIdleTimeout           = 90 * time.Second
+	defaultConnectTimeout        = 30 * time.Second
+	defaultResponseHeaderTimeout = 60 * time.Second
+	defaultMaxBufferedBody       = 8 << 20
+)
+
+var (
+	errUnknownProtocol     = errors.New("unknown backend protocol")
+	errRequestBodyTooLarge = errors.New("request body too large")
+)
+
+type clientAddrKey struct{}
+
+// withClientAddr records the address of the client a proxied request is made
+// for, so that transports can pass it on as REMOTE_ADDR.
+func withClientAddr(ctx context.Context, c *Context) context.Context {
+	if c.Conn == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, clientAddrKey{}, c.Conn.RemoteAddr().String())
+}
+
+// newTransport returns the transport used to send requests to b, over TLS
+// with tlsConfig if it is not nil. HTTP transports keep a pool of connections
+// to the backend, sized by b.MaxIdleConns and b.MaxConns.
+func newTransport(b Backend, tlsConfig *tls.Config) (http.RoundTripper, error) {
+	connectTimeout := b.ConnectTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+
+	if tlsConfig != nil && b.Protocol != "" && b.Protocol != ProtocolHTTP {
+		return nil, fmt.Errorf("%s backends do not support https", b.Protocol)
+	}
+
+	dial := backendDialer(b, connectTimeout)
+
+	switch b.Protocol {
+	case "", ProtocolHTTP:
+		maxIdleConns := b.MaxIdleConns
+		if maxIdleConns <= 0 {
+			maxIdleConns = defaultMaxIdleConns
+		}
+
+		idleTimeout := b.IdleTimeout
+		if idleTimeout <= 0 {
+			idleTimeout = defaultIdleTimeout
+		}
+
+		return &http.Transport{
+			DialContext:         dial,
+			MaxIdleConns:        maxIdleConns,
+			MaxIdleConnsPerHost: maxIdleConns,
+			MaxConnsPerHost:     b.MaxConns,
+			IdleConnTimeout:     idleTimeout,
+			TLSClientConfig:     tlsConfig,
+			// Responses are passed through to the client as they are
+			DisableCompression: true,
+		}, nil
+	}
+
+	maxBody := b.MaxBufferedBody
+	if maxBody <= 0 {
+		maxBody = defaultMaxBufferedBody
+	}
+
+	switch b.Protocol {
+	case ProtocolSCGI:
+		return scgiTransport{dial, maxBody}, nil
+	case ProtocolUWSGI:
+		return uwsgiTransport{dial, maxBody}, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", errUnknownProtocol, b.Protocol)
+}
+
+// backendHost is the host of URLs on b. Backends listening on unix sockets,
+// with an Addr of unix:/path, have no host of their own so use localhost.
+func backendHost(b Backend) string {
+	if network, _ := splitAddr(b.Addr); network == "unix" {
+		return "localhost"
+	}
+	return b.Addr
+}
+
+// backendURL returns the URL of path on b.
+func backendURL(b Backend, path string) string {
+	if b.Scheme == SchemeHTTPS {
+		return "https://" + backendHost(b) + path
+	}
+	return "http://" + backendHost(b) + path
+}
+
+type dialFunc func(ctx context.Context, network string, address string) (net.Conn, error)
+
+// backendDialer dials b, whether it listens on TCP or on a unix socket.
+func backendDialer(b Backend, connectTimeout time.Duration) dialFunc {
+	d := &net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}
+
+	network, address := splitAddr(b.Addr)
+	if network != "unix" {
+		return d.DialContext
+	}
+
+	return func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+		return d.DialContext(ctx, network, address)
+	}
+}
+
+// newUpstreamTLSConfig returns the TLS config for connections to b, or nil if
+// b is not https.
+func newUpstreamTLSConfig(b Backend) (*tls.Config, error) {
+	switch b.Scheme {
+	case "", SchemeHTTP:
+		return nil, nil
+	case SchemeHTTPS:
+	default:
+		return nil, fmt.Errorf("unknown backend scheme %s", b.Scheme)
+	}
+
+	config := &tls.Config{
+		ServerName:         b.TLS.ServerName,
+		InsecureSkipVerify: b.TLS.InsecureSkipVerify,
+	}
+
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(backendHost(b))
+		if err != nil {
+			host = backendHost(b)
+		}
+		config.ServerName = host
+	}
+
+	if b.TLS.CAFile != "" {
+		pem, err := os.ReadFile(b.TLS.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", b.TLS.CAFile)
+		}
+	}
+
+	if (b.TLS.CertificateFile == "") != (b.TLS.CertificateKeyFile == "") {
+		return nil, errors.New("both TLS CertificateFile and CertificateKeyFile must be set")
+	}
+
+	if b.TLS.CertificateFile != "" {
+		cert, err := tls.LoadX509KeyPair(b.TLS.CertificateFile, b.TLS.CertificateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// scgiTransport speaks SCGI, see https://python.ca/scgi/protocol.txt
+type scgiTransport struct {
+	dial    dialFunc
+	maxBody int64
+}
+
+func (t scgiTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	body, length, err := requestBody(r, t.maxBody)
+	if err != nil {
+		return nil, err
+	}
+
+	env := requestEnv(r, length)
+	env = append(env, "SCGI=1")
+
+	var headers []byte
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		headers = append(append(append(headers, k...), 0), v...)
+		headers = append(headers, 0)
+	}
+
+	conn, err := t.dial(r.Context(), "tcp", r.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	closer := interruptible(r, conn)
+
+	var buf bytes.Buffer
+	buf.WriteString(strconv.Itoa(len(headers)) + ":")
+	buf.Write(headers)
+	buf.WriteString(",")
+
+	err = writeRequest(conn, buf.Bytes(), body, length)
+	if err != nil {
+		closer.Close()
+		return nil, err
+	}
+
+	return readUpstreamResponse(bufio.NewReader(conn), closer, r)
+}
+
+// uwsgiTransport speaks the uwsgi binary protocol, see
+// https://uwsgi-docs.readthedocs.io/en/latest/Protocol.html
+type uwsgiTransport struct {
+	dial    dialFunc
+	maxBody int64
+}
+
+func (t uwsgiTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	body, length, err := requestBody(r, t.maxBody)
+	if err != nil {
+		return nil, err
+	}
+
+	var vars []byte
+	for _, kv := range requestEnv(r, length) {
+		k, v, _ := strings.Cut(kv, "=")
+		if len(k) > 0xffff || len(v) > 0xffff {
+			return nil, fmt.Errorf("uwsgi variable %s is too long", k)
+		}
+		vars = binary.LittleEndian.AppendUint16(vars, uint16(len(k)))
+		vars = append(vars, k...)
+		vars = binary.LittleEndian.AppendUint16(vars, uint16(len(v)))
+		vars = append(vars, v...)
+	}
+
+	if len(vars) > 0xffff {
+		return nil, errors.New("uwsgi variables are too long")
+	}
+
+	conn, err := t.dial(r.Context(), "tcp", r.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	closer := interruptible(r, conn)
+
+	// modifier1 0 is a WSGI request, modifier2 is unused
+	header := []byte{0, 0, 0, 0}
+	binary.LittleEndian.PutUint16(header[1:], uint16(len(vars)))
+
+	err = writeRequest(conn, append(header, vars...), body, length)
+	if err != nil {
+		closer.Close()
+		return nil, err
+	}
+
+	return readUpstreamResponse(bufio.NewReader(conn), closer, r)
+}
+
+// interruptible lets cancelling the context of r, such as when a backend
+// timeout expires, unblock reads and writes on conn. The closer returned
+// closes conn and stops watching the context.
+func interruptible(r *http.Request, conn net.Conn) io.Closer {
+	stop := context.AfterFunc(r.Context(), func() { conn.SetDeadline(time.Now()) })
+	return stopCloser{conn, stop}
+}
+
+type stopCloser struct {
+	io.Closer
+	stop func() bool
+}
+
+func (c stopCloser) Close() error {
+	c.stop()
+	return c.Closer.Close()
+}
+
+// requestBody returns the body of r and its length. Bodies of a known length
+// are streamed, while chunked bodies are buffered, up to limit, as SCGI and
+// uwsgi need the length up front.
+func requestBody(r *http.Request, limit int64) (io.Reader, int64, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return http.NoBody, 0, nil
+	}
+	if r.ContentLength > 0 {
+		return r.Body, r.ContentLength, nil
+	}
+
+	b, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if int64(len(b)) > limit {
+		return nil, 0, fmt.Errorf("%w: chunked bodies are limited to %d bytes", errRequestBodyTooLarge, limit)
+	}
+	return bytes.NewReader(b), int64(len(b)), nil
+}
+
+// writeRequest writes header to conn, followed by the length bytes of body.
+func writeRequest(conn net.Conn, header []byte, body io.Reader, length int64) error {
+	_, err := conn.Write(header)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(conn, io.LimitReader(body, length))
+	if err == nil && n < length {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// requestEnv builds CGI style variables for a proxied request. r.Host is the
+// backend, so the server variables come from the Host the client sent.
+func requestEnv(r *http.Request, contentLength int64) []string {
+	host := r.Header.Get(HeaderHost)
+	if host == "" {
+		host = r.Host
+	}
+
+	// SCGI requires CONTENT_LENGTH to be the first variable
+	env := []string{
+		"CONTENT_LENGTH=" + strconv.FormatInt(contentLength, 10),
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"SERVER_SOFTWARE=" + serverSoftware,
+		"SERVER_PROTOCOL=HTTP/1.1",
+		"REQUEST_METHOD=" + r.Method,
+		"REQUEST_URI=" + r.URL.RequestURI(),
+		"PATH_INFO=" + r.URL.Path,
+		"SCRIPT_NAME=",
+		"QUERY_STRING=" + r.URL.RawQuery,
+		"SERVER_NAME=" + normalizeHost(host),
+		"HTTP_HOST=" + host,
+	}
+
+	if _, port, err := net.SplitHostPort(host); err == nil {
+		env = append(env, "SERVER_PORT="+port)
+	}
+
+	if addr, ok := r.Context().Value(clientAddrKey{}).(string); ok {
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			env = append(env, "REMOTE_ADDR="+host, "REMOTE_PORT="+port)
+		}
+	}
+
+	return appendHeaderEnv(env, r.Header, true)
+}
+
+// readUpstreamResponse reads either an HTTP response, or a CGI style response
+// with a Status header. The body is streamed from conn, which is closed along
+// with it.
+func readUpstreamResponse(reader *bufio.Reader, conn io.Closer, r *http.Request) (*http.Response, error) {
+	peek, err := reader.Peek(5)
+	if err == nil && string(peek) == "HTTP/" {
+		resp, err := http.ReadResponse(reader, r)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		resp.Body = readCloser{resp.Body, conn}
+		return resp, nil
+	}
+
+	headers, err := textproto.NewReader(reader).ReadMIMEHeader()
+	if err != nil && !(err == io.EOF && len(headers) > 0) {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %s", errMalformedCGIResponse, err)
+	}
+
+	if headers.Get("Status") == "" && headers.Get(HeaderLocation) != "" {
+		headers.Set("Status", strconv.Itoa(http.StatusFound))
+	}
+
+	statusCode, err := cgiStatus(headers)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	headers.Del("Status")
+
+	contentLength := int64(-1)
+	if cl, err := strconv.ParseInt(headers.Get(HeaderContentLength), 10, 64); err == nil {
+		contentLength = cl
+	}
+
+	return &http.Response{
+		Status:        strconv.Itoa(statusCode) + " " + http.StatusText(statusCode),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header(headers),
+		Body:          readCloser{reader, conn},
+		ContentLength: contentLength,
+		Request:       r,
+	}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,522 @@
+package butler
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveUpstream accepts connections on a test listener and hands each one to
+// serve, closing it afterwards.
+func serveUpstream(t *testing.T, serve func(conn net.Conn, reader *bufio.Reader)) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				serve(conn, bufio.NewReader(conn))
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// scgiServer echoes the request method, path and body
+func scgiServer(conn net.Conn, reader *bufio.Reader) {
+	length, _ := reader.ReadString(':')
+	n, _ := strconv.Atoi(strings.TrimSuffix(length, ":"))
+	headers := make([]byte, n+1)
+	io.ReadFull(reader, headers)
+
+	vars := make(map[string]string)
+	fields := bytes.Split(headers[:n], []byte{0})
+	for i := 0; i+1 < len(fields); i += 2 {
+		vars[string(fields[i])] = string(fields[i+1])
+	}
+
+	cl, _ := strconv.Atoi(vars["CONTENT_LENGTH"])
+	body := make([]byte, cl)
+	io.ReadFull(reader, body)
+
+	status := "200 OK"
+	if vars["PATH_INFO"] == "/missing" {
+		status = "404 Not Found"
+	}
+
+	fmt.Fprintf(conn, "Status: %s\r\nContent-Type: text/plain\r\n\r\n%s %s %s %s",
+		status, vars["REQUEST_METHOD"], vars["PATH_INFO"], vars["HTTP_X_TEST"], body)
+}
+
+// uwsgiServer echoes the request method, path and body
+func uwsgiServer(conn net.Conn, reader *bufio.Reader) {
+	header := make([]byte, 4)
+	io.ReadFull(reader, header)
+	data := make([]byte, binary.LittleEndian.Uint16(header[1:]))
+	io.ReadFull(reader, data)
+
+	vars := make(map[string]string)
+	for len(data) > 0 {
+		kl := binary.LittleEndian.Uint16(data)
+		k := string(data[2 : 2+kl])
+		data = data[2+kl:]
+		vl := binary.LittleEndian.Uint16(data)
+		vars[k] = string(data[2 : 2+vl])
+		data = data[2+vl:]
+	}
+
+	cl, _ := strconv.Atoi(vars["CONTENT_LENGTH"])
+	body := make([]byte, cl)
+	io.ReadFull(reader, body)
+
+	status := "200 OK"
+	if vars["PATH_INFO"] == "/missing" {
+		status = "404 Not Found"
+	}
+
+	fmt.Fprintf(conn, "HTTP/1.1 %s\r\nContent-Type: text/plain\r\n\r\n%s %s %s %s",
+		status, vars["REQUEST_METHOD"], vars["PATH_INFO"], vars["HTTP_X_TEST"], body)
+}
+
+func TestUpstreamProtocols(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	cases := []struct {
+		p string
+		s func(conn net.Conn, reader *bufio.Reader)
+	}{
+		{p: ProtocolSCGI, s: scgiServer},
+		{p: ProtocolUWSGI, s: uwsgiServer},
+	}
+
+	for _, c := range cases {
+		t.Run(c.p, func(t *testing.T) {
+			b := Backend{Addr: serveUpstream(t, c.s), Path: "/", Protocol: c.p}
+			proxy, err := NewServer(&Config{
+				Listen:    0,
+				ListenTLS: -1,
+				Backends:  []Backend{b},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			go proxy.Listen()
+			defer proxy.Close()
+			<-proxy.httpListener.readyCh
+
+			req, _ := http.NewRequest("POST", "http://"+proxy.httpListener.listener.Addr().String()+"/echo", strings.NewReader("body"))
+			req.Header.Set("X-Test", "header")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || string(got) != "POST /echo header body" {
+				t.Fatalf("expected 200 %q but got %v %q", "POST /echo header body", resp.StatusCode, got)
+			}
+
+			resp, err = http.Get("http://" + proxy.httpListener.listener.Addr().String() + "/missing")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNotFound {
+				t.Fatalf("expected 404 but got %v", resp.StatusCode)
+			}
+
+			healthy, err := checkHealth(healthCheck{b: b}, nil)
+			if !healthy || err != nil {
+				t.Fatalf("expected %v backend to be healthy: %v", c.p, err)
+			}
+		})
+	}
+}
+
+func TestRequestEnv(t *testing.T) {
+	// As the proxy sends it, addressed to the backend
+	r, _ := http.NewRequest("GET", "http://10.0.0.1:9000/app?a=1", nil)
+	r.Header.Set(HeaderHost, "www.example.com:8080")
+	r.Header.Set("X-Test", "header")
+
+	vars := map[string][]string{}
+	for _, kv := range requestEnv(r, 0) {
+		k, v, _ := strings.Cut(kv, "=")
+		vars[k] = append(vars[k], v)
+	}
+
+	expected := map[string]string{
+		"HTTP_HOST":    "www.example.com:8080",
+		"SERVER_NAME":  "www.example.com",
+		"SERVER_PORT":  "8080",
+		"QUERY_STRING": "a=1",
+		"HTTP_X_TEST":  "header",
+	}
+	for k, v := range expected {
+		if len(vars[k]) != 1 || vars[k][0] != v {
+			t.Fatalf("expected %s to be %q once but got %q", k, v, vars[k])
+		}
+	}
+
+	for k, vs := range vars {
+		if len(vs) > 1 {
+			t.Fatalf("expected %s once but got %q", k, vs)
+		}
+	}
+}
+
+func TestUpstreamProtocolBodies(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	cases := []struct {
+		p string
+		s func(conn net.Conn, reader *bufio.Reader)
+	}{
+		{p: ProtocolSCGI, s: scgiServer},
+		{p: ProtocolUWSGI, s: uwsgiServer},
+	}
+
+	for _, c := range cases {
+		t.Run(c.p, func(t *testing.T) {
+			// Reports the request to the test before it echoes the body
+			headers := make(chan struct{}, 1)
+			addr := serveUpstream(t, func(conn net.Conn, reader *bufio.Reader) {
+				reader.Peek(1)
+				select {
+				case headers <- struct{}{}:
+				default:
+				}
+				c.s(conn, reader)
+			})
+			b := Backend{Addr: addr, Path: "/", Protocol: c.p, MaxBufferedBody: 8, BreakerThreshold: 1, BreakerCooldown: time.Millisecond}
+			s, proxy := startServer(t, &Config{Listen: 0, ListenTLS: -1, Backends: []Backend{b}})
+
+			post := func(body io.Reader, contentLength int64) (int, string) {
+				req, _ := http.NewRequest("POST", proxy+"/echo", body)
+				req.ContentLength = contentLength
+				req.Header.Set("X-Test", "header")
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				b, _ := io.ReadAll(resp.Body)
+				return resp.StatusCode, string(b)
+			}
+
+			t.Run("Streamed", func(t *testing.T) {
+				pr, pw := io.Pipe()
+				go func() {
+					pw.Write([]byte("streamed "))
+					// The backend has the request before the body is complete
+					select {
+					case <-headers:
+						pw.Write([]byte("body"))
+						pw.Close()
+					case <-time.After(5 * time.Second):
+						pw.CloseWithError(fmt.Errorf("the request was not streamed"))
+					}
+				}()
+
+				status, body := post(pr, int64(len("streamed body")))
+				if status != http.StatusOK || body != "POST /echo header streamed body" {
+					t.Fatalf("expected the body to be streamed but got %v %q", status, body)
+				}
+			})
+
+			t.Run("Chunked", func(t *testing.T) {
+				status, body := post(io.NopCloser(strings.NewReader("chunked")), -1)
+				if status != http.StatusOK || body != "POST /echo header chunked" {
+					t.Fatalf("expected the chunked body to be buffered but got %v %q", status, body)
+				}
+			})
+
+			t.Run("ChunkedTooLarge", func(t *testing.T) {
+				status, _ := post(io.NopCloser(strings.NewReader("too large")), -1)
+				if status != http.StatusRequestEntityTooLarge {
+					t.Fatalf("expected %v but got %v", http.StatusRequestEntityTooLarge, status)
+				}
+			})
+
+			t.Run("ChunkedTooLargeProbe", func(t *testing.T) {
+				u := s.member(b)
+				u.breaker.failure()
+				time.Sleep(10 * time.Millisecond)
+
+				// The probe is not sent, so it says nothing about the backend
+				if status, _ := post(io.NopCloser(strings.NewReader("too large")), -1); status != http.StatusRequestEntityTooLarge {
+					t.Fatalf("expected %v but got %v", http.StatusRequestEntityTooLarge, status)
+				}
+				if status, _ := post(io.NopCloser(strings.NewReader("chunked")), -1); status != http.StatusOK {
+					t.Fatalf("expected the next request to probe the backend but got %v with the breaker %s", status, u.breaker.health().State)
+				}
+			})
+		})
+	}
+}
+
+func TestUpstreamProtocolTimeouts(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	// Accepts requests but never answers them
+	hang := func(conn net.Conn, reader *bufio.Reader) {
+		io.Copy(io.Discard, reader)
+	}
+
+	cases := []struct {
+		n string
+		b Backend
+	}{
+		{"SCGIResponseHeader", Backend{Protocol: ProtocolSCGI, ResponseHeaderTimeout: 50 * time.Millisecond}},
+		{"SCGITotal", Backend{Protocol: ProtocolSCGI, Timeout: 50 * time.Millisecond}},
+		{"UWSGIResponseHeader", Backend{Protocol: ProtocolUWSGI, ResponseHeaderTimeout: 50 * time.Millisecond}},
+		{"UWSGITotal", Backend{Protocol: ProtocolUWSGI, Timeout: 50 * time.Millisecond}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			c.b.Addr = serveUpstream(t, hang)
+			c.b.Path = "/"
+			proxy := startProxy(t, c.b)
+
+			start := time.Now()
+			resp, err := http.Get(proxy + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusGatewayTimeout {
+				t.Fatalf("expected %v but got %v", http.StatusGatewayTimeout, resp.StatusCode)
+			}
+			if time.Since(start) > 2*time.Second {
+				t.Fatal("expected the timeout to cut the request short")
+			}
+		})
+	}
+}
+
+func TestUnknownProtocol(t *testing.T) {
+	_, err := NewServer(&Config{
+		Listen:    0,
+		ListenTLS: -1,
+		Backends:  []Backend{{Addr: "localhost:3000", Path: "/", Protocol: "gopher"}},
+	})
+	if err == nil {
+		t.Fatal("expected an unknown protocol to be rejected")
+	}
+}
+
+// writeUpstreamCA writes the certificate of a TLS test server, so that it can
+// be trusted as a CA.
+func writeUpstreamCA(t *testing.T, upstream *httptest.Server) string {
+	name := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestHTTPSBackend(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	clientCert, clientKey := writeCertificate(t, "butler")
+	clientPEM, _ := os.ReadFile(clientCert)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientPEM)
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/mtls" && len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("secure " + r.TLS.ServerName))
+	}))
+	upstream.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: clientCAs}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	addr := upstream.Listener.Addr().String()
+	ca := writeUpstreamCA(t, upstream)
+
+	cases := []struct {
+		n        string
+		tls      UpstreamTLS
+		path     string
+		status   int
+		expected string
+	}{
+		{"CA", UpstreamTLS{CAFile: ca}, "/", http.StatusOK, "secure "},
+		{"UnknownCA", UpstreamTLS{}, "/", http.StatusBadGateway, ""},
+		{"SkipVerify", UpstreamTLS{InsecureSkipVerify: true}, "/", http.StatusOK, "secure "},
+		{"SNI", UpstreamTLS{CAFile: ca, ServerName: "example.com"}, "/", http.StatusOK, "secure example.com"},
+		{"WrongName", UpstreamTLS{CAFile: ca, ServerName: "example.org"}, "/", http.StatusBadGateway, ""},
+		{"MTLS", UpstreamTLS{CAFile: ca, CertificateFile: clientCert, CertificateKeyFile: clientKey}, "/mtls", http.StatusOK, "secure "},
+		{"MissingClientCert", UpstreamTLS{CAFile: ca}, "/mtls", http.StatusForbidden, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			b := Backend{Addr: addr, Path: "/", Scheme: SchemeHTTPS, TLS: c.tls}
+			proxy := startProxy(t, b)
+
+			resp, err := http.Get(proxy + c.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != c.status || c.expected != "" && string(got) != c.expected {
+				t.Fatalf("expected %v %q but got %v %q", c.status, c.expected, resp.StatusCode, got)
+			}
+
+			if c.status == http.StatusOK {
+				healthy, err := checkHealth(healthCheck{b: b}, nil)
+				if !healthy || err != nil {
+					t.Fatalf("expected the health check to use the TLS settings: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPSBackendInvalid(t *testing.T) {
+	cases := []struct {
+		n string
+		b Backend
+	}{
+		{"Scheme", Backend{Scheme: "ftp"}},
+		{"MissingCA", Backend{Scheme: SchemeHTTPS, TLS: UpstreamTLS{CAFile: "/missing.pem"}}},
+		{"HalfKeyPair", Backend{Scheme: SchemeHTTPS, TLS: UpstreamTLS{CertificateFile: "/cert.pem"}}},
+		{"Protocol", Backend{Scheme: SchemeHTTPS, Protocol: ProtocolSCGI}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			c.b.Addr, c.b.Path = "localhost:3000", "/"
+			_, err := NewServer(&Config{Listen: 0, ListenTLS: -1, Backends: []Backend{c.b}})
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+// unixSocket returns the path of a unix socket in a new temporary directory,
+// kept short as socket paths are limited to around 100 bytes.
+func unixSocket(t *testing.T) string {
+	dir, err := os.MkdirTemp("", "butler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return filepath.Join(dir, "backend.sock")
+}
+
+func TestUnixSocketBackend(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	socket := unixSocket(t)
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var conns atomic.Int32
+	upstream := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", r.Host, r.URL.Path)
+		}),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				conns.Add(1)
+			}
+		},
+	}
+	go upstream.Serve(l)
+	defer upstream.Close()
+
+	b := Backend{Addr: "unix:" + socket, Path: "/"}
+	_, url := startServer(t, &Config{Listen: 0, ListenTLS: -1, Backends: []Backend{b}})
+
+	for i := 0; i < 3; i++ {
+		if got := getBody(t, url+"/app", nil); got != "localhost /app" {
+			t.Fatalf("expected %q but got %q", "localhost /app", got)
+		}
+	}
+
+	if n := conns.Load(); n != 1 {
+		t.Fatalf("expected requests to share 1 connection but used %v", n)
+	}
+
+	healthy, err := checkHealth(healthCheck{b: b}, nil)
+	if !healthy || err != nil {
+		t.Fatalf("expected unix socket backend to be healthy: %v", err)
+	}
+}
+
+func TestUnixSocketSCGIBackend(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	socket := unixSocket(t)
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				scgiServer(conn, bufio.NewReader(conn))
+			}()
+		}
+	}()
+
+	_, url := startServer(t, &Config{
+		Listen:    0,
+		ListenTLS: -1,
+		Backends:  []Backend{{Addr: "unix:" + socket, Path: "/", Protocol: ProtocolSCGI}},
+	})
+
+	if got := getBody(t, url+"/echo", nil); got != "GET /echo  " {
+		t.Fatalf("expected %q but got %q", "GET /echo  ", got)
+	}
+}
@@ -0,0 +1,193 @@
+package butler
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultTunnelIdleTimeout = 5 * time.Minute
+
+// isUpgrade reports whether r asks to switch protocols, such as to WebSocket.
+func isUpgrade(r *Request) bool {
+	if r.Header(HeaderUpgrade) == "" {
+		return false
+	}
+
+	for _, v := range r.HeaderValues(HeaderConnection) {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tunnel is an upstream connection that has switched protocols. Once the 101
+// response has been written, the listener splices it with the client.
+type tunnel struct {
+	conn        net.Conn
+	reader      *bufio.Reader
+	idleTimeout time.Duration
+	// done is called once the tunnel is closed
+	done func()
+}
+
+// dialUpgrade sends the upgrade request r to u on a connection of its own, as
+// the connection leaves the pool once the protocol is switched.
+func dialUpgrade(ctx context.Context, u *upstream, r *http.Request) (*http.Response, *tunnel, error) {
+	connectTimeout := u.b.ConnectTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+
+	conn, err := backendDialer(u.b, connectTimeout)(ctx, "tcp", r.URL.Host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if u.tlsConfig != nil {
+		tlsConn := tls.Client(conn, u.tlsConfig)
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = tlsConn
+	}
+
+	// Cancelling ctx, such as when the response header timeout expires,
+	// unblocks the exchange below
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	err = r.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, r)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if !stop() {
+		resp.Body.Close()
+		conn.Close()
+		return nil, nil, ctx.Err()
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body = readCloser{resp.Body, conn}
+		return resp, nil, nil
+	}
+
+	idleTimeout := u.b.TunnelIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultTunnelIdleTimeout
+	}
+
+	return resp, &tunnel{conn: conn, reader: reader, idleTimeout: idleTimeout}, nil
+}
+
+// splice copies between the client and the upstream until both sides have
+// finished sending, or neither has sent anything for the idle timeout. Each
+// side's end of stream is passed on with a half-close, so that the other side
+// can still finish sending.
+func (t *tunnel) splice(client net.Conn, clientReader io.Reader) {
+	defer t.close()
+	defer client.Close()
+
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	closed := make(chan struct{})
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			close(closed)
+			client.Close()
+			t.conn.Close()
+		})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		t.copy(t.conn, clientReader, &lastActive, closeBoth)
+	}()
+	go func() {
+		defer wg.Done()
+		t.copy(client, t.reader, &lastActive, closeBoth)
+	}()
+
+	go func() {
+		ticker := time.NewTicker(t.idleTimeout / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-closed:
+				return
+			case <-ticker.C:
+				if time.Since(time.Unix(0, lastActive.Load())) >= t.idleTimeout {
+					slog.Debug(fmt.Sprintf("closing idle tunnel to %s", t.conn.RemoteAddr()))
+					closeBoth()
+					return
+				}
+			}
+		}
+	}()
+
+	wg.Wait()
+	closeBoth()
+}
+
+// close closes the upstream connection and releases the backend.
+func (t *tunnel) close() {
+	t.conn.Close()
+	if t.done != nil {
+		t.done()
+	}
+}
+
+func (t *tunnel) copy(dst net.Conn, src io.Reader, lastActive *atomic.Int64, closeBoth func()) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			lastActive.Store(time.Now().UnixNano())
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				closeBoth()
+				return
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			if cw, ok := dst.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+				return
+			}
+			// Without a half-close, the other side would never finish
+			closeBoth()
+			return
+		}
+		if err != nil {
+			closeBoth()
+			return
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package butler
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startUpgradeUpstream switches to an echo protocol, and says bye once the
+// client has finished sending.
+func startUpgradeUpstream(t *testing.T) string {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" || r.Header.Get("Connection") != "Upgrade" {
+			w.Write([]byte("not upgraded"))
+			return
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\nX-Echo: yes\r\n\r\n")
+		rw.Flush()
+
+		io.Copy(conn, rw)
+		conn.Write([]byte("bye"))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream.Listener.Addr().String()
+}
+
+func dialUpgraded(t *testing.T, proxy string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxy, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: keep-alive, Upgrade\r\nUpgrade: echo\r\n\r\nearly"))
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "echo" || resp.Header.Get("X-Echo") != "yes" {
+		t.Fatalf("expected 101 but got %v %v", resp.StatusCode, resp.Header)
+	}
+	return conn, reader
+}
+
+func TestBackendUpgrade(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	proxy := startProxy(t, Backend{Addr: startUpgradeUpstream(t), Path: "/"})
+	conn, reader := dialUpgraded(t, proxy)
+
+	conn.Write([]byte(" hello"))
+	buf := make([]byte, len("early hello"))
+	if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "early hello" {
+		t.Fatalf("expected echo but got %q (%v)", buf, err)
+	}
+
+	// The upstream can still send once the client has finished
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	rest, err := io.ReadAll(reader)
+	if err != nil || string(rest) != "bye" {
+		t.Fatalf("expected bye after half-close but got %q (%v)", rest, err)
+	}
+}
+
+func TestBackendUpgradeIdleTimeout(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	proxy := startProxy(t, Backend{Addr: startUpgradeUpstream(t), Path: "/", TunnelIdleTimeout: 100 * time.Millisecond})
+	conn, reader := dialUpgraded(t, proxy)
+
+	buf := make([]byte, len("early"))
+	io.ReadFull(reader, buf)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := reader.ReadByte()
+	if err != io.EOF {
+		t.Fatalf("expected the idle tunnel to be closed but got %v", err)
+	}
+}
+
+func TestBackendUpgradeRefused(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("plain"))
+	}))
+	defer upstream.Close()
+
+	proxy := startProxy(t, Backend{Addr: upstream.Listener.Addr().String(), Path: "/"})
+
+	req, _ := http.NewRequest("GET", proxy+"/", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(b) != "plain" {
+		t.Fatalf("expected a plain response but got %v %q", resp.StatusCode, b)
+	}
+}
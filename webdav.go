@@ -0,0 +1,366 @@
+package butler
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	RequestPut      = "PUT"
+	RequestDelete   = "DELETE"
+	RequestMkcol    = "MKCOL"
+	RequestPropfind = "PROPFIND"
+	RequestOptions  = "OPTIONS"
+
+	defaultWebDAVMaxSize = 100 << 20
+	// maxPropfindBody bounds the PROPFIND request body, which is ignored
+	maxPropfindBody = 1 << 20
+)
+
+// WebDAV lets authenticated clients write to the document root under Path.
+// Users maps user names to the bcrypt hash of their password, as created by
+// htpasswd -nbB.
+// Methods limits the writes allowed, defaulting to PUT, DELETE and MKCOL.
+// PROPFIND and OPTIONS are always allowed to authenticated clients, so that
+// WebDAV clients can mount Path.
+type WebDAV struct {
+	Path    string            `yaml:"Path"`
+	Users   map[string]string `yaml:"Users"`
+	Methods []string          `yaml:"Methods"`
+	MaxSize int64             `yaml:"MaxSize"`
+}
+
+type webdavHandler struct {
+	dav     WebDAV
+	docRoot string
+}
+
+func newWebDAVHandler(dav WebDAV, docRoot string) (webdavHandler, error) {
+	if docRoot == "" {
+		return webdavHandler{}, errors.New("WebDAV requires DocumentRoot to be set")
+	}
+
+	if len(dav.Users) == 0 {
+		return webdavHandler{}, errors.New("WebDAV requires at least one user")
+	}
+
+	for user, hash := range dav.Users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return webdavHandler{}, fmt.Errorf("WebDAV user %s: password must be a bcrypt hash: %w", user, err)
+		}
+	}
+
+	if dav.Path == "" {
+		dav.Path = "/"
+	}
+
+	if len(dav.Methods) == 0 {
+		dav.Methods = []string{RequestPut, RequestDelete, RequestMkcol}
+	}
+
+	if dav.MaxSize <= 0 {
+		dav.MaxSize = defaultWebDAVMaxSize
+	}
+
+	return webdavHandler{dav, docRoot}, nil
+}
+
+func (h webdavHandler) Handle(c *Context) (bool, error) {
+	urlPath, _, _ := strings.Cut(c.Request.Path, "?")
+	urlPath = path.Clean("/" + urlPath)
+	if !hasPathPrefix(urlPath, h.dav.Path) {
+		return false, nil
+	}
+
+	method := c.Request.Method
+	if method != RequestOptions && method != RequestPropfind && !slices.Contains(h.dav.Methods, method) {
+		if method == RequestGet || method == RequestHead {
+			return false, nil
+		}
+
+		c.Response = MethodNotAllowed()
+		return true, nil
+	}
+
+	if !h.authenticate(c.Request) {
+		c.Response = Unauthorized()
+		c.Response.Headers["WWW-Authenticate"] = []string{`Basic realm="butler"`}
+		return true, nil
+	}
+
+	name := filepath.Join(h.docRoot, filepath.FromSlash(urlPath))
+
+	var err error
+	switch method {
+	case RequestOptions:
+		c.Response = StatusCode(http.StatusOK, nil)
+		c.Response.Headers["DAV"] = []string{"1"}
+		c.Response.Headers["Allow"] = []string{strings.Join(append([]string{RequestOptions, RequestPropfind, RequestGet, RequestHead}, h.dav.Methods...), ", ")}
+	case RequestPut:
+		c.Response, err = h.put(c.Request, name)
+	case RequestDelete:
+		c.Response, err = h.delete(urlPath, name)
+	case RequestMkcol:
+		c.Response, err = h.mkcol(c.Request, name)
+	case RequestPropfind:
+		c.Response, err = h.propfind(c.Request, urlPath, name)
+	default:
+		c.Response = MethodNotAllowed()
+	}
+
+	if err != nil {
+		slog.Error(fmt.Sprintf("webdav %s %s failed: %s", method, urlPath, err))
+		c.Response = InternalServerError()
+		// The body may be partially read
+		c.closeConn = true
+	}
+
+	if c.Response.StatusCode == http.StatusRequestEntityTooLarge {
+		// Rather than reading the rest of a body that is too large
+		c.closeConn = true
+	}
+
+	return true, nil
+}
+
+func (h webdavHandler) authenticate(r *Request) bool {
+	hAuth := r.Headers[HeaderAuthorization]
+	if len(hAuth) == 0 {
+		return false
+	}
+
+	scheme, credentials, _ := strings.Cut(hAuth[0], " ")
+	if !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return false
+	}
+
+	user, password, _ := strings.Cut(string(decoded), ":")
+	expected, ok := h.dav.Users[user]
+	if !ok {
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(expected), []byte(password)) == nil
+}
+
+// put writes the body to a temporary file next to name and renames it into
+// place, so readers never see a partially written file.
+func (h webdavHandler) put(r *Request, name string) (*Response, error) {
+	if r.ContentLength > h.dav.MaxSize {
+		return RequestEntityTooLarge(), nil
+	}
+
+	fi, err := os.Stat(name)
+	if err == nil && fi.IsDir() {
+		return MethodNotAllowed(), nil
+	}
+	exists := err == nil
+
+	dir, err := os.Stat(filepath.Dir(name))
+	if err != nil || !dir.IsDir() {
+		return Conflict(), nil
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(name), ".butler-put-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+
+	written, err := io.Copy(f, io.LimitReader(r.BodyReader(), h.dav.MaxSize+1))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if written > h.dav.MaxSize {
+		return RequestEntityTooLarge(), nil
+	}
+
+	err = os.Chmod(f.Name(), 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Rename(f.Name(), name)
+	if err != nil {
+		return nil, err
+	}
+
+	if exists {
+		return StatusCode(http.StatusNoContent, nil), nil
+	}
+	return StatusCode(http.StatusCreated, nil), nil
+}
+
+func (h webdavHandler) delete(urlPath string, name string) (*Response, error) {
+	if urlPath == path.Clean(h.dav.Path) {
+		return Forbidden(), nil
+	}
+
+	_, err := os.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return NotFound(), nil
+	}
+
+	err = os.RemoveAll(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return StatusCode(http.StatusNoContent, nil), nil
+}
+
+func (h webdavHandler) mkcol(r *Request, name string) (*Response, error) {
+	if r.ContentLength != 0 {
+		return UnsupportedMediaType(), nil
+	}
+
+	_, err := os.Stat(name)
+	if err == nil {
+		return MethodNotAllowed(), nil
+	}
+
+	err = os.Mkdir(name, 0755)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Conflict(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return StatusCode(http.StatusCreated, nil), nil
+}
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	Namespace string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength string          `xml:"D:getcontentlength,omitempty"`
+	ContentType   string          `xml:"D:getcontenttype,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+// propfind lists the properties of name, and of its children if Depth is 1.
+// All properties are returned regardless of which were asked for.
+func (h webdavHandler) propfind(r *Request, urlPath string, name string) (*Response, error) {
+	depth := "infinity"
+	if hDepth := r.Headers["Depth"]; len(hDepth) > 0 {
+		depth = hDepth[0]
+	}
+
+	if depth != "0" && depth != "1" {
+		// Listing a whole tree is too expensive, see RFC 4918 section 9.1
+		return Forbidden(), nil
+	}
+
+	_, complete, err := r.bufferBody(maxPropfindBody)
+	if err != nil {
+		return nil, err
+	}
+	if !complete {
+		return RequestEntityTooLarge(), nil
+	}
+
+	fi, err := os.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return NotFound(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ms := davMultistatus{Namespace: "DAV:", Responses: []davResponse{davResponseFor(urlPath, fi)}}
+
+	if fi.IsDir() && depth == "1" {
+		entries, err := os.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			efi, err := e.Info()
+			if err != nil {
+				continue
+			}
+			ms.Responses = append(ms.Responses, davResponseFor(path.Join(urlPath, e.Name()), efi))
+		}
+	}
+
+	b, err := xml.Marshal(ms)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := StatusCode(http.StatusMultiStatus, append([]byte(xml.Header), b...))
+	resp.Headers[HeaderContentType] = []string{`application/xml; charset="utf-8"`}
+	return resp, nil
+}
+
+func davResponseFor(urlPath string, fi fs.FileInfo) davResponse {
+	href := (&url.URL{Path: urlPath}).EscapedPath()
+	prop := davProp{
+		DisplayName:  fi.Name(),
+		LastModified: fi.ModTime().UTC().Format(http.TimeFormat),
+	}
+
+	if fi.IsDir() {
+		prop.ResourceType.Collection = &struct{}{}
+		if !strings.HasSuffix(href, "/") {
+			href += "/"
+		}
+	} else {
+		prop.ContentLength = strconv.FormatInt(fi.Size(), 10)
+		prop.ContentType = mime.TypeByExtension(filepath.Ext(fi.Name()))
+	}
+
+	return davResponse{
+		Href:     href,
+		Propstat: davPropstat{Prop: prop, Status: "HTTP/1.1 200 OK"},
+	}
+}
@@ -0,0 +1,144 @@
+package butler
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestWebDAV(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "uploads"), 0755)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewServer(&Config{
+		Host:         "localhost",
+		Listen:       0,
+		ListenTLS:    -1,
+		DocumentRoot: dir,
+		WebDAV: []WebDAV{
+			{Path: "/uploads", Users: map[string]string{"alice": string(hash)}, MaxSize: 16},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go s.Listen()
+	defer s.Close()
+	<-s.httpListener.readyCh
+
+	addr := "http://" + s.httpListener.listener.Addr().String()
+
+	cases := []struct {
+		m string
+		p string
+		b string
+		h map[string]string
+		u string
+		s int
+		n string
+	}{
+		{m: "PUT", p: "/uploads/a.txt", b: "hello", s: http.StatusUnauthorized, n: "Unauthenticated"},
+		{m: "PUT", p: "/uploads/a.txt", b: "hello", u: "wrong", s: http.StatusUnauthorized, n: "WrongPassword"},
+		{m: "PUT", p: "/uploads/a.txt", b: "hello", u: "secret", s: http.StatusCreated, n: "Create"},
+		{m: "GET", p: "/uploads/a.txt", s: http.StatusOK, n: "Read"},
+		{m: "PUT", p: "/uploads/a.txt", b: "hello again", u: "secret", s: http.StatusNoContent, n: "Replace"},
+		{m: "PUT", p: "/uploads/a.txt", b: "this body is far too large", u: "secret", s: http.StatusRequestEntityTooLarge, n: "TooLarge"},
+		{m: "PUT", p: "/uploads/missing/a.txt", b: "hello", u: "secret", s: http.StatusConflict, n: "MissingParent"},
+		{m: "PUT", p: "/a.txt", b: "hello", u: "secret", s: http.StatusNotFound, n: "OutsidePolicy"},
+		{m: "MKCOL", p: "/uploads/dir", u: "secret", s: http.StatusCreated, n: "Mkcol"},
+		{m: "MKCOL", p: "/uploads/dir", u: "secret", s: http.StatusMethodNotAllowed, n: "MkcolExists"},
+		{m: "PUT", p: "/uploads/dir/b.txt", b: "nested", u: "secret", s: http.StatusCreated, n: "CreateNested"},
+		{m: "PROPFIND", p: "/uploads", h: map[string]string{"Depth": "1"}, u: "secret", s: http.StatusMultiStatus, n: "Propfind"},
+		{m: "PROPFIND", p: "/uploads", u: "secret", s: http.StatusForbidden, n: "PropfindInfinity"},
+		{m: "PROPFIND", p: "/uploads", b: strings.Repeat("a", maxPropfindBody+1), h: map[string]string{"Depth": "1"}, u: "secret", s: http.StatusRequestEntityTooLarge, n: "PropfindTooLarge"},
+		{m: "DELETE", p: "/uploads/dir", u: "secret", s: http.StatusNoContent, n: "Delete"},
+		{m: "DELETE", p: "/uploads/dir", u: "secret", s: http.StatusNotFound, n: "DeleteMissing"},
+		{m: "DELETE", p: "/uploads", u: "secret", s: http.StatusForbidden, n: "DeleteRoot"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			req, _ := http.NewRequest(c.m, addr+c.p, strings.NewReader(c.b))
+			if c.u != "" {
+				req.SetBasicAuth("alice", c.u)
+			}
+			for k, v := range c.h {
+				req.Header.Set(k, v)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != c.s {
+				t.Fatalf("expected %v but got %v", c.s, resp.StatusCode)
+			}
+		})
+	}
+
+	req, _ := http.NewRequest("PROPFIND", addr+"/uploads", nil)
+	req.SetBasicAuth("alice", "secret")
+	req.Header.Set("Depth", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ms, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, expected := range []string{"<D:href>/uploads/</D:href>", "<D:collection></D:collection>", "<D:href>/uploads/a.txt</D:href>", "<D:getcontentlength>11</D:getcontentlength>"} {
+		if !strings.Contains(string(ms), expected) {
+			t.Fatalf("expected PROPFIND response to contain %v but got %s", expected, ms)
+		}
+	}
+
+	b, _ := os.ReadFile(filepath.Join(dir, "uploads", "a.txt"))
+	if string(b) != "hello again" {
+		t.Fatalf("expected replaced content but got %q", b)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); err == nil {
+		t.Fatal("write outside of the policy path should not have been allowed")
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(dir, "uploads"))
+	if len(entries) != 1 {
+		t.Fatalf("expected temporary files to be cleaned up but got %v", entries)
+	}
+}
+
+func TestWebDAVInvalid(t *testing.T) {
+	cases := []struct {
+		n       string
+		docRoot string
+		dav     WebDAV
+	}{
+		{"NoDocumentRoot", "", WebDAV{Users: map[string]string{"alice": "$2a$04$00000000000000000000000000000000000000000000000000000"}}},
+		{"NoUsers", t.TempDir(), WebDAV{}},
+		{"NotHashed", t.TempDir(), WebDAV{Users: map[string]string{"alice": "secret"}}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.n, func(t *testing.T) {
+			_, err := newWebDAVHandler(c.dav, c.docRoot)
+			if err == nil {
+				t.Fatal("expected the config to be rejected")
+			}
+		})
+	}
+}